@@ -19,6 +19,22 @@ type OauthConfig struct {
 	AuthCodeLifetime     int
 }
 
+// PasswordConfig stores the password policy, a zero MinLength means the
+// oauth package default
+type PasswordConfig struct {
+	MinLength        int
+	RequireUppercase bool
+	RequireNumbers   bool
+	RequireSymbols   bool
+}
+
+// SecurityConfig stores token security options, when TokenEncryption is
+// set tokens are stored as HMAC hashes keyed with EncryptionKey
+type SecurityConfig struct {
+	TokenEncryption bool
+	EncryptionKey   string
+}
+
 // SessionConfig stores session configuration for the web app
 type SessionConfig struct {
 	Secret string
@@ -37,6 +53,8 @@ type SessionConfig struct {
 type Config struct {
 	Database      DatabaseConfig
 	Oauth         OauthConfig
+	Password      PasswordConfig
+	Security      SecurityConfig
 	Session       SessionConfig
 	IsDevelopment bool
 }
@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/RichardKnop/go-oauth2-server/config"
@@ -17,6 +18,27 @@ func init() {
 	}
 }
 
+// Opener opens a database of a registered type
+type Opener func(cnf *config.Config) (*gorm.DB, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]Opener)
+)
+
+// RegisterType makes NewDatabase support another database type. The storage
+// backends register the types they implement when imported, so programs
+// import the backends of the databases they use, registering the same type
+// twice panics.
+func RegisterType(databaseType string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	if _, exists := openers[databaseType]; exists {
+		panic(fmt.Sprintf("database type %s registered twice", databaseType))
+	}
+	openers[databaseType] = opener
+}
+
 // NewDatabase returns a gorm.DB struct, gorm.DB.DB() returns a database handle
 // see http://golang.org/pkg/database/sql/#DB
 func NewDatabase(cnf *config.Config) (*gorm.DB, error) {
@@ -50,6 +72,14 @@ func NewDatabase(cnf *config.Config) (*gorm.DB, error) {
 		return db, nil
 	}
 
+	// Types registered by the storage backends
+	openersMu.RLock()
+	opener, ok := openers[cnf.Database.Type]
+	openersMu.RUnlock()
+	if ok {
+		return opener(cnf)
+	}
+
 	// Database type not supported
 	return nil, fmt.Errorf("Database type %s not suppported", cnf.Database.Type)
 }
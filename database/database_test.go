@@ -2,11 +2,15 @@ package database_test
 
 import (
 	"errors"
+	"path/filepath"
 	"testing"
 
 	"github.com/RichardKnop/go-oauth2-server/config"
 	"github.com/RichardKnop/go-oauth2-server/database"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	_ "github.com/RichardKnop/go-oauth2-server/storage/sqlite"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewDatabaseTypeNotSupported(t *testing.T) {
@@ -21,3 +25,23 @@ func TestNewDatabaseTypeNotSupported(t *testing.T) {
 		assert.Equal(t, errors.New("Database type bogus not suppported"), err)
 	}
 }
+
+func TestNewDatabaseSQLite(t *testing.T) {
+	cnf := &config.Config{
+		Database: config.DatabaseConfig{
+			Type:         "sqlite",
+			DatabaseName: filepath.Join(t.TempDir(), "oauth2.db"),
+		},
+	}
+	db, err := database.NewDatabase(cnf)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var journalMode string
+	require.NoError(t, db.Raw("PRAGMA journal_mode").Row().Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+
+	// The schema has been created
+	assert.True(t, db.HasTable(new(models.OauthClient)))
+	assert.True(t, db.HasTable(new(models.OauthAccessToken)))
+}
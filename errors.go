@@ -0,0 +1,90 @@
+package oauth2server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+)
+
+var (
+	// ErrInvalidGrantType ...
+	ErrInvalidGrantType = errors.New("Invalid grant type")
+	// ErrInvalidClientIDOrSecret ...
+	ErrInvalidClientIDOrSecret = errors.New("Invalid client ID or secret")
+	// ErrInvalidUsernameOrPassword ...
+	ErrInvalidUsernameOrPassword = errors.New("Invalid username or password")
+	// ErrInvalidScope ...
+	ErrInvalidScope = errors.New("Invalid scope")
+	// ErrInvalidRedirectURI ...
+	ErrInvalidRedirectURI = errors.New("Invalid redirect URI")
+	// ErrAuthorizationCodeNotFound ...
+	ErrAuthorizationCodeNotFound = errors.New("Authorization code not found")
+	// ErrAuthorizationCodeExpired ...
+	ErrAuthorizationCodeExpired = errors.New("Authorization code expired")
+	// ErrRefreshTokenNotFound ...
+	ErrRefreshTokenNotFound = errors.New("Refresh token not found")
+	// ErrRefreshTokenExpired ...
+	ErrRefreshTokenExpired = errors.New("Refresh token expired")
+	// ErrRequestedScopeCannotBeGreater ...
+	ErrRequestedScopeCannotBeGreater = errors.New("Requested scope cannot be greater")
+	// ErrTokenMissing ...
+	ErrTokenMissing = errors.New("Token missing")
+	// ErrTokenHintInvalid ...
+	ErrTokenHintInvalid = errors.New("Invalid token hint")
+	// ErrRateLimitExceeded ...
+	ErrRateLimitExceeded = errors.New("Rate limit exceeded")
+	// ErrCannotSetEmptyUsername ...
+	ErrCannotSetEmptyUsername = errors.New("Cannot set empty username")
+	// ErrUsernameTaken ...
+	ErrUsernameTaken = errors.New("Username taken")
+	// ErrUserNotFound ...
+	ErrUserNotFound = errors.New("User not found")
+	// ErrClientNotFound ...
+	ErrClientNotFound = errors.New("Client not found")
+	// ErrAccessTokenNotFound ...
+	ErrAccessTokenNotFound = errors.New("Access token not found")
+	// ErrAccessTokenExpired ...
+	ErrAccessTokenExpired = errors.New("Access token expired")
+)
+
+var (
+	errStatusCodeMap = map[error]int{
+		ErrInvalidGrantType:              http.StatusBadRequest,
+		ErrInvalidClientIDOrSecret:       http.StatusUnauthorized,
+		ErrInvalidUsernameOrPassword:     http.StatusUnauthorized,
+		ErrInvalidScope:                  http.StatusBadRequest,
+		ErrInvalidRedirectURI:            http.StatusBadRequest,
+		ErrAuthorizationCodeNotFound:     http.StatusNotFound,
+		ErrAuthorizationCodeExpired:      http.StatusBadRequest,
+		ErrRefreshTokenNotFound:          http.StatusNotFound,
+		ErrRefreshTokenExpired:           http.StatusBadRequest,
+		ErrRequestedScopeCannotBeGreater: http.StatusBadRequest,
+		ErrTokenMissing:                  http.StatusBadRequest,
+		ErrTokenHintInvalid:              http.StatusBadRequest,
+		ErrRateLimitExceeded:             http.StatusTooManyRequests,
+		ErrCannotSetEmptyUsername:        http.StatusBadRequest,
+		ErrUsernameTaken:                 http.StatusConflict,
+		ErrUserNotFound:                  http.StatusNotFound,
+		ErrClientNotFound:                http.StatusNotFound,
+		ErrAccessTokenNotFound:           http.StatusNotFound,
+		ErrAccessTokenExpired:            http.StatusUnauthorized,
+		pass.ErrTooShort:                 http.StatusBadRequest,
+		pass.ErrUppercaseRequired:        http.StatusBadRequest,
+		pass.ErrNumberRequired:           http.StatusBadRequest,
+		pass.ErrSymbolRequired:           http.StatusBadRequest,
+		storage.ErrCircuitOpen:           http.StatusServiceUnavailable,
+		storage.ErrInvalidCursor:         http.StatusBadRequest,
+	}
+)
+
+func getErrStatusCode(err error) int {
+	for target, code := range errStatusCodeMap {
+		if errors.Is(err, target) {
+			return code
+		}
+	}
+
+	return http.StatusInternalServerError
+}
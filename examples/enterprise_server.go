@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	oauth2server "github.com/RichardKnop/go-oauth2-server"
@@ -35,6 +36,7 @@ func main() {
 		}).
 		WithSecurity(&oauth2server.SecurityConfig{
 			TokenEncryption:   true,
+			EncryptionKey:     os.Getenv("TOKEN_ENCRYPTION_KEY"), // HMAC key for tokens at rest
 			MinPasswordLength: 12,                        // Strong password policy
 			RequireUppercase:  true,
 			RequireNumbers:    true,
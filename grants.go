@@ -0,0 +1,269 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+)
+
+// authClient authenticates a client by its ID and secret
+func (s *SDK) authClient(ctx context.Context, clientID, secret string) (*models.OauthClient, error) {
+	// Fetch the client
+	client, err := s.storage.GetClient(ctx, clientID)
+	if err == nil && client == nil {
+		err = storage.ErrClientNotFound
+	}
+	if err != nil {
+		// Take as long as a wrong secret would
+		s.secretVerifier.burn(secret)
+		return nil, err
+	}
+
+	// Verify the secret
+	if !s.verifyClientSecret(ctx, client, secret) {
+		return nil, ErrInvalidClientIDOrSecret
+	}
+
+	return client, nil
+}
+
+func (s *SDK) authorizationCodeGrant(ctx context.Context, client *models.OauthClient, code, redirectURI string) (*TokenResponse, error) {
+	start := time.Now()
+
+	// Fetch the authorization code
+	authorizationCode, err := s.getValidAuthorizationCode(ctx, code, redirectURI, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the user the code was issued to
+	user, err := s.getUserByID(ctx, authorizationCode.UserID.String)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete the authorization code and log in the user together, so a
+	// failure leaves neither a used code nor tokens behind
+	var (
+		accessToken  *models.OauthAccessToken
+		refreshToken *models.OauthRefreshToken
+	)
+	err = s.storage.WithTx(ctx, func(tx storage.Storage) (err error) {
+		// Another exchange of the same code consumed it first
+		err = tx.DeleteAuthorizationCode(ctx, authorizationCode.Code)
+		if errors.Is(err, storage.ErrCodeNotFound) {
+			return ErrAuthorizationCodeNotFound
+		}
+		if err != nil {
+			return err
+		}
+		accessToken, refreshToken, err = s.generateTokens(ctx, tx, client, user, authorizationCode.Scope)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordTokenGeneration(client, "authorization_code", start)
+	return s.newTokenResponse(accessToken, refreshToken), nil
+}
+
+func (s *SDK) passwordGrant(ctx context.Context, client *models.OauthClient, username, password, requestedScope string) (*TokenResponse, error) {
+	start := time.Now()
+
+	// Get the scope string
+	scope, err := s.getScope(ctx, requestedScope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticate the user
+	user, err := s.storage.AuthenticateUser(ctx, username, password)
+	if err != nil || user == nil {
+		// For security reasons, return a general error message
+		return nil, ErrInvalidUsernameOrPassword
+	}
+
+	// Log in the user
+	accessToken, refreshToken, err := s.generateTokens(ctx, s.storage, client, user, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordTokenGeneration(client, "password", start)
+	return s.newTokenResponse(accessToken, refreshToken), nil
+}
+
+func (s *SDK) clientCredentialsGrant(ctx context.Context, client *models.OauthClient, requestedScope string) (*TokenResponse, error) {
+	start := time.Now()
+
+	// Get the scope string
+	scope, err := s.getScope(ctx, requestedScope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new access token, client credentials grant does not
+	// produce a refresh token
+	accessToken, err := s.grantAccessToken(ctx, s.storage, client, nil, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordTokenGeneration(client, "client_credentials", start)
+	return s.newTokenResponse(accessToken, nil), nil
+}
+
+func (s *SDK) refreshTokenGrant(ctx context.Context, client *models.OauthClient, token, requestedScope string) (*TokenResponse, error) {
+	start := time.Now()
+
+	// Fetch the refresh token
+	theRefreshToken, err := s.getValidRefreshToken(ctx, token, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the scope
+	scope, err := s.getRefreshTokenScope(ctx, theRefreshToken, requestedScope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the user, client only refresh tokens have none
+	var user *models.OauthUser
+	if theRefreshToken.UserID.Valid {
+		user, err = s.getUserByID(ctx, theRefreshToken.UserID.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create a new access token, the refresh token stays the same
+	accessToken, err := s.grantAccessToken(ctx, s.storage, client, user, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordTokenGeneration(client, "refresh_token", start)
+	return s.newTokenResponse(accessToken, theRefreshToken), nil
+}
+
+// issueAuthorizationCode creates and stores an authorization code for a user
+// who approved the client
+func (s *SDK) issueAuthorizationCode(ctx context.Context, clientID, userID, redirectURI, requestedScope string) (*models.OauthAuthorizationCode, error) {
+	// Fetch the client
+	client, err := s.storage.GetClient(ctx, clientID)
+	if errors.Is(err, storage.ErrClientNotFound) || (err == nil && client == nil) {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Redirect URI must match the one registered for the client
+	if redirectURI == "" {
+		redirectURI = client.RedirectURI.String
+	}
+	if client.RedirectURI.String != "" && redirectURI != client.RedirectURI.String {
+		return nil, ErrInvalidRedirectURI
+	}
+
+	// Fetch the user
+	user, err := s.getUserByID(ctx, userID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the scope string
+	scope, err := s.getScope(ctx, requestedScope)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new authorization code
+	authorizationCode := models.NewOauthAuthorizationCode(
+		client,
+		user,
+		int(s.config.Performance.AuthCodeTTL.Seconds()), // expires in
+		redirectURI,
+		scope,
+	)
+	if err := s.storage.StoreAuthorizationCode(ctx, authorizationCode); err != nil {
+		return nil, err
+	}
+	authorizationCode.Client = client
+	authorizationCode.User = user
+
+	return authorizationCode, nil
+}
+
+// getValidAuthorizationCode returns a valid non expired authorization code
+func (s *SDK) getValidAuthorizationCode(ctx context.Context, code, redirectURI string, client *models.OauthClient) (*models.OauthAuthorizationCode, error) {
+	// Fetch the auth code from the storage
+	authorizationCode, err := s.storage.GetAuthorizationCode(ctx, code)
+	if errors.Is(err, storage.ErrCodeExpired) {
+		return nil, ErrAuthorizationCodeExpired
+	}
+	if err != nil && !errors.Is(err, storage.ErrCodeNotFound) {
+		return nil, err
+	}
+
+	// Not found, codes issued to other clients are treated the same way
+	if authorizationCode == nil || authorizationCode.ClientID.String != client.ID {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+
+	// Redirect URI must match if it was used to obtain the authorization code
+	if redirectURI != authorizationCode.RedirectURI.String {
+		return nil, ErrInvalidRedirectURI
+	}
+
+	// Check the authorization code hasn't expired
+	if time.Now().After(authorizationCode.ExpiresAt) {
+		return nil, ErrAuthorizationCodeExpired
+	}
+
+	return authorizationCode, nil
+}
+
+// getValidRefreshToken returns a valid non expired refresh token
+func (s *SDK) getValidRefreshToken(ctx context.Context, token string, client *models.OauthClient) (*models.OauthRefreshToken, error) {
+	// Fetch the refresh token from the storage
+	refreshToken, err := s.storage.GetRefreshToken(ctx, token)
+	if errors.Is(err, storage.ErrTokenExpired) {
+		return nil, ErrRefreshTokenExpired
+	}
+	if err != nil && !errors.Is(err, storage.ErrTokenNotFound) {
+		return nil, err
+	}
+
+	// Not found, tokens issued to other clients are treated the same way
+	if refreshToken == nil || refreshToken.ClientID.String != client.ID {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	// Check the refresh token hasn't expired
+	if time.Now().UTC().After(refreshToken.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	return refreshToken, nil
+}
+
+// getUserByID fetches a user, treating an empty result as not found
+func (s *SDK) getUserByID(ctx context.Context, userID string) (*models.OauthUser, error) {
+	user, err := s.storage.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, storage.ErrUserNotFound
+	}
+	return user, nil
+}
@@ -0,0 +1,202 @@
+package oauth2server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/log"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+var realm = "go_oauth2_server"
+
+// tokensHandler handles all OAuth 2.0 grant types
+// (POST /oauth/tokens)
+func (s *Server) tokensHandler(c *fiber.Ctx) error {
+	// Map of grant types against handler functions
+	grantTypes := map[string]func(c *fiber.Ctx, client *models.OauthClient) (*TokenResponse, error){
+		"authorization_code": s.authorizationCodeGrant,
+		"password":           s.passwordGrant,
+		"client_credentials": s.clientCredentialsGrant,
+		"refresh_token":      s.refreshTokenGrant,
+	}
+
+	// Check the grant type
+	grantHandler, ok := grantTypes[c.FormValue("grant_type")]
+	if !ok {
+		return errorResponse(c, ErrInvalidGrantType.Error(), fiber.StatusBadRequest)
+	}
+
+	// Client auth
+	client, err := s.basicAuthClient(c)
+	if err != nil {
+		return unauthorizedError(c, err.Error())
+	}
+
+	// Grant processing
+	resp, err := grantHandler(c, client)
+	if err != nil {
+		return errorResponse(c, err.Error(), getErrStatusCode(err))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+func (s *Server) authorizationCodeGrant(c *fiber.Ctx, client *models.OauthClient) (*TokenResponse, error) {
+	return s.sdk.authorizationCodeGrant(
+		c.UserContext(),
+		client,
+		c.FormValue("code"),
+		c.FormValue("redirect_uri"),
+	)
+}
+
+func (s *Server) passwordGrant(c *fiber.Ctx, client *models.OauthClient) (*TokenResponse, error) {
+	return s.sdk.passwordGrant(
+		c.UserContext(),
+		client,
+		c.FormValue("username"),
+		c.FormValue("password"),
+		c.FormValue("scope"),
+	)
+}
+
+func (s *Server) clientCredentialsGrant(c *fiber.Ctx, client *models.OauthClient) (*TokenResponse, error) {
+	return s.sdk.clientCredentialsGrant(
+		c.UserContext(),
+		client,
+		c.FormValue("scope"),
+	)
+}
+
+func (s *Server) refreshTokenGrant(c *fiber.Ctx, client *models.OauthClient) (*TokenResponse, error) {
+	return s.sdk.refreshTokenGrant(
+		c.UserContext(),
+		client,
+		c.FormValue("refresh_token"),
+		c.FormValue("scope"),
+	)
+}
+
+// introspectHandler handles OAuth 2.0 introspect request
+// (POST /oauth/introspect)
+func (s *Server) introspectHandler(c *fiber.Ctx) error {
+	// Client auth
+	client, err := s.basicAuthClient(c)
+	if err != nil {
+		return unauthorizedError(c, err.Error())
+	}
+
+	// Introspect the token
+	resp, err := s.sdk.introspectToken(
+		c.UserContext(),
+		client,
+		c.FormValue("token"),
+		c.FormValue("token_type_hint"),
+	)
+	if err != nil {
+		return errorResponse(c, err.Error(), getErrStatusCode(err))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+func (s *Server) healthHandler(c *fiber.Ctx) error {
+	if err := s.sdk.storage.HealthCheck(c.UserContext()); err != nil {
+		// The error may name hosts and databases, it is only logged
+		log.ERROR.Printf("Storage health check failed: %s", err)
+		storageStatus := "unavailable"
+		if errors.Is(err, storage.ErrCircuitOpen) {
+			storageStatus = "circuit_open"
+		}
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":  "unhealthy",
+			"storage": storageStatus,
+			"time":    time.Now().Format(time.RFC3339),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "healthy",
+		"time":   time.Now().Format(time.RFC3339),
+	})
+}
+
+// clientAuthKey holds the clientAuth of a request in its locals
+type clientAuthKey struct{}
+
+// clientAuth is the outcome of authenticating the client of a request
+type clientAuth struct {
+	client *models.OauthClient
+	err    error
+}
+
+// Get client credentials from basic auth and try to authenticate client
+func (s *Server) basicAuthClient(c *fiber.Ctx) (*models.OauthClient, error) {
+	return s.sdk.basicAuthClient(c)
+}
+
+// basicAuthClient authenticates the client once per request, the rate
+// limiter does so before the handlers
+func (s *SDK) basicAuthClient(c *fiber.Ctx) (*models.OauthClient, error) {
+	if auth, ok := c.Locals(clientAuthKey{}).(*clientAuth); ok {
+		return auth.client, auth.err
+	}
+
+	auth := new(clientAuth)
+	defer c.Locals(clientAuthKey{}, auth)
+
+	// Get client credentials from basic auth
+	clientID, secret, ok := parseBasicAuth(c.Get(fiber.HeaderAuthorization))
+	if !ok {
+		auth.err = ErrInvalidClientIDOrSecret
+		return nil, auth.err
+	}
+
+	// Authenticate the client
+	client, err := s.authClient(c.UserContext(), clientID, secret)
+	if err != nil {
+		// For security reasons, return a general error message
+		auth.err = ErrInvalidClientIDOrSecret
+		return nil, auth.err
+	}
+
+	auth.client = client
+	return client, nil
+}
+
+// parseBasicAuth parses an HTTP Basic Authentication string,
+// "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==" returns ("Aladdin", "open sesame", true)
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	// Case insensitive prefix match, see RFC 7617 section 2
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	return username, password, true
+}
+
+// errorResponse produces a JSON error response with the following structure:
+// {"error":"some error message"}
+func errorResponse(c *fiber.Ctx, err string, code int) error {
+	return c.Status(code).JSON(fiber.Map{"error": err})
+}
+
+// unauthorizedError has to contain WWW-Authenticate header
+// See http://self-issued.info/docs/draft-ietf-oauth-v2-bearer.html#rfc.section.3
+func unauthorizedError(c *fiber.Ctx, err string) error {
+	c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf("Bearer realm=%s", realm))
+	return errorResponse(c, err, fiber.StatusUnauthorized)
+}
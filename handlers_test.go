@@ -0,0 +1,294 @@
+package oauth2server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/oauth/tokentypes"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/util"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSDK builds a memory backed SDK with a test client and a test user
+func newTestSDK(t *testing.T) (*SDK, *fiber.App) {
+	return newTestSDKFromBuilder(t, New())
+}
+
+// testEncryptionKey is the key test SDKs hash tokens with
+const testEncryptionKey = "test_encryption_key"
+
+// newTestSDKFromBuilder is like newTestSDK but uses a preconfigured builder,
+// token encryption uses testEncryptionKey unless the builder sets a key
+func newTestSDKFromBuilder(t *testing.T, builder *Builder) (*SDK, *fiber.App) {
+	if security := builder.config.Security; security != nil && security.TokenEncryption && security.EncryptionKey == "" {
+		builder.WithEncryptionKey(testEncryptionKey)
+	}
+	sdk, err := builder.Build()
+	require.NoError(t, err)
+	t.Cleanup(func() { sdk.Close() })
+
+	ctx := context.Background()
+	secretHash, err := pass.HashPassword("test_secret")
+	require.NoError(t, err)
+	require.NoError(t, sdk.storage.CreateClient(ctx, &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Key:         "test_client_1",
+		Secret:      string(secretHash),
+		RedirectURI: util.StringOrNull("https://www.example.com"),
+	}))
+
+	passwordHash, err := pass.HashPassword("test_password")
+	require.NoError(t, err)
+	require.NoError(t, sdk.storage.CreateUser(ctx, &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Username:    "test@user",
+		Password:    util.StringOrNull(string(passwordHash)),
+	}))
+
+	app := fiber.New()
+	sdk.CreateServer().RegisterRoutes(app, "/v1/oauth")
+
+	return sdk, app
+}
+
+// postForm sends a form encoded POST request authenticated with basic auth
+func postForm(t *testing.T, app *fiber.App, path, clientID, secret string, form url.Values) (int, map[string]interface{}) {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(clientID+":"+secret)))
+	}
+
+	resp, err := app.Test(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	data := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(body, &data), string(body))
+
+	return resp.StatusCode, data
+}
+
+func TestTokensHandlerInvalidGrantType(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"bogus"},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, ErrInvalidGrantType.Error(), data["error"])
+}
+
+func TestTokensHandlerMissingClientAuth(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "", "", url.Values{
+		"grant_type": {"client_credentials"},
+	})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, ErrInvalidClientIDOrSecret.Error(), data["error"])
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	sdk, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"client_credentials"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, tokentypes.Bearer, data["token_type"])
+	assert.Equal(t, float64(3600), data["expires_in"])
+	assert.Equal(t, "read", data["scope"])
+
+	// Client credentials grant does not produce refresh token
+	assert.Nil(t, data["refresh_token"])
+
+	accessToken, err := sdk.storage.GetAccessToken(context.Background(), data["access_token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", accessToken.ClientID.String)
+	assert.False(t, accessToken.UserID.Valid)
+}
+
+func TestPasswordGrant(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"bogus"},
+	})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, ErrInvalidUsernameOrPassword.Error(), data["error"])
+
+	code, data = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"test_password"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1", data["user_id"])
+	assert.NotEmpty(t, data["access_token"])
+	assert.NotEmpty(t, data["refresh_token"])
+}
+
+func TestPasswordGrantInvalidScope(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"test_password"},
+		"scope":      {"bogus"},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, ErrInvalidScope.Error(), data["error"])
+}
+
+func TestAuthorizationCodeGrant(t *testing.T) {
+	sdk, app := newTestSDK(t)
+	ctx := context.Background()
+
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	user, err := sdk.storage.GetUserByID(ctx, "1")
+	require.NoError(t, err)
+	authorizationCode := models.NewOauthAuthorizationCode(client, user, 60, "https://www.example.com", "read")
+	require.NoError(t, sdk.storage.StoreAuthorizationCode(ctx, authorizationCode))
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizationCode.Code},
+		"redirect_uri": {"https://bogus"},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, ErrInvalidRedirectURI.Error(), data["error"])
+
+	code, data = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizationCode.Code},
+		"redirect_uri": {"https://www.example.com"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1", data["user_id"])
+	assert.Equal(t, "read", data["scope"])
+	assert.NotEmpty(t, data["refresh_token"])
+
+	// The authorization code should get deleted after use
+	code, data = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorizationCode.Code},
+		"redirect_uri": {"https://www.example.com"},
+	})
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, ErrAuthorizationCodeNotFound.Error(), data["error"])
+}
+
+func TestRefreshTokenGrant(t *testing.T) {
+	sdk, app := newTestSDK(t)
+	ctx := context.Background()
+
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	user, err := sdk.storage.GetUserByID(ctx, "1")
+	require.NoError(t, err)
+
+	expired := models.NewOauthRefreshToken(client, user, 60, "read")
+	expired.ExpiresAt = time.Now().UTC().Add(-10 * time.Second)
+	require.NoError(t, sdk.storage.StoreRefreshToken(ctx, expired))
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {expired.Token},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, ErrRefreshTokenExpired.Error(), data["error"])
+
+	refreshToken := models.NewOauthRefreshToken(client, user, 60, "read")
+	require.NoError(t, sdk.storage.StoreRefreshToken(ctx, refreshToken))
+
+	code, data = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"bogus_token"},
+	})
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, ErrRefreshTokenNotFound.Error(), data["error"])
+
+	// Defaults to the original scope and keeps the refresh token
+	code, data = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken.Token},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "read", data["scope"])
+	assert.Equal(t, refreshToken.Token, data["refresh_token"])
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	username, password, ok := parseBasicAuth("Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==")
+	assert.True(t, ok)
+	assert.Equal(t, "Aladdin", username)
+	assert.Equal(t, "open sesame", password)
+
+	_, _, ok = parseBasicAuth("Bearer QWxhZGRpbjpvcGVuIHNlc2FtZQ==")
+	assert.False(t, ok)
+
+	_, _, ok = parseBasicAuth("Basic !!!")
+	assert.False(t, ok)
+}
+
+func TestTokenEncryption(t *testing.T) {
+	// Token encryption is on by default and needs a key
+	_, err := New().Build()
+	assert.Error(t, err)
+	_, err = New().WithSecurity(&SecurityConfig{TokenEncryption: true}).Build()
+	assert.Error(t, err)
+
+	sdk, app := newTestSDKFromBuilder(t, New().WithSecurity(&SecurityConfig{
+		TokenEncryption: true,
+		EncryptionKey:   "secret_key",
+	}))
+	ctx := context.Background()
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"test_password"},
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	// Only hashes are persisted
+	inner := sdk.storage.(*storage.HashedStorage).Storage
+	_, err = inner.GetAccessToken(ctx, data["access_token"].(string))
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+	_, err = inner.GetRefreshToken(ctx, data["refresh_token"].(string))
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+
+	// The plaintext tokens keep working
+	code, data = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {data["refresh_token"].(string)},
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	code, data = postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token": {data["access_token"].(string)},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["active"])
+	assert.Equal(t, "test@user", data["username"])
+}
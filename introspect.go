@@ -0,0 +1,170 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/oauth/tokentypes"
+)
+
+const (
+	// AccessTokenHint ...
+	AccessTokenHint = "access_token"
+	// RefreshTokenHint ...
+	RefreshTokenHint = "refresh_token"
+)
+
+// IntrospectResponse represents an RFC 7662 introspection response
+type IntrospectResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int    `json:"exp,omitempty"`
+}
+
+// introspectToken looks up a token according to the token type hint, expired
+// and unknown tokens produce an inactive response as per RFC 7662 section 2.2
+func (s *SDK) introspectToken(ctx context.Context, client *models.OauthClient, token, tokenTypeHint string) (*IntrospectResponse, error) {
+	if token == "" {
+		return nil, ErrTokenMissing
+	}
+
+	// Default to access token hint
+	if tokenTypeHint == "" {
+		tokenTypeHint = AccessTokenHint
+	}
+	if tokenTypeHint != AccessTokenHint && tokenTypeHint != RefreshTokenHint {
+		return nil, ErrTokenHintInvalid
+	}
+
+	// Resource servers introspect on every request, try the cache first.
+	// Refresh tokens are only ever disclosed to the client they were issued
+	// to, other clients fall through to an inactive response.
+	cacheKey := introspectCacheKey(s.tokenHasher.Hash(token), tokenTypeHint)
+	if s.cache != nil {
+		cached := new(IntrospectResponse)
+		if err := s.cache.Get(ctx, cacheKey, cached); err == nil && cached.Active &&
+			(tokenTypeHint == AccessTokenHint || cached.ClientID == client.Key) {
+			return cached, nil
+		}
+	}
+
+	var (
+		introspectResponse *IntrospectResponse
+		err                error
+	)
+	switch tokenTypeHint {
+	case AccessTokenHint:
+		introspectResponse, err = s.introspectAccessToken(ctx, client, token)
+	case RefreshTokenHint:
+		introspectResponse, err = s.introspectRefreshToken(ctx, client, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only active responses are cached and never beyond the token expiry
+	if s.cache != nil && introspectResponse.Active {
+		ttl := time.Until(time.Unix(int64(introspectResponse.ExpiresAt), 0))
+		if cacheTTL := s.cacheTTL(); cacheTTL < ttl {
+			ttl = cacheTTL
+		}
+		if ttl > 0 {
+			s.cache.Set(ctx, cacheKey, introspectResponse, ttl)
+		}
+	}
+
+	return introspectResponse, nil
+}
+
+func (s *SDK) introspectAccessToken(ctx context.Context, client *models.OauthClient, token string) (*IntrospectResponse, error) {
+	accessToken, err := s.validateAccessToken(ctx, token)
+	if errors.Is(err, ErrAccessTokenNotFound) || errors.Is(err, ErrAccessTokenExpired) {
+		return &IntrospectResponse{Active: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newIntrospectResponse(
+		ctx,
+		client,
+		accessToken.Client,
+		accessToken.User,
+		accessToken.UserID.String,
+		accessToken.Scope,
+		accessToken.ExpiresAt,
+	)
+}
+
+func (s *SDK) introspectRefreshToken(ctx context.Context, client *models.OauthClient, token string) (*IntrospectResponse, error) {
+	// Refresh tokens are only ever disclosed to the client they were issued to
+	refreshToken, err := s.getValidRefreshToken(ctx, token, client)
+	if errors.Is(err, ErrRefreshTokenNotFound) || errors.Is(err, ErrRefreshTokenExpired) {
+		return &IntrospectResponse{Active: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newIntrospectResponse(
+		ctx,
+		client,
+		refreshToken.Client,
+		refreshToken.User,
+		refreshToken.UserID.String,
+		refreshToken.Scope,
+		refreshToken.ExpiresAt,
+	)
+}
+
+// newIntrospectResponse builds an active introspection response, resolving
+// the client key and username when the backend did not preload them
+func (s *SDK) newIntrospectResponse(ctx context.Context, caller, client *models.OauthClient, user *models.OauthUser, userID, scope string, expiresAt time.Time) (*IntrospectResponse, error) {
+	introspectResponse := &IntrospectResponse{
+		Active:    true,
+		Scope:     scope,
+		TokenType: tokentypes.Bearer,
+		ExpiresAt: int(expiresAt.Unix()),
+	}
+
+	if client != nil {
+		introspectResponse.ClientID = client.Key
+	} else {
+		// Storage can only look clients up by key, which the token does not
+		// carry, so fall back to the calling client
+		introspectResponse.ClientID = caller.Key
+	}
+
+	if user != nil {
+		introspectResponse.Username = user.Username
+	} else if userID != "" {
+		user, err := s.getUserByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		introspectResponse.Username = user.Username
+	}
+
+	return introspectResponse, nil
+}
+
+// cacheTTL returns the configured cache TTL, defaulting to 5 minutes
+func (s *SDK) cacheTTL() time.Duration {
+	if s.config.Storage.Cache != nil && s.config.Storage.Cache.TTL > 0 {
+		return s.config.Storage.Cache.TTL
+	}
+	return 5 * time.Minute
+}
+
+// introspectCacheKey returns the cache key for an introspection response.
+// The token is hashed first when token encryption is enabled, so the cache
+// does not leak live tokens either.
+func introspectCacheKey(token, tokenTypeHint string) string {
+	return fmt.Sprintf("introspect:%s:%s", tokenTypeHint, token)
+}
@@ -0,0 +1,161 @@
+package oauth2server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/oauth/tokentypes"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospectTokenMissing(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, ErrTokenMissing.Error(), data["error"])
+}
+
+func TestIntrospectInvalidTokenHint(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token":           {"token"},
+		"token_type_hint": {"bogus"},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, ErrTokenHintInvalid.Error(), data["error"])
+}
+
+func TestIntrospectUnknownTokenIsInactive(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	code, data := postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token": {"bogus"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"active": false}, data)
+}
+
+func TestIntrospectAccessToken(t *testing.T) {
+	_, app := newTestSDK(t)
+
+	_, tokens := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"test_password"},
+	})
+
+	code, data := postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token": {tokens["access_token"].(string)},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["active"])
+	assert.Equal(t, "read", data["scope"])
+	assert.Equal(t, "test_client_1", data["client_id"])
+	assert.Equal(t, "test@user", data["username"])
+	assert.Equal(t, tokentypes.Bearer, data["token_type"])
+	assert.NotZero(t, data["exp"])
+}
+
+func TestIntrospectRefreshToken(t *testing.T) {
+	sdk, app := newTestSDK(t)
+	ctx := context.Background()
+
+	_, tokens := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"test_password"},
+	})
+
+	code, data := postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token":           {tokens["refresh_token"].(string)},
+		"token_type_hint": {RefreshTokenHint},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["active"])
+	assert.Equal(t, "test@user", data["username"])
+
+	// Expired refresh tokens are inactive
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	expired := models.NewOauthRefreshToken(client, nil, 60, "read")
+	expired.ExpiresAt = time.Now().UTC().Add(-10 * time.Second)
+	require.NoError(t, sdk.storage.StoreRefreshToken(ctx, expired))
+
+	code, data = postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token":           {expired.Token},
+		"token_type_hint": {RefreshTokenHint},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, data["active"])
+}
+
+func TestIntrospectUsesCache(t *testing.T) {
+	sdk, app := newTestSDKFromBuilder(t, New().WithMemoryCache(100))
+
+	_, tokens := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"client_credentials"},
+	})
+	accessToken := tokens["access_token"].(string)
+
+	code, data := postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token": {accessToken},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["active"])
+
+	// The second lookup is served from the cache without touching storage
+	require.NoError(t, sdk.storage.DeleteAccessToken(context.Background(), accessToken))
+	code, data = postForm(t, app, "/v1/oauth/introspect", "test_client_1", "test_secret", url.Values{
+		"token": {accessToken},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, data["active"])
+	assert.Equal(t, "test_client_1", data["client_id"])
+}
+
+func TestBulkRevocationDropsCachedIntrospection(t *testing.T) {
+	sdk, app := newTestSDKFromBuilder(t, New().WithMemoryCache(100))
+	ctx := context.Background()
+
+	secretHash, err := pass.HashPassword("test_secret")
+	require.NoError(t, err)
+	require.NoError(t, sdk.storage.CreateClient(ctx, &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "2"},
+		Key:         "test_client_2",
+		Secret:      string(secretHash),
+	}))
+
+	_, tokens := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"password"},
+		"username":   {"test@user"},
+		"password":   {"test_password"},
+	})
+	introspect := func(clientID, hint string) bool {
+		code, data := postForm(t, app, "/v1/oauth/introspect", clientID, "test_secret", url.Values{
+			"token":           {tokens[hint].(string)},
+			"token_type_hint": {hint},
+		})
+		require.Equal(t, http.StatusOK, code)
+		return data["active"].(bool)
+	}
+	assert.True(t, introspect("test_client_1", AccessTokenHint))
+	assert.True(t, introspect("test_client_1", RefreshTokenHint))
+
+	// A cached refresh token response is not disclosed to other clients
+	assert.False(t, introspect("test_client_2", RefreshTokenHint))
+
+	result, err := sdk.RevokeUserTokens(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.AccessTokens)
+	assert.Equal(t, 1, result.RefreshTokens)
+	assert.False(t, introspect("test_client_1", AccessTokenHint))
+	assert.False(t, introspect("test_client_1", RefreshTokenHint))
+}
@@ -0,0 +1,173 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+)
+
+// MaintenanceStatus describes the background token cleanup
+type MaintenanceStatus struct {
+	Enabled      bool          `json:"enabled"`
+	Running      bool          `json:"running"`
+	Runs         int64         `json:"runs"`
+	Failures     int64         `json:"failures"`
+	LastRunAt    time.Time     `json:"last_run_at,omitempty"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastRemoved  int           `json:"last_removed"`
+	LastError    error         `json:"-"` // nil when the last run succeeded
+}
+
+// maintenance periodically removes expired tokens with a pool of workers,
+// each worker removes batches from its own range of IDs until the backend
+// runs out of expired rows in it
+type maintenance struct {
+	storage   storage.Storage
+	workers   int
+	interval  time.Duration
+	batchSize int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	status MaintenanceStatus
+}
+
+func newMaintenance(s storage.Storage, config *PerformanceConfig) *maintenance {
+	m := &maintenance{storage: s, workers: 1}
+	if config == nil {
+		return m
+	}
+	if config.TokenWorkers > 1 {
+		m.workers = config.TokenWorkers
+	}
+	m.interval = config.CleanupInterval
+	m.batchSize = config.BatchSize
+	return m
+}
+
+// start launches the supervisor, a zero cleanup interval disables maintenance
+func (m *maintenance) start() {
+	if m.interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.mu.Lock()
+	m.status.Enabled = true
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.run(ctx)
+			}
+		}
+	}()
+}
+
+// stop cancels any run in progress and waits for the workers to exit
+func (m *maintenance) stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// Status returns a snapshot of the maintenance status
+func (m *maintenance) Status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// run performs a single cleanup run and records its outcome
+func (m *maintenance) run(ctx context.Context) {
+	start := time.Now()
+	m.mu.Lock()
+	m.status.Running = true
+	m.mu.Unlock()
+
+	removed, err := m.cleanup(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.Running = false
+	m.status.Runs++
+	m.status.LastRunAt = start
+	m.status.LastDuration = time.Since(start)
+	m.status.LastRemoved = removed
+	m.status.LastError = err
+	if err != nil {
+		m.status.Failures++
+	}
+}
+
+// cleanup removes expired tokens, in batches when the backend supports it
+func (m *maintenance) cleanup(ctx context.Context) (int, error) {
+	cleaner, ok := m.storage.(storage.BatchCleaner)
+	if !ok || m.batchSize < 1 {
+		return 0, m.safely(func() error {
+			return m.storage.CleanupExpiredTokens(ctx)
+		})
+	}
+
+	// Workers never pick the same rows, so they do not wait on each other's
+	// locks or find their batch already deleted
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		removed int
+		ranges  = storage.SplitIDs(m.workers)
+		errs    = make([]error, len(ranges))
+	)
+	for i := range ranges {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.safely(func() error {
+				for ctx.Err() == nil {
+					n, err := cleaner.CleanupExpiredTokensBatch(ctx, ranges[i], m.batchSize)
+					mu.Lock()
+					removed += n
+					mu.Unlock()
+					if err != nil {
+						return err
+					}
+					// A partial batch means there is nothing left to remove
+					if n < m.batchSize {
+						return nil
+					}
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	return removed, errors.Join(errs...)
+}
+
+// safely runs fn and turns a panic into an error so a misbehaving backend
+// cannot take the maintenance supervisor down
+func (m *maintenance) safely(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("token cleanup panicked: %v", r)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,93 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceRemovesExpiredTokens(t *testing.T) {
+	sdk, _ := newTestSDKFromBuilder(t, New().WithPerformance(&PerformanceConfig{
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: time.Hour,
+		TokenWorkers:    3,
+		CleanupInterval: 10 * time.Millisecond,
+		BatchSize:       2,
+	}))
+	ctx := context.Background()
+
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	user, err := sdk.storage.GetUserByID(ctx, "1")
+	require.NoError(t, err)
+
+	var expired []string
+	for i := 0; i < 5; i++ {
+		accessToken := models.NewOauthAccessToken(client, user, 60, "read")
+		accessToken.ExpiresAt = time.Now().UTC().Add(-time.Minute)
+		require.NoError(t, sdk.storage.StoreAccessToken(ctx, accessToken))
+		expired = append(expired, accessToken.Token)
+	}
+	valid := models.NewOauthAccessToken(client, user, 60, "read")
+	require.NoError(t, sdk.storage.StoreAccessToken(ctx, valid))
+
+	assert.Eventually(t, func() bool {
+		tokens, err := sdk.storage.BatchGetTokens(ctx, expired)
+		return err == nil && len(tokens) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = sdk.storage.GetAccessToken(ctx, valid.Token)
+	assert.NoError(t, err)
+
+	status := sdk.MaintenanceStatus()
+	assert.True(t, status.Enabled)
+	assert.NotZero(t, status.Runs)
+	assert.Zero(t, status.Failures)
+	assert.NoError(t, status.LastError)
+
+	// Close stops the supervisor, no more runs happen afterwards
+	require.NoError(t, sdk.Close())
+	runs := sdk.MaintenanceStatus().Runs
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, runs, sdk.MaintenanceStatus().Runs)
+}
+
+// failingStorage is a storage backend whose cleanup always fails
+type failingStorage struct {
+	storage.Storage
+	panics bool
+}
+
+func (f *failingStorage) CleanupExpiredTokensBatch(ctx context.Context, ids storage.IDRange, limit int) (int, error) {
+	if f.panics {
+		panic("boom")
+	}
+	return 1, errors.New("database is down")
+}
+
+func TestMaintenanceRecordsErrors(t *testing.T) {
+	m := newMaintenance(&failingStorage{Storage: storage.NewMemoryStorage()}, &PerformanceConfig{
+		TokenWorkers: 2,
+		BatchSize:    10,
+	})
+
+	m.run(context.Background())
+	status := m.Status()
+	assert.False(t, status.Enabled)
+	assert.Equal(t, int64(1), status.Runs)
+	assert.Equal(t, int64(1), status.Failures)
+	assert.Equal(t, 2, status.LastRemoved)
+	assert.ErrorContains(t, status.LastError, "database is down")
+
+	// Panicking backends are reported as errors too
+	m.storage = &failingStorage{Storage: storage.NewMemoryStorage(), panics: true}
+	m.run(context.Background())
+	assert.Equal(t, int64(2), m.Status().Failures)
+	assert.ErrorContains(t, m.Status().LastError, "panicked")
+}
@@ -0,0 +1,82 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// metricsMiddleware counts requests by route, method and status
+func (s *SDK) metricsMiddleware(c *fiber.Ctx) error {
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		// The error handler has not written the response yet
+		status = fiber.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+	// Fiber reuses the method's buffer once the handler returns, and label
+	// values outlive the request
+	s.metrics.RecordRequestCount(c.Route().Path, utils.CopyString(c.Method()), strconv.Itoa(status))
+
+	return err
+}
+
+// recordTokenGeneration reports a successful grant, failed grants are not
+// timed as they mostly measure how fast bad credentials are rejected
+func (s *SDK) recordTokenGeneration(client *models.OauthClient, grantType string, start time.Time) {
+	s.metrics.RecordTokenGeneration(client.Key, grantType, time.Since(start))
+}
+
+// gaugeInterval is how often the active tokens and runtime gauges are
+// refreshed
+const gaugeInterval = time.Minute
+
+// reportGauges refreshes the gauges now and every gaugeInterval until ctx is
+// done. Counting active tokens in storage keeps the gauge right whether
+// tokens expire, are cleaned up or are revoked by another replica.
+func (s *SDK) reportGauges(ctx context.Context) {
+	ticker := time.NewTicker(gaugeInterval)
+	defer ticker.Stop()
+	for {
+		s.recordActiveTokens(ctx)
+		s.recordRuntime()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordActiveTokens sets the active tokens gauge of providers that have
+// one, a failed count leaves the last value in place
+func (s *SDK) recordActiveTokens(ctx context.Context) {
+	recorder, ok := s.metrics.(storage.ActiveTokensRecorder)
+	if !ok {
+		return
+	}
+	if count, err := s.storage.CountActiveTokens(ctx); err == nil {
+		recorder.RecordActiveTokens(count)
+	}
+}
+
+// recordRuntime reports the memory obtained from the OS and the number of
+// goroutines
+func (s *SDK) recordRuntime() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	s.metrics.RecordMemoryUsage(int64(stats.Sys))
+	s.metrics.RecordGoroutineCount(runtime.NumGoroutine())
+}
@@ -0,0 +1,96 @@
+package oauth2server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetricsRoute(t *testing.T) {
+	sdk, app := newTestSDKFromBuilder(t, New().WithPrometheusMetrics("oauth2", "server"))
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", url.Values{
+		"grant_type": {"client_credentials"},
+	})
+	require.Equal(t, http.StatusOK, code)
+	_, err := sdk.ValidateAccessToken(context.Background(), data["access_token"].(string))
+	require.NoError(t, err)
+	_, err = sdk.ValidateAccessToken(context.Background(), "bogus")
+	require.Error(t, err)
+
+	sdk.recordRuntime()
+
+	// Metrics are not served next to the OAuth routes but on a router of
+	// their own
+	resp, err := app.Test(httptest.NewRequest("GET", "/v1/oauth/metrics", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	internal := fiber.New()
+	require.True(t, sdk.CreateServer().RegisterMetricsRoute(internal, "/metrics"))
+	resp, err = internal.Test(httptest.NewRequest("GET", "/metrics", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		`oauth2_server_token_generation_duration_seconds_count{grant_type="client_credentials"} 1`,
+		`oauth2_server_token_validation_duration_seconds_count{result="valid"} 1`,
+		`oauth2_server_token_validation_duration_seconds_count{result="invalid"} 1`,
+		`oauth2_server_rate_limit_requests_total{result="allowed"} 2`,
+		`oauth2_server_requests_total{endpoint="/v1/oauth/tokens",method="POST",status="200"} 1`,
+	} {
+		assert.Contains(t, string(body), line)
+	}
+	assert.Regexp(t, `oauth2_server_goroutines [1-9]`, string(body))
+	assert.Regexp(t, `oauth2_server_memory_usage_bytes [1-9]`, string(body))
+}
+
+func TestMetricsRouteDisabled(t *testing.T) {
+	sdk, _ := newTestSDK(t)
+
+	internal := fiber.New()
+	assert.False(t, sdk.CreateServer().RegisterMetricsRoute(internal, "/metrics"))
+	resp, err := internal.Test(httptest.NewRequest("GET", "/metrics", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDatadogMetricsExport(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	sdk, _ := newTestSDKFromBuilder(t, New().WithDatadogMetrics(agent.LocalAddr().String(), "oauth2"))
+	_, err = sdk.GrantClientCredentialsToken(context.Background(), "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	// Active tokens are counted in storage rather than when tokens are issued
+	sdk.recordActiveTokens(context.Background())
+
+	// Closing flushes the queued metrics, earlier ticks may have sent some
+	require.NoError(t, sdk.Close())
+	var received string
+	buf := make([]byte, 65536)
+	for {
+		agent.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		received += string(buf[:n]) + "\n"
+	}
+	assert.Contains(t, received, "|#client_id:test_client_1,grant_type:client_credentials")
+	assert.Contains(t, received, "oauth2.active_tokens:1|g")
+}
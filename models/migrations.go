@@ -13,12 +13,63 @@ var (
 			Name:     "initial",
 			Function: migrate0001,
 		},
+		{
+			Name:     "client_rate_limits",
+			Function: migrate0002,
+		},
+		{
+			Name:     "token_hash_columns",
+			Function: migrate0003,
+		},
+		{
+			Name:     "mysql_table_options",
+			Function: migrate0004,
+		},
+		{
+			Name:     "client_secret_length",
+			Function: migrate0005,
+		},
 	}
 )
 
-// MigrateAll executes all migrations
+// MigrateAll executes all migrations, creating the migrations table first
+// on a new database
 func MigrateAll(db *gorm.DB) error {
-	return migrations.Migrate(db, list)
+	if err := migrations.Bootstrap(db); err != nil {
+		return err
+	}
+
+	// SQLite cannot add constraints to existing tables, which the initial
+	// migration does, so its tables are created without the foreign keys.
+	// There are no SQLite databases from before the initial migration was
+	// written, so both kinds of database start from the same schema.
+	stages := list
+	if db.Dialect().GetName() == "sqlite3" {
+		stages = append([]migrations.MigrationStage{{
+			Name:     list[0].Name,
+			Function: migrate0001SQLite,
+		}}, list[1:]...)
+	}
+	return migrations.Migrate(db, stages)
+}
+
+// migrate0001SQLite is the initial migration without the foreign keys
+func migrate0001SQLite(db *gorm.DB, name string) error {
+	for _, model := range []interface{}{
+		new(OauthClient),
+		new(OauthScope),
+		new(OauthRole),
+		new(OauthUser),
+		new(OauthRefreshToken),
+		new(OauthAccessToken),
+		new(OauthAuthorizationCode),
+	} {
+		if err := db.CreateTable(model).Error; err != nil {
+			return fmt.Errorf("Error creating %s table: %s", db.NewScope(model).TableName(), err)
+		}
+	}
+
+	return nil
 }
 
 func migrate0001(db *gorm.DB, name string) error {
@@ -107,3 +158,105 @@ func migrate0001(db *gorm.DB, name string) error {
 
 	return nil
 }
+
+func migrate0002(db *gorm.DB, name string) error {
+	// Add per-client rate limit override columns
+	if err := db.AutoMigrate(new(OauthClient)).Error; err != nil {
+		return fmt.Errorf("Error adding rate limit columns to oauth_clients table: %s", err)
+	}
+
+	return nil
+}
+
+func migrate0003(db *gorm.DB, name string) error {
+	// Widen token columns so they can hold token hashes, SQLite does not
+	// enforce varchar lengths and cannot alter columns
+	typ := "varchar(100)"
+	switch db.Dialect().GetName() {
+	case "sqlite3":
+		return nil
+	case "mysql":
+		// MySQL replaces the whole column definition
+		typ += " NOT NULL"
+	}
+	if err := db.Model(new(OauthAccessToken)).ModifyColumn("token", typ).Error; err != nil {
+		return fmt.Errorf("Error widening oauth_access_tokens.token column: %s", err)
+	}
+	if err := db.Model(new(OauthRefreshToken)).ModifyColumn("token", typ).Error; err != nil {
+		return fmt.Errorf("Error widening oauth_refresh_tokens.token column: %s", err)
+	}
+	if err := db.Model(new(OauthAuthorizationCode)).ModifyColumn("code", typ).Error; err != nil {
+		return fmt.Errorf("Error widening oauth_authorization_codes.code column: %s", err)
+	}
+
+	return nil
+}
+
+func migrate0004(db *gorm.DB, name string) error {
+	// MySQL needs InnoDB for the foreign keys, and a case insensitive
+	// collation so usernames and client keys are unique regardless of case.
+	// The tables are converted on one connection, the foreign key checks
+	// would otherwise reject changing the collation of the key columns.
+	if db.Dialect().GetName() != "mysql" {
+		return nil
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("Error converting tables to InnoDB: %s", tx.Error)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			// Pooled connections must not keep the checks disabled
+			tx.Exec("SET FOREIGN_KEY_CHECKS = 1")
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Exec("SET FOREIGN_KEY_CHECKS = 0").Error; err != nil {
+		return fmt.Errorf("Error converting tables to InnoDB: %s", err)
+	}
+	for _, model := range []interface{}{
+		new(OauthClient),
+		new(OauthScope),
+		new(OauthRole),
+		new(OauthUser),
+		new(OauthRefreshToken),
+		new(OauthAccessToken),
+		new(OauthAuthorizationCode),
+	} {
+		table := tx.NewScope(model).QuotedTableName()
+		err := tx.Exec("ALTER TABLE " + table + " ENGINE=InnoDB, CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci").Error
+		if err != nil {
+			return fmt.Errorf("Error converting %s table to InnoDB: %s", table, err)
+		}
+	}
+	if err := tx.Exec("SET FOREIGN_KEY_CHECKS = 1").Error; err != nil {
+		return fmt.Errorf("Error converting tables to InnoDB: %s", err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("Error converting tables to InnoDB: %s", err)
+	}
+	committed = true
+
+	return nil
+}
+
+func migrate0005(db *gorm.DB, name string) error {
+	// Widen the client secret column so it can hold argon2id hashes, SQLite
+	// does not enforce varchar lengths and cannot alter columns
+	typ := "varchar(255)"
+	switch db.Dialect().GetName() {
+	case "sqlite3":
+		return nil
+	case "mysql":
+		// MySQL replaces the whole column definition
+		typ += " NOT NULL"
+	}
+	if err := db.Model(new(OauthClient)).ModifyColumn("secret", typ).Error; err != nil {
+		return fmt.Errorf("Error widening oauth_clients.secret column: %s", err)
+	}
+
+	return nil
+}
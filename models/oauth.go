@@ -13,8 +13,11 @@ import (
 type OauthClient struct {
 	MyGormModel
 	Key         string         `sql:"type:varchar(254);unique;not null"`
-	Secret      string         `sql:"type:varchar(60);not null"`
+	Secret      string         `sql:"type:varchar(255);not null"`
 	RedirectURI sql.NullString `sql:"type:varchar(200)"`
+	// Per-client rate limit overrides, NULL means use the server defaults
+	RateLimitRPS   sql.NullInt64
+	RateLimitBurst sql.NullInt64
 }
 
 // TableName specifies table name
@@ -68,7 +71,7 @@ type OauthRefreshToken struct {
 	UserID    sql.NullString `sql:"index"`
 	Client    *OauthClient
 	User      *OauthUser
-	Token     string    `sql:"type:varchar(40);unique;not null"`
+	Token     string    `sql:"type:varchar(100);unique;not null"`
 	ExpiresAt time.Time `sql:"not null"`
 	Scope     string    `sql:"type:varchar(200);not null"`
 }
@@ -85,7 +88,7 @@ type OauthAccessToken struct {
 	UserID    sql.NullString `sql:"index"`
 	Client    *OauthClient
 	User      *OauthUser
-	Token     string    `sql:"type:varchar(40);unique;not null"`
+	Token     string    `sql:"type:varchar(100);unique;not null"`
 	ExpiresAt time.Time `sql:"not null"`
 	Scope     string    `sql:"type:varchar(200);not null"`
 }
@@ -102,7 +105,7 @@ type OauthAuthorizationCode struct {
 	UserID      sql.NullString `sql:"index;not null"`
 	Client      *OauthClient
 	User        *OauthUser
-	Code        string         `sql:"type:varchar(40);unique;not null"`
+	Code        string         `sql:"type:varchar(100);unique;not null"`
 	RedirectURI sql.NullString `sql:"type:varchar(200)"`
 	ExpiresAt   time.Time      `sql:"not null"`
 	Scope       string         `sql:"type:varchar(200);not null"`
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/jinzhu/gorm"
+)
+
+// tokenHashBatchSize is the number of rows rewritten per query
+const tokenHashBatchSize = 500
+
+// MigrateTokenHashes replaces plaintext access tokens, refresh tokens and
+// authorization codes with their hashes, rows that are already hashed are
+// skipped so it is safe to run repeatedly. It returns the number of rows
+// rewritten.
+func MigrateTokenHashes(db *gorm.DB, hasher *tokenhash.Hasher) (int, error) {
+	var migrated int
+	for _, table := range []struct{ name, column string }{
+		{new(OauthAccessToken).TableName(), "token"},
+		{new(OauthRefreshToken).TableName(), "token"},
+		{new(OauthAuthorizationCode).TableName(), "code"},
+	} {
+		for {
+			var rows []struct {
+				ID    string
+				Value string
+			}
+			err := db.Table(table.name).
+				Select(fmt.Sprintf("id, %s AS value", table.column)).
+				Where(fmt.Sprintf("%s NOT LIKE ?", table.column), tokenhash.Prefix+"%").
+				Limit(tokenHashBatchSize).Scan(&rows).Error
+			if err != nil {
+				return migrated, fmt.Errorf("Error reading %s: %s", table.name, err)
+			}
+			if len(rows) == 0 {
+				break
+			}
+
+			for _, row := range rows {
+				err := db.Table(table.name).Where("id = ?", row.ID).
+					UpdateColumn(table.column, hasher.Hash(row.Value)).Error
+				if err != nil {
+					return migrated, fmt.Errorf("Error hashing %s.%s: %s", table.name, table.column, err)
+				}
+				migrated++
+			}
+		}
+	}
+
+	return migrated, nil
+}
@@ -25,10 +25,13 @@ func (s *Service) GrantAccessToken(client *models.OauthClient, user *models.Oaut
 
 	// Create a new access token
 	accessToken := models.NewOauthAccessToken(client, user, expiresIn, scope)
+	token := accessToken.Token
+	accessToken.Token = s.hashToken(token)
 	if err := tx.Create(accessToken).Error; err != nil {
 		tx.Rollback() // rollback the transaction
 		return nil, err
 	}
+	accessToken.Token = token
 	accessToken.Client = client
 	accessToken.User = user
 
@@ -19,13 +19,16 @@ var (
 func (s *Service) Authenticate(token string) (*models.OauthAccessToken, error) {
 	// Fetch the access token from the database
 	accessToken := new(models.OauthAccessToken)
-	notFound := s.db.Where("token = ?", token).First(accessToken).RecordNotFound()
+	notFound := s.db.Where("token IN (?)", s.tokenCandidates(token)).First(accessToken).RecordNotFound()
 
 	// Not found
 	if notFound {
 		return nil, ErrAccessTokenNotFound
 	}
 
+	// Callers work with the token they presented, not the stored hash
+	accessToken.Token = token
+
 	// Check the access token hasn't expired
 	if time.Now().UTC().After(accessToken.ExpiresAt) {
 		return nil, ErrAccessTokenExpired
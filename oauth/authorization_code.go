@@ -18,9 +18,12 @@ var (
 func (s *Service) GrantAuthorizationCode(client *models.OauthClient, user *models.OauthUser, expiresIn int, redirectURI, scope string) (*models.OauthAuthorizationCode, error) {
 	// Create a new authorization code
 	authorizationCode := models.NewOauthAuthorizationCode(client, user, expiresIn, redirectURI, scope)
+	code := authorizationCode.Code
+	authorizationCode.Code = s.hashToken(code)
 	if err := s.db.Create(authorizationCode).Error; err != nil {
 		return nil, err
 	}
+	authorizationCode.Code = code
 	authorizationCode.Client = client
 	authorizationCode.User = user
 
@@ -32,12 +35,13 @@ func (s *Service) getValidAuthorizationCode(code, redirectURI string, client *mo
 	// Fetch the auth code from the database
 	authorizationCode := new(models.OauthAuthorizationCode)
 	notFound := models.OauthAuthorizationCodePreload(s.db).Where("client_id = ?", client.ID).
-		Where("code = ?", code).First(authorizationCode).RecordNotFound()
+		Where("code IN (?)", s.tokenCandidates(code)).First(authorizationCode).RecordNotFound()
 
 	// Not found
 	if notFound {
 		return nil, ErrAuthorizationCodeNotFound
 	}
+	authorizationCode.Code = code
 
 	// Redirect URI must match if it was used to obtain the authorization code
 	if redirectURI != authorizationCode.RedirectURI.String {
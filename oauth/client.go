@@ -29,9 +29,9 @@ func (s *Service) ClientExists(clientID string) bool {
 
 // FindClientByClientID looks up a client by client ID
 func (s *Service) FindClientByClientID(clientID string) (*models.OauthClient, error) {
-	// Client IDs are case insensitive
+	// Client IDs are case insensitive, key is a reserved word in MySQL
 	client := new(models.OauthClient)
-	notFound := s.db.Where("key = LOWER(?)", clientID).
+	notFound := s.db.Where(s.db.Dialect().Quote("key")+" = LOWER(?)", clientID).
 		First(client).RecordNotFound()
 
 	// Not found
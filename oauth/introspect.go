@@ -71,7 +71,7 @@ func (s *Service) NewIntrospectResponseFromAccessToken(accessToken *models.Oauth
 
 	if accessToken.ClientID.Valid {
 		client := new(models.OauthClient)
-		notFound := s.db.Select("key").First(client, accessToken.ClientID.String).
+		notFound := s.db.Select(s.db.Dialect().Quote("key")).First(client, accessToken.ClientID.String).
 			RecordNotFound()
 		if notFound {
 			return nil, ErrClientNotFound
@@ -103,7 +103,7 @@ func (s *Service) NewIntrospectResponseFromRefreshToken(refreshToken *models.Oau
 
 	if refreshToken.ClientID.Valid {
 		client := new(models.OauthClient)
-		notFound := s.db.Select("key").First(client, refreshToken.ClientID.String).
+		notFound := s.db.Select(s.db.Dialect().Quote("key")).First(client, refreshToken.ClientID.String).
 			RecordNotFound()
 		if notFound {
 			return nil, ErrClientNotFound
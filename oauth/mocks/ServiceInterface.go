@@ -5,6 +5,7 @@ import "github.com/stretchr/testify/mock"
 
 import "github.com/RichardKnop/go-oauth2-server/config"
 import "github.com/RichardKnop/go-oauth2-server/models"
+import "github.com/RichardKnop/go-oauth2-server/storage"
 import "github.com/RichardKnop/go-oauth2-server/util/routes"
 import "github.com/gorilla/mux"
 import "github.com/jinzhu/gorm"
@@ -495,3 +496,88 @@ func (_m *ServiceInterface) NewIntrospectResponseFromRefreshToken(refreshToken *
 
 	return r0, r1
 }
+func (_m *ServiceInterface) MigrateTokenHashes() (int, error) {
+	ret := _m.Called()
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func() int); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+func (_m *ServiceInterface) RevokeUserTokens(userID string) (*storage.RevokeResult, error) {
+	ret := _m.Called(userID)
+
+	var r0 *storage.RevokeResult
+	if rf, ok := ret.Get(0).(func(string) *storage.RevokeResult); ok {
+		r0 = rf(userID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*storage.RevokeResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(userID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+func (_m *ServiceInterface) RevokeClientTokens(clientID string) (*storage.RevokeResult, error) {
+	ret := _m.Called(clientID)
+
+	var r0 *storage.RevokeResult
+	if rf, ok := ret.Get(0).(func(string) *storage.RevokeResult); ok {
+		r0 = rf(clientID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*storage.RevokeResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(clientID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+func (_m *ServiceInterface) RevokeTokensWithScope(scope string) (*storage.RevokeResult, error) {
+	ret := _m.Called(scope)
+
+	var r0 *storage.RevokeResult
+	if rf, ok := ret.Get(0).(func(string) *storage.RevokeResult); ok {
+		r0 = rf(scope)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*storage.RevokeResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(scope)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -0,0 +1,3 @@
+// Package oauthtest tests oauth.Service against an SQLite database, the
+// oauth package's own suite needs a PostgreSQL server
+package oauthtest
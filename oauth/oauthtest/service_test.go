@@ -0,0 +1,113 @@
+package oauthtest_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/config"
+	"github.com/RichardKnop/go-oauth2-server/database"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/oauth"
+	"github.com/RichardKnop/go-oauth2-server/oauth/roles"
+	_ "github.com/RichardKnop/go-oauth2-server/storage/sqlite"
+	"github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestService returns a service backed by a fresh SQLite database
+func newTestService(t *testing.T, cnf *config.Config) (*oauth.Service, *gorm.DB) {
+	cnf.Database = config.DatabaseConfig{
+		Type:         "sqlite",
+		DatabaseName: filepath.Join(t.TempDir(), "oauth2.db"),
+	}
+	db, err := database.NewDatabase(cnf)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for _, role := range []string{roles.Superuser, roles.User} {
+		require.NoError(t, db.Create(&models.OauthRole{ID: role, Name: role}).Error)
+	}
+
+	service, err := oauth.NewService(cnf, db)
+	require.NoError(t, err)
+	return service, db
+}
+
+func TestNewServiceRequiresEncryptionKey(t *testing.T) {
+	cnf := &config.Config{Security: config.SecurityConfig{TokenEncryption: true}}
+	_, err := oauth.NewService(cnf, nil)
+	assert.ErrorIs(t, err, tokenhash.ErrKeyRequired)
+}
+
+func TestGetOrCreateRefreshTokenRotatesHashedToken(t *testing.T) {
+	service, db := newTestService(t, &config.Config{
+		Security: config.SecurityConfig{TokenEncryption: true, EncryptionKey: "secret_key"},
+	})
+	client, err := service.CreateClient("test_client_1", "test_secret", "https://www.example.com")
+	require.NoError(t, err)
+	user, err := service.CreateUser(roles.User, "test@user", "test_password")
+	require.NoError(t, err)
+
+	first, err := service.GetOrCreateRefreshToken(client, user, 3600, "read_write")
+	require.NoError(t, err)
+	second, err := service.GetOrCreateRefreshToken(client, user, 3600, "read_write")
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Token, second.Token)
+
+	// Only the latest refresh token is kept
+	var count int
+	require.NoError(t, db.Model(new(models.OauthRefreshToken)).Count(&count).Error)
+	assert.Equal(t, 1, count)
+
+	_, err = service.GetValidRefreshToken(first.Token, client)
+	assert.Equal(t, oauth.ErrRefreshTokenNotFound, err)
+	_, err = service.GetValidRefreshToken(second.Token, client)
+	assert.NoError(t, err)
+}
+
+func TestAuthClientAcceptsArgon2idSecret(t *testing.T) {
+	service, db := newTestService(t, &config.Config{})
+	client, err := service.CreateClient("test_client_1", "test_secret", "https://www.example.com")
+	require.NoError(t, err)
+
+	// The SDK rehashes secrets with the hasher it is configured with
+	hash, err := (&password.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}).Hash("test_secret")
+	require.NoError(t, err)
+	require.NoError(t, db.Model(client).UpdateColumn("secret", hash).Error)
+
+	_, err = service.AuthClient("test_client_1", "test_secret")
+	assert.NoError(t, err)
+	_, err = service.AuthClient("test_client_1", "bogus")
+	assert.Equal(t, oauth.ErrInvalidClientSecret, err)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	// Without a policy only the minimum length is checked
+	service, _ := newTestService(t, &config.Config{})
+	_, err := service.CreateUser(roles.User, "test@user", "short")
+	assert.Equal(t, oauth.ErrPasswordTooShort, err)
+	user, err := service.CreateUser(roles.User, "test@user", "test_password")
+	require.NoError(t, err)
+	assert.Equal(t, oauth.ErrPasswordTooShort, service.SetPassword(user, "short"))
+
+	// Every violated rule of a configured policy is reported at once
+	service, _ = newTestService(t, &config.Config{
+		Password: config.PasswordConfig{MinLength: 8, RequireUppercase: true, RequireNumbers: true},
+	})
+	_, err = service.CreateUser(roles.User, "test@user", "short")
+	policyErr := new(password.PolicyError)
+	if assert.ErrorAs(t, err, &policyErr) {
+		assert.Len(t, policyErr.Violations, 3)
+	}
+	user, err = service.CreateUser(roles.User, "test@user", "Test_password1")
+	require.NoError(t, err)
+	err = service.SetPassword(user, "test_password1")
+	if assert.ErrorAs(t, err, &policyErr) {
+		assert.Len(t, policyErr.Violations, 1)
+		assert.ErrorIs(t, err, password.ErrUppercaseRequired)
+	}
+	assert.NoError(t, service.SetPassword(user, "Test_password2"))
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/RichardKnop/go-oauth2-server/models"
 	"github.com/RichardKnop/go-oauth2-server/util"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/jinzhu/gorm"
 )
 
 var (
@@ -17,8 +19,8 @@ var (
 	ErrRequestedScopeCannotBeGreater = errors.New("Requested scope cannot be greater")
 )
 
-// GetOrCreateRefreshToken retrieves an existing refresh token, if expired,
-// the token gets deleted and new refresh token is created
+// GetOrCreateRefreshToken retrieves an existing refresh token, if expired or
+// hashed, the token gets deleted and new refresh token is created
 func (s *Service) GetOrCreateRefreshToken(client *models.OauthClient, user *models.OauthUser, expiresIn int, scope string) (*models.OauthRefreshToken, error) {
 	// Try to fetch an existing refresh token first
 	refreshToken := new(models.OauthRefreshToken)
@@ -36,20 +38,31 @@ func (s *Service) GetOrCreateRefreshToken(client *models.OauthClient, user *mode
 		expired = time.Now().UTC().After(refreshToken.ExpiresAt)
 	}
 
-	// If the refresh token has expired, delete it
-	if expired {
-		s.db.Unscoped().Delete(refreshToken)
+	// Reuse a stored refresh token unless it expired, a hashed refresh token
+	// cannot be handed out again so it is rotated too
+	if found && !expired && !tokenhash.IsHashed(refreshToken.Token) {
+		return refreshToken, nil
 	}
 
-	// Create a new refresh token if it expired or was not found
-	if expired || !found {
-		refreshToken = models.NewOauthRefreshToken(client, user, expiresIn, scope)
-		if err := s.db.Create(refreshToken).Error; err != nil {
-			return nil, err
+	// Replace the old refresh token, if any, with a new one
+	oldRefreshToken := refreshToken
+	refreshToken = models.NewOauthRefreshToken(client, user, expiresIn, scope)
+	token := refreshToken.Token
+	refreshToken.Token = s.hashToken(token)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if found {
+			if err := tx.Unscoped().Delete(oldRefreshToken).Error; err != nil {
+				return err
+			}
 		}
-		refreshToken.Client = client
-		refreshToken.User = user
+		return tx.Create(refreshToken).Error
+	})
+	if err != nil {
+		return nil, err
 	}
+	refreshToken.Token = token
+	refreshToken.Client = client
+	refreshToken.User = user
 
 	return refreshToken, nil
 }
@@ -59,12 +72,13 @@ func (s *Service) GetValidRefreshToken(token string, client *models.OauthClient)
 	// Fetch the refresh token from the database
 	refreshToken := new(models.OauthRefreshToken)
 	notFound := models.OauthRefreshTokenPreload(s.db).Where("client_id = ?", client.ID).
-		Where("token = ?", token).First(refreshToken).RecordNotFound()
+		Where("token IN (?)", s.tokenCandidates(token)).First(refreshToken).RecordNotFound()
 
 	// Not found
 	if notFound {
 		return nil, ErrRefreshTokenNotFound
 	}
+	refreshToken.Token = token
 
 	// Check the refresh token hasn't expired
 	if time.Now().UTC().After(refreshToken.ExpiresAt) {
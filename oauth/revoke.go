@@ -0,0 +1,33 @@
+package oauth
+
+import (
+	"context"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/sqlstore"
+)
+
+// RevokeUserTokens deletes the access tokens, refresh tokens and
+// authorization codes issued to the user with userID
+func (s *Service) RevokeUserTokens(userID string) (*storage.RevokeResult, error) {
+	return s.store().RevokeUserTokens(context.Background(), userID)
+}
+
+// RevokeClientTokens deletes the access tokens, refresh tokens and
+// authorization codes issued to the client with clientID. It is the ID of
+// the client rather than its key, so the tokens of a deleted client can be
+// revoked as well.
+func (s *Service) RevokeClientTokens(clientID string) (*storage.RevokeResult, error) {
+	return s.store().RevokeClientTokens(context.Background(), clientID)
+}
+
+// RevokeTokensWithScope deletes the access tokens, refresh tokens and
+// authorization codes granted scope
+func (s *Service) RevokeTokensWithScope(scope string) (*storage.RevokeResult, error) {
+	return s.store().RevokeTokensWithScope(context.Background(), scope)
+}
+
+// store returns the storage backend for the service's database
+func (s *Service) store() *sqlstore.Store {
+	return sqlstore.New(s.db, nil, nil)
+}
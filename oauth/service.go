@@ -1,8 +1,11 @@
 package oauth
 
 import (
+	"fmt"
+
 	"github.com/RichardKnop/go-oauth2-server/config"
 	"github.com/RichardKnop/go-oauth2-server/oauth/roles"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
 	"github.com/jinzhu/gorm"
 )
 
@@ -11,15 +14,28 @@ type Service struct {
 	cnf          *config.Config
 	db           *gorm.DB
 	allowedRoles []string
+	tokenHasher  *tokenhash.Hasher
 }
 
-// NewService returns a new Service instance
-func NewService(cnf *config.Config, db *gorm.DB) *Service {
-	return &Service{
+// NewService returns a new Service instance, it fails when token encryption
+// is enabled without a usable encryption key
+func NewService(cnf *config.Config, db *gorm.DB) (*Service, error) {
+	s := &Service{
 		cnf:          cnf,
 		db:           db,
 		allowedRoles: []string{roles.Superuser, roles.User},
 	}
+
+	// Store keyed hashes of tokens instead of the tokens themselves
+	if cnf.Security.TokenEncryption {
+		hasher, err := tokenhash.New(cnf.Security.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable token encryption: %w", err)
+		}
+		s.tokenHasher = hasher
+	}
+
+	return s, nil
 }
 
 // GetConfig returns config.Config instance
@@ -3,6 +3,7 @@ package oauth
 import (
 	"github.com/RichardKnop/go-oauth2-server/config"
 	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
 	"github.com/RichardKnop/go-oauth2-server/util/routes"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
@@ -42,5 +43,9 @@ type ServiceInterface interface {
 	Authenticate(token string) (*models.OauthAccessToken, error)
 	NewIntrospectResponseFromAccessToken(accessToken *models.OauthAccessToken) (*IntrospectResponse, error)
 	NewIntrospectResponseFromRefreshToken(refreshToken *models.OauthRefreshToken) (*IntrospectResponse, error)
+	MigrateTokenHashes() (int, error)
+	RevokeUserTokens(userID string) (*storage.RevokeResult, error)
+	RevokeClientTokens(clientID string) (*storage.RevokeResult, error)
+	RevokeTokensWithScope(scope string) (*storage.RevokeResult, error)
 	Close()
 }
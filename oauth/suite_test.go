@@ -79,7 +79,10 @@ func (suite *OauthTestSuite) SetupSuite() {
 	}
 
 	// Initialise the service
-	suite.service = oauth.NewService(suite.cnf, suite.db)
+	suite.service, err = oauth.NewService(suite.cnf, suite.db)
+	if err != nil {
+		log.ERROR.Fatal(err)
+	}
 
 	// Register routes
 	suite.router = mux.NewRouter()
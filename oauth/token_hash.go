@@ -0,0 +1,26 @@
+package oauth
+
+import (
+	"github.com/RichardKnop/go-oauth2-server/models"
+)
+
+// hashToken returns the value stored in the database for a token or an
+// authorization code, the token itself unless token encryption is enabled
+func (s *Service) hashToken(token string) string {
+	return s.tokenHasher.Hash(token)
+}
+
+// tokenCandidates returns the stored values a token may be found under,
+// rows stored before token encryption was enabled are matched by plaintext
+func (s *Service) tokenCandidates(token string) []string {
+	return s.tokenHasher.Candidates(token)
+}
+
+// MigrateTokenHashes hashes tokens stored before token encryption was
+// enabled and returns the number of rows rewritten
+func (s *Service) MigrateTokenHashes() (int, error) {
+	if s.tokenHasher == nil {
+		return 0, nil
+	}
+	return models.MigrateTokenHashes(s.db, s.tokenHasher)
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/RichardKnop/go-oauth2-server/config"
 	"github.com/RichardKnop/go-oauth2-server/models"
 	"github.com/RichardKnop/go-oauth2-server/util"
 	pass "github.com/RichardKnop/go-oauth2-server/util/password"
@@ -124,8 +125,8 @@ func (s *Service) createUserCommon(db *gorm.DB, roleID, username, password strin
 
 	// If the password is being set already, create a bcrypt hash
 	if password != "" {
-		if len(password) < MinPasswordLength {
-			return nil, ErrPasswordTooShort
+		if err := s.validatePassword(password); err != nil {
+			return nil, err
 		}
 		passwordHash, err := pass.HashPassword(password)
 		if err != nil {
@@ -147,8 +148,8 @@ func (s *Service) createUserCommon(db *gorm.DB, roleID, username, password strin
 }
 
 func (s *Service) setPasswordCommon(db *gorm.DB, user *models.OauthUser, password string) error {
-	if len(password) < MinPasswordLength {
-		return ErrPasswordTooShort
+	if err := s.validatePassword(password); err != nil {
+		return err
 	}
 
 	// Create a bcrypt hash
@@ -170,3 +171,31 @@ func (s *Service) updateUsernameCommon(db *gorm.DB, user *models.OauthUser, user
 	}
 	return db.Model(user).UpdateColumn("username", strings.ToLower(username)).Error
 }
+
+// validatePassword checks the password against the configured policy, the
+// errors are *pass.PolicyError values listing every violated rule. Without a
+// policy only MinPasswordLength is checked and ErrPasswordTooShort returned,
+// as before the policy was configurable.
+func (s *Service) validatePassword(password string) error {
+	if s.cnf.Password == (config.PasswordConfig{}) {
+		if len(password) < MinPasswordLength {
+			return ErrPasswordTooShort
+		}
+		return nil
+	}
+	return s.passwordPolicy().Validate(password)
+}
+
+// passwordPolicy returns the configured password policy
+func (s *Service) passwordPolicy() *pass.Policy {
+	policy := &pass.Policy{
+		MinLength:        s.cnf.Password.MinLength,
+		RequireUppercase: s.cnf.Password.RequireUppercase,
+		RequireNumbers:   s.cnf.Password.RequireNumbers,
+		RequireSymbols:   s.cnf.Password.RequireSymbols,
+	}
+	if policy.MinLength == 0 {
+		policy.MinLength = MinPasswordLength
+	}
+	return policy
+}
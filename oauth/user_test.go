@@ -1,8 +1,10 @@
 package oauth_test
 
 import (
+	"errors"
 	"time"
 
+	"github.com/RichardKnop/go-oauth2-server/config"
 	"github.com/RichardKnop/go-oauth2-server/models"
 	"github.com/RichardKnop/go-oauth2-server/oauth"
 	"github.com/RichardKnop/go-oauth2-server/oauth/roles"
@@ -172,6 +174,28 @@ func (suite *OauthTestSuite) TestCreateUser() {
 	if assert.NotNil(suite.T(), user) {
 		assert.Equal(suite.T(), "test@newuser2", user.Username)
 	}
+
+	// Every violated password policy rule is reported at once
+	suite.cnf.Password = config.PasswordConfig{
+		MinLength:        8,
+		RequireUppercase: true,
+		RequireNumbers:   true,
+	}
+	defer func() { suite.cnf.Password = config.PasswordConfig{} }()
+	user, err = suite.service.CreateUser(
+		roles.User,      // role ID
+		"test@newuser3", // username
+		"short",         // password
+	)
+
+	// User object should be nil
+	assert.Nil(suite.T(), user)
+
+	// Correct error should be returned
+	policyErr := new(pass.PolicyError)
+	if assert.True(suite.T(), errors.As(err, &policyErr)) {
+		assert.Len(suite.T(), policyErr.Violations, 3)
+	}
 }
 
 func (suite *OauthTestSuite) TestSetPassword() {
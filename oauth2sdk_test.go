@@ -0,0 +1,343 @@
+package oauth2server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrantClientCredentialsToken(t *testing.T) {
+	sdk, _ := newTestSDK(t)
+	ctx := context.Background()
+
+	_, err := sdk.GrantClientCredentialsToken(ctx, "bogus", "test_secret", "")
+	assert.True(t, errors.Is(err, ErrInvalidClientIDOrSecret))
+
+	_, err = sdk.GrantClientCredentialsToken(ctx, "test_client_1", "bogus", "")
+	assert.True(t, errors.Is(err, ErrInvalidClientIDOrSecret))
+
+	resp, err := sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.AccessToken)
+	assert.Empty(t, resp.RefreshToken)
+
+	accessToken, err := sdk.ValidateAccessToken(ctx, resp.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "1", accessToken.ClientID.String)
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	sdk, _ := newTestSDK(t)
+	ctx := context.Background()
+
+	_, err := sdk.IssueAuthorizationCode(ctx, "bogus", "1", "", "")
+	assert.True(t, errors.Is(err, ErrClientNotFound))
+
+	_, err = sdk.IssueAuthorizationCode(ctx, "test_client_1", "bogus", "", "")
+	assert.True(t, errors.Is(err, ErrUserNotFound))
+
+	_, err = sdk.IssueAuthorizationCode(ctx, "test_client_1", "1", "https://bogus", "")
+	assert.True(t, errors.Is(err, ErrInvalidRedirectURI))
+
+	// Redirect URI defaults to the one registered for the client
+	authorizationCode, err := sdk.IssueAuthorizationCode(ctx, "test_client_1", "1", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.example.com", authorizationCode.RedirectURI.String)
+	assert.Equal(t, "read", authorizationCode.Scope)
+
+	_, err = sdk.ExchangeAuthorizationCode(ctx, "test_client_1", "test_secret", authorizationCode.Code, "https://bogus")
+	assert.True(t, errors.Is(err, ErrInvalidRedirectURI))
+
+	resp, err := sdk.ExchangeAuthorizationCode(ctx, "test_client_1", "test_secret", authorizationCode.Code, "https://www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1", resp.UserID)
+	assert.NotEmpty(t, resp.RefreshToken)
+
+	// Codes can only be used once
+	_, err = sdk.ExchangeAuthorizationCode(ctx, "test_client_1", "test_secret", authorizationCode.Code, "https://www.example.com")
+	assert.True(t, errors.Is(err, ErrAuthorizationCodeNotFound))
+
+	refreshed, err := sdk.RefreshToken(ctx, "test_client_1", "test_secret", resp.RefreshToken, "")
+	require.NoError(t, err)
+	assert.NotEqual(t, resp.AccessToken, refreshed.AccessToken)
+	assert.Equal(t, resp.RefreshToken, refreshed.RefreshToken)
+
+	_, err = sdk.RefreshToken(ctx, "test_client_1", "test_secret", resp.RefreshToken, "read write")
+	assert.True(t, errors.Is(err, ErrInvalidScope))
+}
+
+// failingRefreshTokens fails to store refresh tokens, also in transactions
+type failingRefreshTokens struct {
+	storage.Storage
+}
+
+var errStoreFailed = errors.New("store failed")
+
+func (f failingRefreshTokens) StoreRefreshToken(ctx context.Context, token *models.OauthRefreshToken) error {
+	return errStoreFailed
+}
+
+func (f failingRefreshTokens) WithTx(ctx context.Context, fn func(tx storage.Storage) error) error {
+	return f.Storage.WithTx(ctx, func(tx storage.Storage) error {
+		return fn(failingRefreshTokens{tx})
+	})
+}
+
+func TestAuthorizationCodeExchangeIsAtomic(t *testing.T) {
+	sdk, _ := newTestSDK(t)
+	ctx := context.Background()
+
+	authorizationCode, err := sdk.IssueAuthorizationCode(ctx, "test_client_1", "1", "", "")
+	require.NoError(t, err)
+
+	// The code is kept and no access token is left behind
+	sdk.storage = failingRefreshTokens{sdk.storage}
+	_, err = sdk.ExchangeAuthorizationCode(ctx, "test_client_1", "test_secret", authorizationCode.Code, "https://www.example.com")
+	assert.True(t, errors.Is(err, errStoreFailed), "got %v", err)
+	page, err := sdk.storage.ListTokens(ctx, storage.TokenFilter{ClientID: "1"}, storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, page.Tokens)
+
+	sdk.storage = sdk.storage.(failingRefreshTokens).Storage
+	resp, err := sdk.ExchangeAuthorizationCode(ctx, "test_client_1", "test_secret", authorizationCode.Code, "https://www.example.com")
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.RefreshToken)
+}
+
+func TestAuthorizationCodeConcurrentExchange(t *testing.T) {
+	sdk, _ := newTestSDK(t)
+	ctx := context.Background()
+
+	authorizationCode, err := sdk.IssueAuthorizationCode(ctx, "test_client_1", "1", "", "")
+	require.NoError(t, err)
+
+	const exchanges = 4
+	errs := make(chan error, exchanges)
+	for i := 0; i < exchanges; i++ {
+		go func() {
+			_, err := sdk.ExchangeAuthorizationCode(ctx, "test_client_1", "test_secret", authorizationCode.Code, "https://www.example.com")
+			errs <- err
+		}()
+	}
+	exchanged := 0
+	for i := 0; i < exchanges; i++ {
+		if err := <-errs; err == nil {
+			exchanged++
+		} else {
+			assert.True(t, errors.Is(err, ErrAuthorizationCodeNotFound), "got %v", err)
+		}
+	}
+	assert.Equal(t, 1, exchanged)
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	sdk, _ := newTestSDK(t)
+	ctx := context.Background()
+
+	_, err := sdk.ValidateAccessToken(ctx, "bogus")
+	assert.True(t, errors.Is(err, ErrAccessTokenNotFound))
+
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	expired := models.NewOauthAccessToken(client, nil, 60, "read")
+	expired.ExpiresAt = time.Now().UTC().Add(-time.Second)
+	require.NoError(t, sdk.storage.StoreAccessToken(ctx, expired))
+
+	_, err = sdk.ValidateAccessToken(ctx, expired.Token)
+	assert.True(t, errors.Is(err, ErrAccessTokenExpired))
+}
+
+func TestRevokeToken(t *testing.T) {
+	sdk, _ := newTestSDKFromBuilder(t, New().WithMemoryCache(100))
+	ctx := context.Background()
+
+	resp, err := sdk.GrantPasswordToken(ctx, "test_client_1", "test_secret", "test@user", "test_password", "")
+	require.NoError(t, err)
+
+	// Make sure an active introspection response is cached
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	introspected, err := sdk.introspectToken(ctx, client, resp.AccessToken, AccessTokenHint)
+	require.NoError(t, err)
+	assert.True(t, introspected.Active)
+
+	assert.True(t, errors.Is(sdk.RevokeToken(ctx, "bogus", "test_secret", resp.AccessToken, ""), ErrInvalidClientIDOrSecret))
+	assert.True(t, errors.Is(sdk.RevokeToken(ctx, "test_client_1", "bogus", resp.AccessToken, ""), ErrInvalidClientIDOrSecret))
+	assert.True(t, errors.Is(sdk.RevokeToken(ctx, "test_client_1", "test_secret", "", ""), ErrTokenMissing))
+	assert.True(t, errors.Is(sdk.RevokeToken(ctx, "test_client_1", "test_secret", resp.AccessToken, "bogus"), ErrTokenHintInvalid))
+
+	// Unknown tokens are ignored
+	assert.NoError(t, sdk.RevokeToken(ctx, "test_client_1", "test_secret", "bogus", ""))
+
+	// A wrong hint still finds the token
+	require.NoError(t, sdk.RevokeToken(ctx, "test_client_1", "test_secret", resp.AccessToken, RefreshTokenHint))
+	_, err = sdk.ValidateAccessToken(ctx, resp.AccessToken)
+	assert.True(t, errors.Is(err, ErrAccessTokenNotFound))
+	introspected, err = sdk.introspectToken(ctx, client, resp.AccessToken, AccessTokenHint)
+	require.NoError(t, err)
+	assert.False(t, introspected.Active)
+
+	require.NoError(t, sdk.RevokeToken(ctx, "test_client_1", "test_secret", resp.RefreshToken, RefreshTokenHint))
+	_, err = sdk.RefreshToken(ctx, "test_client_1", "test_secret", resp.RefreshToken, "")
+	assert.True(t, errors.Is(err, ErrRefreshTokenNotFound))
+}
+
+func TestBuildWithPostgreSQL(t *testing.T) {
+	// Nothing listens on port 1, so the postgres backend fails to connect
+	_, err := New().WithPostgreSQL("postgres://localhost:1/oauth2?sslmode=disable&connect_timeout=1").WithEncryptionKey(testEncryptionKey).Build()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to connect to PostgreSQL")
+}
+
+func TestBuildWithSQLite(t *testing.T) {
+	sdk, err := New().WithSQLite(filepath.Join(t.TempDir(), "oauth2.db")).WithEncryptionKey(testEncryptionKey).Build()
+	require.NoError(t, err)
+	defer sdk.Close()
+	ctx := context.Background()
+
+	secretHash, err := pass.HashPassword("test_secret")
+	require.NoError(t, err)
+	require.NoError(t, sdk.storage.CreateClient(ctx, &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Key:         "test_client_1",
+		Secret:      string(secretHash),
+	}))
+
+	resp, err := sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	_, err = sdk.ValidateAccessToken(ctx, resp.AccessToken)
+	assert.NoError(t, err)
+}
+
+func TestBuildWithPersistentMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oauth2.json")
+	sdk, err := New().WithPersistentMemory(path).WithEncryptionKey(testEncryptionKey).Build()
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	secretHash, err := pass.HashPassword("test_secret")
+	require.NoError(t, err)
+	require.NoError(t, sdk.storage.CreateClient(ctx, &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Key:         "test_client_1",
+		Secret:      string(secretHash),
+	}))
+	resp, err := sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	require.NoError(t, sdk.Close())
+
+	// The client and its token are back after a restart
+	sdk, err = New().WithPersistentMemory(path).WithEncryptionKey(testEncryptionKey).Build()
+	require.NoError(t, err)
+	defer sdk.Close()
+
+	_, err = sdk.ValidateAccessToken(ctx, resp.AccessToken)
+	assert.NoError(t, err)
+	_, err = sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	assert.NoError(t, err)
+}
+
+func TestBuildWithRedisTokenStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	sdk, _ := newTestSDKFromBuilder(t, New().WithRedisTokenStore(server.Addr()))
+	ctx := context.Background()
+
+	resp, err := sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	assert.True(t, server.Exists("access_token:"+sdk.tokenHasher.Hash(resp.AccessToken)))
+
+	_, err = sdk.ValidateAccessToken(ctx, resp.AccessToken)
+	assert.NoError(t, err)
+}
+
+func TestBuildWithRedisCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	sdk, _ := newTestSDKFromBuilder(t, New().WithRedisCache("redis://"+server.Addr()))
+	ctx := context.Background()
+
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	resp, err := sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+
+	// Active introspection responses are cached in Redis
+	introspected, err := sdk.introspectToken(ctx, client, resp.AccessToken, AccessTokenHint)
+	require.NoError(t, err)
+	assert.True(t, introspected.Active)
+	assert.NotEmpty(t, server.Keys())
+
+	_, err = New().WithRedisCache("redis://localhost:1").WithEncryptionKey(testEncryptionKey).Build()
+	assert.Error(t, err)
+}
+
+func TestBuildWithL1Cache(t *testing.T) {
+	server := miniredis.RunT(t)
+	sdk, err := New().WithRedisCache("redis://"+server.Addr()).WithL1Cache(1000, 5*time.Second).WithEncryptionKey(testEncryptionKey).Build()
+	require.NoError(t, err)
+	defer sdk.Close()
+	assert.IsType(t, new(storage.TieredCache), sdk.cache)
+
+	_, err = New().WithMemoryCache(1000).WithL1Cache(1000, 5*time.Second).WithEncryptionKey(testEncryptionKey).Build()
+	assert.EqualError(t, err, "an L1 cache requires a Redis cache")
+}
+
+func TestBuildWithCircuitBreaker(t *testing.T) {
+	sdk, err := New().
+		WithSQLite(filepath.Join(t.TempDir(), "oauth2.db")).
+		WithCircuitBreaker(&storage.CircuitBreakerConfig{
+			Enabled:          true,
+			FailureThreshold: 2,
+			RecoveryTimeout:  time.Minute,
+		}).
+		WithEncryptionKey(testEncryptionKey).
+		Build()
+	require.NoError(t, err)
+	defer sdk.Close()
+	app := fiber.New()
+	sdk.CreateServer().RegisterRoutes(app, "/v1/oauth")
+	ctx := context.Background()
+	hashed, ok := sdk.storage.(*storage.HashedStorage)
+	require.True(t, ok)
+	breaker, ok := hashed.Storage.(*storage.CircuitBreakerStorage)
+	require.True(t, ok)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/v1/oauth/health", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Every query fails once the database is gone
+	require.NoError(t, breaker.Storage.Close())
+	for i := 0; i < 2; i++ {
+		_, err := sdk.ValidateAccessToken(ctx, "token")
+		require.Error(t, err)
+	}
+	assert.Equal(t, storage.CircuitOpen, breaker.State())
+
+	_, err = sdk.storage.GetClient(ctx, "test_client_1")
+	assert.Equal(t, storage.ErrCircuitOpen, err)
+	assert.Equal(t, http.StatusServiceUnavailable, getErrStatusCode(err))
+
+	// Only the status is reported, not the error, which is logged
+	resp, err = app.Test(httptest.NewRequest("GET", "/v1/oauth/health", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	var health map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	assert.Equal(t, "unhealthy", health["status"])
+	assert.Equal(t, "circuit_open", health["storage"])
+	assert.NotContains(t, health, "error")
+}
@@ -0,0 +1,301 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RateLimiter interface for different rate limiting strategies
+type RateLimiter interface {
+	Allow(ctx context.Context, clientID string) (bool, error)
+	Take(ctx context.Context, clientID string) (*RateLimitResult, error)
+	Reset(ctx context.Context, clientID string) error
+}
+
+// RateLimit defines the sustained rate and burst allowed for a client
+type RateLimit struct {
+	RPS   int `json:"rps"`
+	Burst int `json:"burst"`
+}
+
+// RateLimitResult describes the outcome of a single rate limiting decision
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // zero when allowed
+	ResetAfter time.Duration // until the client is back at full capacity
+}
+
+// RateLimitResolver returns a per-client override, nil means use the defaults
+type RateLimitResolver func(ctx context.Context, clientID string) (*RateLimit, error)
+
+// TokenBucketLimiter is an in-process token bucket rate limiter keyed by client ID
+type TokenBucketLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	defaults  RateLimit
+	window    time.Duration
+	resolver  RateLimitResolver
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	limit     RateLimit
+	tokens    float64
+	updatedAt time.Time
+	checkedAt time.Time // when the limit was last resolved
+}
+
+// NewTokenBucketLimiter creates a new token bucket rate limiter, the window
+// controls how often per-client overrides are re-read and idle buckets dropped
+func NewTokenBucketLimiter(defaults RateLimit, window time.Duration, resolver RateLimitResolver) *TokenBucketLimiter {
+	if window <= 0 {
+		window = time.Minute
+	}
+	return &TokenBucketLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		defaults: normalizeRateLimit(defaults),
+		window:   window,
+		resolver: resolver,
+		now:      time.Now,
+	}
+}
+
+// Allow returns true if the client can make another request right now
+func (l *TokenBucketLimiter) Allow(ctx context.Context, clientID string) (bool, error) {
+	result, err := l.Take(ctx, clientID)
+	if err != nil {
+		return false, err
+	}
+	return result.Allowed, nil
+}
+
+// Take consumes a token from the client's bucket if one is available
+func (l *TokenBucketLimiter) Take(ctx context.Context, clientID string) (*RateLimitResult, error) {
+	// Resolve the limit outside of the lock, it may hit the storage
+	now := l.now()
+	l.mu.Lock()
+	bucket, exists := l.buckets[clientID]
+	stale := !exists || now.Sub(bucket.checkedAt) >= l.window
+	l.mu.Unlock()
+
+	limit := l.defaults
+	if stale {
+		limit = resolveRateLimit(ctx, l.resolver, l.defaults, clientID)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, exists = l.buckets[clientID]
+	if !exists {
+		bucket = &tokenBucket{
+			limit:     limit,
+			tokens:    float64(limit.Burst),
+			updatedAt: now,
+			checkedAt: now,
+		}
+		l.buckets[clientID] = bucket
+	} else if stale {
+		bucket.limit = limit
+		bucket.checkedAt = now
+	}
+
+	bucket.refill(now)
+
+	result := &RateLimitResult{Limit: bucket.limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = bucket.durationFor(1 - bucket.tokens)
+	}
+	result.Remaining = int(math.Floor(bucket.tokens))
+	result.ResetAfter = bucket.durationFor(float64(bucket.limit.Burst) - bucket.tokens)
+
+	return result, nil
+}
+
+// Reset drops the client's bucket so it starts again at full capacity
+func (l *TokenBucketLimiter) Reset(ctx context.Context, clientID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, clientID)
+	return nil
+}
+
+// sweep drops buckets that have been idle for a whole window, this keeps
+// memory bounded when clients send bogus client IDs
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for clientID, bucket := range l.buckets {
+		if now.Sub(bucket.updatedAt) >= l.window {
+			delete(l.buckets, clientID)
+		}
+	}
+}
+
+// refill adds tokens accrued since the last update, capped at the burst size
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*float64(b.limit.RPS))
+		b.updatedAt = now
+	}
+}
+
+// durationFor returns how long it takes to accrue n tokens
+func (b *tokenBucket) durationFor(n float64) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(n / float64(b.limit.RPS) * float64(time.Second))
+}
+
+// resolveRateLimit returns the client's limit, falling back to the defaults
+func resolveRateLimit(ctx context.Context, resolver RateLimitResolver, defaults RateLimit, clientID string) RateLimit {
+	if resolver == nil {
+		return defaults
+	}
+	limit, err := resolver(ctx, clientID)
+	if err != nil || limit == nil {
+		return defaults
+	}
+	return normalizeRateLimit(*limit)
+}
+
+// normalizeRateLimit makes sure the rate is positive and the bucket can hold
+// at least one request
+func normalizeRateLimit(limit RateLimit) RateLimit {
+	if limit.RPS < 1 {
+		limit.RPS = 1
+	}
+	if limit.Burst < 1 {
+		limit.Burst = limit.RPS
+	}
+	return limit
+}
+
+// clientRateLimitResolver reads per-client overrides from the client record,
+// requests limited per IP address use the defaults
+func clientRateLimitResolver(s storage.Storage) RateLimitResolver {
+	return func(ctx context.Context, clientID string) (*RateLimit, error) {
+		if strings.HasPrefix(clientID, "ip:") {
+			return nil, nil
+		}
+		client, err := s.GetClient(ctx, clientID)
+		if errors.Is(err, storage.ErrClientNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if client == nil || !client.RateLimitRPS.Valid {
+			return nil, nil
+		}
+		return &RateLimit{
+			RPS:   int(client.RateLimitRPS.Int64),
+			Burst: int(client.RateLimitBurst.Int64),
+		}, nil
+	}
+}
+
+// ipRateLimitResolver gives requests limited per IP address their own limit
+// and passes client IDs on to next
+func ipRateLimitResolver(limit RateLimit, next RateLimitResolver) RateLimitResolver {
+	return func(ctx context.Context, clientID string) (*RateLimit, error) {
+		if strings.HasPrefix(clientID, "ip:") {
+			return &limit, nil
+		}
+		if next == nil {
+			return nil, nil
+		}
+		return next(ctx, clientID)
+	}
+}
+
+func createRateLimiter(config *RateLimitConfig, cache storage.CacheProvider, resolver RateLimitResolver) (RateLimiter, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+
+	defaults := RateLimit{RPS: config.DefaultRPS, Burst: config.BurstSize}
+	if config.IPRPS > 0 {
+		resolver = ipRateLimitResolver(RateLimit{RPS: config.IPRPS, Burst: config.IPBurst}, resolver)
+	}
+	switch config.Storage {
+	case "memory", "":
+		return NewTokenBucketLimiter(defaults, config.WindowSize, resolver), nil
+	case "redis":
+		// Counters are shared between replicas through the cache provider
+		if cache == nil {
+			return nil, fmt.Errorf("%s rate limit storage requires a cache provider", config.Storage)
+		}
+		return NewSlidingWindowLimiter(cache, defaults, config.WindowSize, resolver), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit storage: %s", config.Storage)
+	}
+}
+
+// rateLimitingMiddleware takes a token per IP address from every request
+// before its credentials are checked, so a flood of wrong secrets is turned
+// away without running the secret hasher. Requests from a client that has
+// authenticated then take a token per client as well. Made up client IDs
+// neither escape the limit nor use up the quota of a real client.
+func (s *SDK) rateLimitingMiddleware(c *fiber.Ctx) error {
+	if s.rateLimiter == nil {
+		return c.Next()
+	}
+
+	result, err := s.rateLimiter.Take(c.UserContext(), "ip:"+c.IP())
+	if err != nil {
+		// Fail open, an unavailable limiter should not take the server down
+		return c.Next()
+	}
+
+	clientID := ""
+	if _, _, ok := parseBasicAuth(c.Get(fiber.HeaderAuthorization)); ok && result.Allowed {
+		if client, err := s.basicAuthClient(c); err == nil {
+			// Client keys are case insensitive
+			clientID = strings.ToLower(client.Key)
+			if result, err = s.rateLimiter.Take(c.UserContext(), clientID); err != nil {
+				return c.Next()
+			}
+		}
+	}
+
+	// IP addresses are not reported, there are too many to tag metrics with
+	s.metrics.RecordRateLimit(clientID, !result.Allowed)
+
+	c.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+	if !result.Allowed {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		return errorResponse(c, ErrRateLimitExceeded.Error(), fiber.StatusTooManyRequests)
+	}
+
+	return c.Next()
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
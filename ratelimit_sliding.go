@@ -0,0 +1,184 @@
+package oauth2server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+)
+
+// SlidingWindowLimiter is a sliding window counter rate limiter, the counters
+// live in a shared cache so all replicas enforce a single limit per client
+type SlidingWindowLimiter struct {
+	cache     storage.CacheProvider
+	defaults  RateLimit
+	window    time.Duration
+	resolver  RateLimitResolver
+	now       func() time.Time
+	mu        sync.Mutex
+	limits    map[string]*resolvedRateLimit
+	lastSweep time.Time
+}
+
+type resolvedRateLimit struct {
+	limit     RateLimit
+	checkedAt time.Time
+}
+
+// NewSlidingWindowLimiter creates a new sliding window rate limiter, each
+// client may make RPS * window requests in any window. The whole quota can be
+// used at once, so the burst size does not apply.
+func NewSlidingWindowLimiter(cache storage.CacheProvider, defaults RateLimit, window time.Duration, resolver RateLimitResolver) *SlidingWindowLimiter {
+	if window <= 0 {
+		window = time.Minute
+	}
+	return &SlidingWindowLimiter{
+		cache:    cache,
+		defaults: normalizeRateLimit(defaults),
+		window:   window,
+		resolver: resolver,
+		now:      time.Now,
+		limits:   make(map[string]*resolvedRateLimit),
+	}
+}
+
+// Allow returns true if the client can make another request right now
+func (l *SlidingWindowLimiter) Allow(ctx context.Context, clientID string) (bool, error) {
+	result, err := l.Take(ctx, clientID)
+	if err != nil {
+		return false, err
+	}
+	return result.Allowed, nil
+}
+
+// Take counts a request against the client's current window. The previous
+// window's count is weighted by how much of it still overlaps the sliding
+// window, which smooths out bursts at window boundaries.
+func (l *SlidingWindowLimiter) Take(ctx context.Context, clientID string) (*RateLimitResult, error) {
+	now := l.now()
+	quota := l.quota(l.limitFor(ctx, clientID, now))
+
+	index := now.UnixNano() / int64(l.window)
+	elapsed := now.Sub(time.Unix(0, index*int64(l.window)))
+
+	// A missing previous window simply counts as zero
+	var previous int64
+	if err := l.cache.Get(ctx, l.key(clientID, index-1), &previous); err != nil {
+		previous = 0
+	}
+
+	// Counters are needed for two windows, the current one and the next one
+	// when it becomes the previous window
+	currentKey := l.key(clientID, index)
+	current, err := l.cache.Increment(ctx, currentKey, 1, 2*l.window)
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment rate limit counter: %w", err)
+	}
+
+	weight := 1 - float64(elapsed)/float64(l.window)
+	estimate := float64(previous)*weight + float64(current)
+
+	result := &RateLimitResult{
+		Limit:      int(quota),
+		ResetAfter: 2*l.window - elapsed,
+	}
+	if estimate <= float64(quota) {
+		result.Allowed = true
+		result.Remaining = int(quota - int64(math.Ceil(estimate)))
+		return result, nil
+	}
+
+	// Rejected requests do not count against the client
+	current--
+	l.cache.Increment(ctx, currentKey, -1, 2*l.window)
+
+	result.RetryAfter = l.retryAfter(previous, current, elapsed, quota)
+	if current == 0 {
+		result.ResetAfter = l.window - elapsed
+	}
+
+	return result, nil
+}
+
+// Reset deletes the client's counters so it starts again with a full quota
+func (l *SlidingWindowLimiter) Reset(ctx context.Context, clientID string) error {
+	l.mu.Lock()
+	delete(l.limits, clientID)
+	l.mu.Unlock()
+
+	index := l.now().UnixNano() / int64(l.window)
+	return l.cache.DeleteMulti(ctx, []string{
+		l.key(clientID, index),
+		l.key(clientID, index-1),
+	})
+}
+
+// retryAfter returns how long until one more request fits into the sliding
+// window, given the accepted request counts of the previous and current window
+func (l *SlidingWindowLimiter) retryAfter(previous, current int64, elapsed time.Duration, quota int64) time.Duration {
+	window := float64(l.window)
+
+	// There is room in the current window once enough of the previous
+	// window has slid out
+	if room := quota - current - 1; room >= 0 {
+		if previous == 0 {
+			return 0
+		}
+		wait := window*(1-float64(room)/float64(previous)) - float64(elapsed)
+		return time.Duration(math.Max(0, math.Ceil(wait)))
+	}
+
+	// Otherwise wait for the next window, where the current window becomes
+	// the previous one and slides out in the same way
+	wait := window*(1-float64(quota-1)/float64(current)) + window - float64(elapsed)
+	return time.Duration(math.Ceil(wait))
+}
+
+// limitFor returns the client's limit, overrides are re-read once per window
+func (l *SlidingWindowLimiter) limitFor(ctx context.Context, clientID string, now time.Time) RateLimit {
+	l.mu.Lock()
+	resolved, exists := l.limits[clientID]
+	l.mu.Unlock()
+	if exists && now.Sub(resolved.checkedAt) < l.window {
+		return resolved.limit
+	}
+
+	// Resolve the limit outside of the lock, it may hit the storage
+	limit := resolveRateLimit(ctx, l.resolver, l.defaults, clientID)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	l.limits[clientID] = &resolvedRateLimit{limit: limit, checkedAt: now}
+
+	return limit
+}
+
+// sweep drops limits that have not been used for a whole window
+func (l *SlidingWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for clientID, resolved := range l.limits {
+		if now.Sub(resolved.checkedAt) >= l.window {
+			delete(l.limits, clientID)
+		}
+	}
+}
+
+// quota returns the number of requests allowed per window
+func (l *SlidingWindowLimiter) quota(limit RateLimit) int64 {
+	quota := int64(float64(limit.RPS) * l.window.Seconds())
+	if quota < 1 {
+		quota = 1
+	}
+	return quota
+}
+
+func (l *SlidingWindowLimiter) key(clientID string, index int64) string {
+	return fmt.Sprintf("ratelimit:%s:%d", clientID, index)
+}
@@ -0,0 +1,269 @@
+package oauth2server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		now     = time.Now()
+		limiter = NewTokenBucketLimiter(RateLimit{RPS: 2, Burst: 3}, time.Minute, nil)
+	)
+	limiter.now = func() time.Time { return now }
+
+	// The burst is available straight away
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Take(ctx, "test_client_1")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, 2-i, result.Remaining)
+	}
+
+	// Then the bucket is empty
+	result, err := limiter.Take(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, result.ResetAfter)
+
+	// Other clients have their own buckets
+	allowed, err := limiter.Allow(ctx, "test_client_2")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// Tokens are refilled at the configured rate
+	now = now.Add(500 * time.Millisecond)
+	allowed, err = limiter.Allow(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = limiter.Allow(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Reset starts again at full capacity
+	require.NoError(t, limiter.Reset(ctx, "test_client_1"))
+	result, err = limiter.Take(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+}
+
+func TestTokenBucketLimiterOverrides(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		now       = time.Now()
+		resolved  int
+		overrides = map[string]*RateLimit{"partner": {RPS: 10, Burst: 10}}
+	)
+	limiter := NewTokenBucketLimiter(RateLimit{RPS: 1, Burst: 1}, time.Minute, func(ctx context.Context, clientID string) (*RateLimit, error) {
+		resolved++
+		return overrides[clientID], nil
+	})
+	limiter.now = func() time.Time { return now }
+
+	result, err := limiter.Take(ctx, "partner")
+	require.NoError(t, err)
+	assert.Equal(t, 10, result.Limit)
+
+	result, err = limiter.Take(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Limit)
+
+	// Overrides are only re-read once per window
+	limiter.Take(ctx, "partner")
+	assert.Equal(t, 2, resolved)
+
+	overrides["partner"] = &RateLimit{RPS: 20, Burst: 20}
+	now = now.Add(time.Minute)
+	result, err = limiter.Take(ctx, "partner")
+	require.NoError(t, err)
+	assert.Equal(t, 20, result.Limit)
+	assert.Equal(t, 3, resolved)
+}
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	var (
+		ctx = context.Background()
+		now = time.Unix(1000, 0) // start of a 10 second window
+	)
+	cache, err := storage.NewMemoryCache(nil)
+	require.NoError(t, err)
+
+	// Two replicas sharing the same cache enforce a single limit
+	replicas := []*SlidingWindowLimiter{
+		NewSlidingWindowLimiter(cache, RateLimit{RPS: 1}, 10*time.Second, nil),
+		NewSlidingWindowLimiter(cache, RateLimit{RPS: 1}, 10*time.Second, nil),
+	}
+	for _, replica := range replicas {
+		replica.now = func() time.Time { return now }
+	}
+
+	for i := 0; i < 10; i++ {
+		result, err := replicas[i%2].Take(ctx, "test_client_1")
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 10, result.Limit)
+		assert.Equal(t, 9-i, result.Remaining)
+	}
+
+	result, err := replicas[0].Take(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 11*time.Second, result.RetryAfter)
+	assert.Equal(t, 20*time.Second, result.ResetAfter)
+
+	// Other clients have their own counters
+	allowed, err := replicas[1].Allow(ctx, "test_client_2")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// The previous window still counts while it slides out
+	now = now.Add(10 * time.Second)
+	allowed, err = replicas[1].Allow(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Rejected requests were not counted, so one request fits after a second
+	now = now.Add(time.Second)
+	allowed, err = replicas[1].Allow(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = replicas[0].Allow(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Reset clears the shared counters for every replica
+	require.NoError(t, replicas[0].Reset(ctx, "test_client_1"))
+	result, err = replicas[1].Take(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 9, result.Remaining)
+}
+
+func TestCreateRateLimiter(t *testing.T) {
+	config := &RateLimitConfig{Enabled: true, DefaultRPS: 1, Storage: "redis"}
+
+	_, err := createRateLimiter(config, nil, nil)
+	assert.Error(t, err)
+
+	cache, err := storage.NewMemoryCache(nil)
+	require.NoError(t, err)
+	limiter, err := createRateLimiter(config, cache, nil)
+	require.NoError(t, err)
+	assert.IsType(t, new(SlidingWindowLimiter), limiter)
+
+	config.Storage = "bogus"
+	_, err = createRateLimiter(config, cache, nil)
+	assert.Error(t, err)
+}
+
+func TestRateLimitingMiddleware(t *testing.T) {
+	sdk, app := newTestSDKFromBuilder(t, New().WithCustomRateLimit(&RateLimitConfig{
+		Enabled:    true,
+		DefaultRPS: 1,
+		BurstSize:  2,
+		WindowSize: time.Minute,
+		IPRPS:      100,
+		IPBurst:    100,
+	}))
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	for i := 0; i < 2; i++ {
+		code, _ := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", form)
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	code, data := postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", form)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, ErrRateLimitExceeded.Error(), data["error"])
+
+	r, err := http.NewRequest("GET", "/v1/oauth/health", nil)
+	require.NoError(t, err)
+	r.SetBasicAuth("test_client_1", "test_secret")
+	resp, err := app.Test(r)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get(fiber.HeaderRetryAfter))
+	assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Reset"))
+
+	// Partner clients can be given a higher tier on the client record
+	client, err := sdk.storage.GetClient(context.Background(), "test_client_1")
+	require.NoError(t, err)
+	client.RateLimitRPS = util.IntOrNull(100)
+	client.RateLimitBurst = util.IntOrNull(100)
+	require.NoError(t, sdk.storage.UpdateClient(context.Background(), client))
+	require.NoError(t, sdk.rateLimiter.Reset(context.Background(), "test_client_1"))
+
+	code, _ = postForm(t, app, "/v1/oauth/tokens", "test_client_1", "test_secret", form)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestRateLimitingMiddlewareKeys(t *testing.T) {
+	sdk, app := newTestSDKFromBuilder(t, New().WithCustomRateLimit(&RateLimitConfig{
+		Enabled:    true,
+		DefaultRPS: 1,
+		BurstSize:  2,
+		WindowSize: time.Minute,
+		IPRPS:      1,
+		IPBurst:    5,
+	}))
+	form := url.Values{"grant_type": {"client_credentials"}}
+	takeToken := func(clientID, secret string) (int, string) {
+		r := httptest.NewRequest("POST", "/v1/oauth/tokens", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(clientID, secret)
+		resp, err := app.Test(r)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("X-RateLimit-Limit")
+	}
+
+	// Made up client IDs and wrong secrets only use up the quota of the IP
+	// address
+	code, header := takeToken("bogus_1", "bogus")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "5", header)
+	code, _ = takeToken("test_client_1", "bogus")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Not the quota of the real client, whose key is case insensitive
+	code, header = takeToken("test_client_1", "test_secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "2", header)
+	code, _ = takeToken("TEST_client_1", "test_secret")
+	assert.Equal(t, http.StatusOK, code)
+	code, header = takeToken("test_client_1", "test_secret")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "2", header)
+
+	// Once the IP address is out of tokens requests are turned away before
+	// their credentials are checked
+	code, header = takeToken("test_client_1", "test_secret")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "5", header)
+	code, header = takeToken("bogus_2", "bogus")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "5", header)
+
+	// Per IP limits never look up a client
+	limit, err := clientRateLimitResolver(sdk.storage)(context.Background(), "ip:0.0.0.0")
+	assert.NoError(t, err)
+	assert.Nil(t, limit)
+}
@@ -0,0 +1,124 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+)
+
+// revokeToken revokes an access or refresh token issued to the client, see
+// RFC 7009. The hint only decides which token type is looked up first.
+func (s *SDK) revokeToken(ctx context.Context, client *models.OauthClient, token, tokenTypeHint string) error {
+	if token == "" {
+		return ErrTokenMissing
+	}
+
+	// Default to access token hint
+	if tokenTypeHint == "" {
+		tokenTypeHint = AccessTokenHint
+	}
+	revokers := []func(context.Context, *models.OauthClient, string) (bool, error){
+		s.revokeAccessToken,
+		s.revokeRefreshToken,
+	}
+	switch tokenTypeHint {
+	case AccessTokenHint:
+	case RefreshTokenHint:
+		revokers[0], revokers[1] = revokers[1], revokers[0]
+	default:
+		return ErrTokenHintInvalid
+	}
+
+	for _, revoke := range revokers {
+		revoked, err := revoke(ctx, client, token)
+		if err != nil || revoked {
+			return err
+		}
+	}
+
+	// Invalid tokens do not cause an error, RFC 7009 section 2.2
+	return nil
+}
+
+// revokeAccessToken deletes an access token if it belongs to the client
+func (s *SDK) revokeAccessToken(ctx context.Context, client *models.OauthClient, token string) (bool, error) {
+	accessToken, err := s.storage.GetAccessToken(ctx, token)
+	if errors.Is(err, storage.ErrTokenNotFound) || errors.Is(err, storage.ErrTokenExpired) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if accessToken == nil || accessToken.ClientID.String != client.ID {
+		return false, nil
+	}
+
+	if err := s.storage.DeleteAccessToken(ctx, token); err != nil {
+		return false, err
+	}
+
+	// Resource servers must not see a cached active response any more
+	if s.cache != nil {
+		s.cache.Delete(ctx, introspectCacheKey(s.tokenHasher.Hash(token), AccessTokenHint))
+	}
+
+	return true, nil
+}
+
+// revokeRefreshToken deletes a refresh token if it belongs to the client
+func (s *SDK) revokeRefreshToken(ctx context.Context, client *models.OauthClient, token string) (bool, error) {
+	refreshToken, err := s.storage.GetRefreshToken(ctx, token)
+	if errors.Is(err, storage.ErrTokenNotFound) || errors.Is(err, storage.ErrTokenExpired) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if refreshToken == nil || refreshToken.ClientID.String != client.ID {
+		return false, nil
+	}
+
+	if err := s.storage.DeleteRefreshToken(ctx, token); err != nil {
+		return false, err
+	}
+
+	if s.cache != nil {
+		s.cache.Delete(ctx, introspectCacheKey(s.tokenHasher.Hash(token), RefreshTokenHint))
+	}
+
+	return true, nil
+}
+
+// revoked drops the cached introspection responses of the tokens a bulk
+// revocation deleted, also when it failed part way
+func (s *SDK) revoked(ctx context.Context, result *storage.RevokeResult, err error) (*storage.RevokeResult, error) {
+	if s.cache == nil || result == nil {
+		return result, err
+	}
+
+	var keys []string
+	for _, kind := range []struct {
+		hint   string
+		values []string
+	}{
+		{AccessTokenHint, result.Tokens},
+		{RefreshTokenHint, result.RefreshTokenValues},
+	} {
+		for _, value := range kind.values {
+			// Rows stored before token encryption was enabled hold plaintext
+			if !tokenhash.IsHashed(value) {
+				value = s.tokenHasher.Hash(value)
+			}
+			keys = append(keys, introspectCacheKey(value, kind.hint))
+		}
+	}
+	if len(keys) > 0 {
+		if cacheErr := s.cache.DeleteMulti(ctx, keys); err == nil {
+			err = cacheErr
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,91 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/RichardKnop/go-oauth2-server/log"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+)
+
+// SecretHasher hashes and verifies client secrets. Implementations must
+// compare secrets in constant time.
+type SecretHasher interface {
+	// Hash returns a hash of the secret to be stored
+	Hash(secret string) (string, error)
+	// Verify returns nil if the secret matches the hash, password.ErrMismatch
+	// if it does not and password.ErrUnsupportedHash if the hash was produced
+	// by another algorithm
+	Verify(hash, secret string) error
+	// NeedsRehash returns true if the hash was produced by another algorithm
+	// or with outdated parameters
+	NeedsRehash(hash string) bool
+}
+
+// knownSecretHashers verify hashes the configured hasher does not support,
+// so secrets keep working while stored hashes migrate to another algorithm
+var knownSecretHashers = []SecretHasher{
+	pass.NewBcryptHasher(),
+	pass.NewArgon2idHasher(),
+}
+
+// secretVerifier verifies client secrets and upgrades outdated hashes
+type secretVerifier struct {
+	hasher SecretHasher
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+func newSecretVerifier(hasher SecretHasher) *secretVerifier {
+	if hasher == nil {
+		hasher = pass.NewBcryptHasher()
+	}
+	return &secretVerifier{hasher: hasher}
+}
+
+// verify returns true if the secret matches the client's stored hash
+func (v *secretVerifier) verify(client *models.OauthClient, secret string) bool {
+	err := v.hasher.Verify(client.Secret, secret)
+	for _, hasher := range knownSecretHashers {
+		if !errors.Is(err, pass.ErrUnsupportedHash) {
+			break
+		}
+		err = hasher.Verify(client.Secret, secret)
+	}
+	return err == nil
+}
+
+// burn spends as much time as verifying a real secret, so unknown clients
+// cannot be told apart from wrong secrets by timing
+func (v *secretVerifier) burn(secret string) {
+	v.dummyOnce.Do(func() {
+		v.dummyHash, _ = v.hasher.Hash("dummy secret")
+	})
+	v.hasher.Verify(v.dummyHash, secret)
+}
+
+// verifyClientSecret checks the secret and transparently rehashes it with
+// the configured hasher when the stored hash is outdated
+func (s *SDK) verifyClientSecret(ctx context.Context, client *models.OauthClient, secret string) bool {
+	if !s.secretVerifier.verify(client, secret) {
+		return false
+	}
+
+	if s.secretVerifier.hasher.NeedsRehash(client.Secret) {
+		// Best effort, the old hash keeps working if the update fails
+		hash, err := s.secretVerifier.hasher.Hash(secret)
+		if err == nil {
+			updated := *client
+			updated.Secret = hash
+			err = s.storage.UpdateClient(ctx, &updated)
+		}
+		if err != nil {
+			log.ERROR.Printf("Failed to rehash secret of client %s: %s", client.Key, err)
+		}
+	}
+
+	return true
+}
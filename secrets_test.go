@@ -0,0 +1,43 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSecretRehash(t *testing.T) {
+	hasher := &pass.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	sdk, _ := newTestSDKFromBuilder(t, New().WithSecretHasher(hasher))
+	ctx := context.Background()
+
+	// A wrong secret leaves the bcrypt hash alone
+	_, err := sdk.GrantClientCredentialsToken(ctx, "test_client_1", "bogus", "")
+	assert.True(t, errors.Is(err, ErrInvalidClientIDOrSecret))
+	client, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(client.Secret, "$2a$"))
+
+	// The bcrypt hash created by the oauth service is accepted and upgraded
+	_, err = sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	client, err = sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(client.Secret, "$argon2id$"))
+	assert.False(t, hasher.NeedsRehash(client.Secret))
+
+	// The new hash keeps working and is not rehashed again
+	_, err = sdk.GrantClientCredentialsToken(ctx, "test_client_1", "test_secret", "")
+	require.NoError(t, err)
+	rehashed, err := sdk.storage.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.Equal(t, client.Secret, rehashed.Secret)
+
+	_, err = sdk.GrantClientCredentialsToken(ctx, "test_client_1", "bogus", "")
+	assert.True(t, errors.Is(err, ErrInvalidClientIDOrSecret))
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"golang.org/x/sync/singleflight"
+)
+
+// CachedStorageConfig defines how long CachedStorage keeps each entity
+type CachedStorageConfig struct {
+	ClientTTL time.Duration `json:"client_ttl"`
+	UserTTL   time.Duration `json:"user_ttl"`
+	ScopeTTL  time.Duration `json:"scope_ttl"`
+
+	// Access tokens are never cached past their expiry
+	TokenTTL time.Duration `json:"token_ttl"`
+
+	// How long a lookup that found nothing is remembered
+	NegativeTTL time.Duration `json:"negative_ttl"`
+}
+
+// DefaultCachedStorageConfig returns the TTLs used when none are configured
+func DefaultCachedStorageConfig() *CachedStorageConfig {
+	return &CachedStorageConfig{
+		ClientTTL:   5 * time.Minute,
+		UserTTL:     5 * time.Minute,
+		ScopeTTL:    30 * time.Minute,
+		TokenTTL:    5 * time.Minute,
+		NegativeTTL: 30 * time.Second,
+	}
+}
+
+// CachedStorage wraps a storage backend with a read-through cache for
+// clients, users, scopes and access tokens. Lookups that find nothing are
+// cached as well, and concurrent misses for the same key share a single
+// backend call. Writes and deletes made through the wrapper drop the cached
+// entries they affect, changes made around it are only seen once the
+// entries expire.
+type CachedStorage struct {
+	Storage
+	cache   CacheProvider
+	config  *CachedStorageConfig
+	metrics MetricsProvider
+	group   singleflight.Group
+
+	// Incremented by every invalidation, a value loaded while it changed
+	// may already be stale and is not cached
+	generation atomic.Uint64
+
+	// Set on the wrapper of a running transaction, which bypasses the cache
+	// and collects the keys to drop once the transaction is over
+	txKeys *[]string
+}
+
+// cachedEntry is what is stored in the cache, Missing marks a negative entry
+type cachedEntry struct {
+	Missing bool            `json:"missing,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+// NewCachedStorage wraps s with cache, a nil config uses the default TTLs
+func NewCachedStorage(s Storage, cache CacheProvider, config *CachedStorageConfig) *CachedStorage {
+	if config == nil {
+		config = DefaultCachedStorageConfig()
+	}
+	return &CachedStorage{Storage: s, cache: cache, config: config, metrics: NewNoOpMetrics()}
+}
+
+// SetMetrics sets the provider cache hits and misses are reported to
+func (c *CachedStorage) SetMetrics(metrics MetricsProvider) {
+	c.metrics = metrics
+}
+
+// GetClient retrieves a client through the cache
+func (c *CachedStorage) GetClient(ctx context.Context, clientID string) (*models.OauthClient, error) {
+	client := new(models.OauthClient)
+	err := c.get(ctx, "get_client", clientCacheKey(clientID), client, ErrClientNotFound, func() (interface{}, time.Duration, error) {
+		client, err := c.Storage.GetClient(ctx, clientID)
+		return client, c.config.ClientTTL, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// CreateClient creates a client and drops a cached miss for its key
+func (c *CachedStorage) CreateClient(ctx context.Context, client *models.OauthClient) error {
+	if err := c.Storage.CreateClient(ctx, client); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, clientCacheKey(client.Key))
+}
+
+// UpdateClient updates a client and drops its cached copy
+func (c *CachedStorage) UpdateClient(ctx context.Context, client *models.OauthClient) error {
+	if err := c.Storage.UpdateClient(ctx, client); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, clientCacheKey(client.Key))
+}
+
+// DeleteClient deletes a client and drops its cached copy
+func (c *CachedStorage) DeleteClient(ctx context.Context, clientID string) error {
+	if err := c.Storage.DeleteClient(ctx, clientID); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, clientCacheKey(clientID))
+}
+
+// GetUser retrieves a user through the cache
+func (c *CachedStorage) GetUser(ctx context.Context, username string) (*models.OauthUser, error) {
+	user := new(models.OauthUser)
+	err := c.get(ctx, "get_user", userCacheKey(username), user, ErrUserNotFound, func() (interface{}, time.Duration, error) {
+		user, err := c.Storage.GetUser(ctx, username)
+		return user, c.config.UserTTL, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateUser creates a user and drops a cached miss for its username
+func (c *CachedStorage) CreateUser(ctx context.Context, user *models.OauthUser) error {
+	if err := c.Storage.CreateUser(ctx, user); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, userCacheKey(user.Username))
+}
+
+// StoreAccessToken stores an access token and drops a cached miss for it
+func (c *CachedStorage) StoreAccessToken(ctx context.Context, token *models.OauthAccessToken) error {
+	if err := c.Storage.StoreAccessToken(ctx, token); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, accessTokenCacheKey(token.Token))
+}
+
+// GetAccessToken retrieves an access token through the cache
+func (c *CachedStorage) GetAccessToken(ctx context.Context, tokenStr string) (*models.OauthAccessToken, error) {
+	token := new(models.OauthAccessToken)
+	err := c.get(ctx, "get_access_token", accessTokenCacheKey(tokenStr), token, ErrTokenNotFound, func() (interface{}, time.Duration, error) {
+		token, err := c.Storage.GetAccessToken(ctx, tokenStr)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl := c.config.TokenTTL
+		if untilExpiry := time.Until(token.ExpiresAt); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+		return token, ttl, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The cached copy may have expired since it was stored
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+	return token, nil
+}
+
+// DeleteAccessToken deletes an access token and drops its cached copy
+func (c *CachedStorage) DeleteAccessToken(ctx context.Context, tokenStr string) error {
+	if err := c.Storage.DeleteAccessToken(ctx, tokenStr); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, accessTokenCacheKey(tokenStr))
+}
+
+// BatchDeleteTokens deletes access tokens and drops their cached copies
+func (c *CachedStorage) BatchDeleteTokens(ctx context.Context, tokens []string) error {
+	if err := c.Storage.BatchDeleteTokens(ctx, tokens); err != nil {
+		return err
+	}
+	keys := make([]string, len(tokens))
+	for i, token := range tokens {
+		keys[i] = accessTokenCacheKey(token)
+	}
+	return c.invalidate(ctx, keys...)
+}
+
+// RevokeUserTokens revokes a user's tokens and drops their cached copies
+func (c *CachedStorage) RevokeUserTokens(ctx context.Context, userID string) (*RevokeResult, error) {
+	result, err := c.Storage.RevokeUserTokens(ctx, userID)
+	return c.revoked(ctx, result, err)
+}
+
+// RevokeClientTokens revokes a client's tokens and drops their cached copies
+func (c *CachedStorage) RevokeClientTokens(ctx context.Context, clientID string) (*RevokeResult, error) {
+	result, err := c.Storage.RevokeClientTokens(ctx, clientID)
+	return c.revoked(ctx, result, err)
+}
+
+// RevokeTokensWithScope revokes the tokens granted scope and drops their
+// cached copies
+func (c *CachedStorage) RevokeTokensWithScope(ctx context.Context, scope string) (*RevokeResult, error) {
+	result, err := c.Storage.RevokeTokensWithScope(ctx, scope)
+	return c.revoked(ctx, result, err)
+}
+
+// revoked drops the cached copies of the access tokens a revocation
+// deleted, also when it failed part way
+func (c *CachedStorage) revoked(ctx context.Context, result *RevokeResult, err error) (*RevokeResult, error) {
+	if result == nil || len(result.Tokens) == 0 {
+		return result, err
+	}
+	keys := make([]string, len(result.Tokens))
+	for i, token := range result.Tokens {
+		keys[i] = accessTokenCacheKey(token)
+	}
+	if invalidateErr := c.invalidate(ctx, keys...); err == nil {
+		err = invalidateErr
+	}
+	return result, err
+}
+
+// GetScope retrieves a scope through the cache
+func (c *CachedStorage) GetScope(ctx context.Context, scope string) (*models.OauthScope, error) {
+	oauthScope := new(models.OauthScope)
+	err := c.get(ctx, "get_scope", scopeCacheKey(scope), oauthScope, ErrScopeNotFound, func() (interface{}, time.Duration, error) {
+		oauthScope, err := c.Storage.GetScope(ctx, scope)
+		return oauthScope, c.config.ScopeTTL, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oauthScope, nil
+}
+
+// CleanupExpiredTokensBatch passes batched cleanup through to the backend,
+// cached tokens never outlive their expiry so there is nothing to drop
+func (c *CachedStorage) CleanupExpiredTokensBatch(ctx context.Context, ids IDRange, limit int) (int, error) {
+	return CleanupExpiredTokensBatch(ctx, c.Storage, ids, limit)
+}
+
+// WithTx runs fn in a transaction of the wrapped storage. Reads inside it
+// skip the cache, the entries it wrote are dropped once it is over whether
+// it committed or not.
+func (c *CachedStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	if c.txKeys != nil {
+		return fn(c)
+	}
+
+	var keys []string
+	err := c.Storage.WithTx(ctx, func(tx Storage) error {
+		return fn(&CachedStorage{Storage: tx, cache: c.cache, config: c.config, metrics: c.metrics, txKeys: &keys})
+	})
+	if len(keys) == 0 {
+		return err
+	}
+	if invalidateErr := c.invalidate(ctx, keys...); err == nil {
+		err = invalidateErr
+	}
+	return err
+}
+
+// get decodes the entry cached under key into dest. On a miss load is called
+// once for all concurrent callers, its result is cached for the TTL it
+// returns and notFound is cached for the negative TTL.
+func (c *CachedStorage) get(ctx context.Context, operation, key string, dest interface{}, notFound error, load func() (interface{}, time.Duration, error)) error {
+	// A transaction reads its own writes, which the cache does not hold
+	if c.txKeys != nil {
+		value, _, err := load()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal cached value: %w", err)
+		}
+		return json.Unmarshal(data, dest)
+	}
+
+	start := time.Now()
+	entry := new(cachedEntry)
+	if err := c.cache.Get(ctx, key, entry); err == nil {
+		if entry.Missing {
+			c.metrics.RecordCacheOperation(operation, true, time.Since(start))
+			return notFound
+		}
+		if err := json.Unmarshal(entry.Value, dest); err == nil {
+			c.metrics.RecordCacheOperation(operation, true, time.Since(start))
+			return nil
+		}
+	}
+	c.metrics.RecordCacheOperation(operation, false, time.Since(start))
+
+	// Every caller decodes its own copy of the shared result
+	shared, err, _ := c.group.Do(key, func() (interface{}, error) {
+		generation := c.generation.Load()
+		value, ttl, err := load()
+		if err != nil && !errors.Is(err, notFound) {
+			return nil, err
+		}
+		// Skip caching when something was invalidated during the load
+		fresh := c.generation.Load() == generation
+		if err != nil {
+			if fresh {
+				c.cache.Set(ctx, key, &cachedEntry{Missing: true}, c.config.NegativeTTL)
+			}
+			return nil, err
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal cached value: %w", err)
+		}
+		if fresh && ttl > 0 {
+			c.cache.Set(ctx, key, &cachedEntry{Value: data}, ttl)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(shared.([]byte), dest)
+}
+
+func (c *CachedStorage) invalidate(ctx context.Context, keys ...string) error {
+	if c.txKeys != nil {
+		*c.txKeys = append(*c.txKeys, keys...)
+		return nil
+	}
+	c.generation.Add(1)
+	if err := c.cache.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("failed to invalidate cache: %w", err)
+	}
+	return nil
+}
+
+// Client keys and usernames are case insensitive, so are their cache keys
+func clientCacheKey(clientID string) string {
+	return "storage:client:" + strings.ToLower(clientID)
+}
+
+func userCacheKey(username string) string {
+	return "storage:user:" + strings.ToLower(username)
+}
+
+func scopeCacheKey(scope string) string {
+	return "storage:scope:" + scope
+}
+
+func accessTokenCacheKey(token string) string {
+	return "storage:access_token:" + token
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage counts the lookups that reach the backend, GetClient
+// blocks until release is closed when it is set
+type countingStorage struct {
+	Storage
+	clients int32
+	tokens  int32
+	release chan struct{}
+}
+
+func (s *countingStorage) GetClient(ctx context.Context, clientID string) (*models.OauthClient, error) {
+	atomic.AddInt32(&s.clients, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	return s.Storage.GetClient(ctx, clientID)
+}
+
+func (s *countingStorage) GetAccessToken(ctx context.Context, tokenStr string) (*models.OauthAccessToken, error) {
+	atomic.AddInt32(&s.tokens, 1)
+	return s.Storage.GetAccessToken(ctx, tokenStr)
+}
+
+func newTestCachedStorage(t *testing.T) (*CachedStorage, *countingStorage) {
+	cache, err := NewMemoryCache(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { cache.Close() })
+	backend := &countingStorage{Storage: NewMemoryStorage()}
+	return NewCachedStorage(backend, cache, nil), backend
+}
+
+func TestCachedStorageClients(t *testing.T) {
+	ctx := context.Background()
+	cached, backend := newTestCachedStorage(t)
+
+	// Misses are cached too
+	for i := 0; i < 2; i++ {
+		_, err := cached.GetClient(ctx, "test_client_1")
+		assert.Equal(t, ErrClientNotFound, err)
+	}
+	assert.Equal(t, int32(1), backend.clients)
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1", Secret: "secret"}
+	require.NoError(t, cached.CreateClient(ctx, client))
+	for i := 0; i < 2; i++ {
+		found, err := cached.GetClient(ctx, "test_client_1")
+		require.NoError(t, err)
+		assert.Equal(t, "secret", found.Secret)
+	}
+	assert.Equal(t, int32(2), backend.clients)
+
+	// Callers get their own copy
+	found, err := cached.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	found.Secret = "changed"
+	found, err = cached.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", found.Secret)
+
+	updated := *client
+	updated.Secret = "new_secret"
+	require.NoError(t, cached.UpdateClient(ctx, &updated))
+	found, err = cached.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.Equal(t, "new_secret", found.Secret)
+	assert.Equal(t, int32(3), backend.clients)
+
+	require.NoError(t, cached.DeleteClient(ctx, "test_client_1"))
+	_, err = cached.GetClient(ctx, "test_client_1")
+	assert.Equal(t, ErrClientNotFound, err)
+}
+
+func TestCachedStorageCoalescesMisses(t *testing.T) {
+	ctx := context.Background()
+	cached, backend := newTestCachedStorage(t)
+	require.NoError(t, cached.CreateClient(ctx, &models.OauthClient{Key: "test_client_1"}))
+	backend.release = make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := cached.GetClient(ctx, "test_client_1")
+			assert.NoError(t, err)
+			assert.Equal(t, "test_client_1", client.Key)
+		}()
+	}
+
+	// Let the callers pile up behind the first one before releasing it
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), backend.clients)
+}
+
+func TestCachedStorageAccessTokens(t *testing.T) {
+	ctx := context.Background()
+	cached, backend := newTestCachedStorage(t)
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	accessToken := models.NewOauthAccessToken(client, nil, 60, "read")
+
+	_, err := cached.GetAccessToken(ctx, accessToken.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Storing a token drops the cached miss
+	require.NoError(t, cached.StoreAccessToken(ctx, accessToken))
+	for i := 0; i < 2; i++ {
+		found, err := cached.GetAccessToken(ctx, accessToken.Token)
+		require.NoError(t, err)
+		assert.Equal(t, "read", found.Scope)
+	}
+	assert.Equal(t, int32(2), backend.tokens)
+
+	// Revoked tokens stop working at once
+	require.NoError(t, cached.DeleteAccessToken(ctx, accessToken.Token))
+	_, err = cached.GetAccessToken(ctx, accessToken.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	other := models.NewOauthAccessToken(client, nil, 60, "read")
+	require.NoError(t, cached.StoreAccessToken(ctx, other))
+	_, err = cached.GetAccessToken(ctx, other.Token)
+	require.NoError(t, err)
+	require.NoError(t, cached.BatchDeleteTokens(ctx, []string{other.Token}))
+	_, err = cached.GetAccessToken(ctx, other.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Tokens are never cached past their expiry
+	expiring := models.NewOauthAccessToken(client, nil, 1, "read")
+	require.NoError(t, cached.StoreAccessToken(ctx, expiring))
+	_, err = cached.GetAccessToken(ctx, expiring.Token)
+	require.NoError(t, err)
+	time.Sleep(time.Until(expiring.ExpiresAt) + 10*time.Millisecond)
+	_, err = cached.GetAccessToken(ctx, expiring.Token)
+	assert.Equal(t, ErrTokenExpired, err)
+}
@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+)
+
+const (
+	// DefaultFailureThreshold is the number of consecutive failures that
+	// opens the circuit
+	DefaultFailureThreshold = 5
+
+	// DefaultRecoveryTimeout is how long an open circuit rejects calls
+	// before letting trial calls through
+	DefaultRecoveryTimeout = 30 * time.Second
+
+	// DefaultHalfOpenRequests is the number of trial calls let through by a
+	// half-open circuit
+	DefaultHalfOpenRequests = 1
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets every call through
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen lets a few trial calls through
+	CircuitHalfOpen
+	// CircuitOpen rejects every call with ErrCircuitOpen
+	CircuitOpen
+)
+
+// String returns the name of the state
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitStateRecorder is implemented by metrics providers that can report
+// the state of a circuit breaker
+type CircuitStateRecorder interface {
+	RecordCircuitBreakerState(state CircuitState)
+}
+
+// UnavailableClassifier is implemented by backends that recognise the
+// errors their driver returns when the database is unreachable, overloaded
+// or timing out
+type UnavailableClassifier interface {
+	IsUnavailable(err error) bool
+}
+
+// CircuitBreakerStorage wraps a storage backend with a circuit breaker.
+// After FailureThreshold consecutive failures the circuit opens and calls
+// fail at once with ErrCircuitOpen instead of waiting on a struggling
+// backend. Once RecoveryTimeout has passed up to MaxRequests trial calls are
+// let through, the circuit closes when they all succeed and opens again on
+// the first failure. Only connection, driver and timeout errors are
+// failures, plus whatever the backend reports through UnavailableClassifier,
+// errors about the data such as lookups that find nothing or duplicate keys
+// are not.
+type CircuitBreakerStorage struct {
+	Storage
+	threshold   int
+	timeout     time.Duration
+	maxRequests int
+	metrics     MetricsProvider
+	unavailable func(err error) bool // the backend's UnavailableClassifier, if any
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int       // consecutive failures while closed
+	requests  int       // trial calls let through while half-open
+	successes int       // trial calls that succeeded while half-open
+	openedAt  time.Time // when the circuit last opened
+
+	// Incremented on every state change, so calls started in an earlier
+	// state do not count towards the current one
+	generation uint64
+
+	// Set on the storage handed to a transaction, its calls are let through
+	// and only report whether one of them failed, the transaction as a whole
+	// is counted once it is over
+	txFailed *bool
+}
+
+// NewCircuitBreakerStorage wraps s with a circuit breaker, settings left at
+// zero use the defaults
+func NewCircuitBreakerStorage(s Storage, config *CircuitBreakerConfig) *CircuitBreakerStorage {
+	c := &CircuitBreakerStorage{
+		Storage:     s,
+		threshold:   DefaultFailureThreshold,
+		timeout:     DefaultRecoveryTimeout,
+		maxRequests: DefaultHalfOpenRequests,
+		metrics:     NewNoOpMetrics(),
+	}
+	if classifier, ok := s.(UnavailableClassifier); ok {
+		c.unavailable = classifier.IsUnavailable
+	}
+	if config != nil {
+		if config.FailureThreshold > 0 {
+			c.threshold = config.FailureThreshold
+		}
+		if config.RecoveryTimeout > 0 {
+			c.timeout = config.RecoveryTimeout
+		}
+		if config.MaxRequests > 0 {
+			c.maxRequests = config.MaxRequests
+		}
+	}
+	return c
+}
+
+// SetMetrics sets the provider state changes are reported to, it must
+// implement CircuitStateRecorder for them to be reported
+func (c *CircuitBreakerStorage) SetMetrics(metrics MetricsProvider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = metrics
+	c.recordState()
+}
+
+// State returns the current state of the circuit
+func (c *CircuitBreakerStorage) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentState(time.Now())
+}
+
+// GetClient retrieves a client unless the circuit is open
+func (c *CircuitBreakerStorage) GetClient(ctx context.Context, clientID string) (client *models.OauthClient, err error) {
+	err = c.do(func() error {
+		client, err = c.Storage.GetClient(ctx, clientID)
+		return err
+	})
+	return client, err
+}
+
+// CreateClient creates a client unless the circuit is open
+func (c *CircuitBreakerStorage) CreateClient(ctx context.Context, client *models.OauthClient) error {
+	return c.do(func() error { return c.Storage.CreateClient(ctx, client) })
+}
+
+// UpdateClient updates a client unless the circuit is open
+func (c *CircuitBreakerStorage) UpdateClient(ctx context.Context, client *models.OauthClient) error {
+	return c.do(func() error { return c.Storage.UpdateClient(ctx, client) })
+}
+
+// DeleteClient deletes a client unless the circuit is open
+func (c *CircuitBreakerStorage) DeleteClient(ctx context.Context, clientID string) error {
+	return c.do(func() error { return c.Storage.DeleteClient(ctx, clientID) })
+}
+
+// GetUser retrieves a user by username unless the circuit is open
+func (c *CircuitBreakerStorage) GetUser(ctx context.Context, username string) (user *models.OauthUser, err error) {
+	err = c.do(func() error {
+		user, err = c.Storage.GetUser(ctx, username)
+		return err
+	})
+	return user, err
+}
+
+// GetUserByID retrieves a user by ID unless the circuit is open
+func (c *CircuitBreakerStorage) GetUserByID(ctx context.Context, userID string) (user *models.OauthUser, err error) {
+	err = c.do(func() error {
+		user, err = c.Storage.GetUserByID(ctx, userID)
+		return err
+	})
+	return user, err
+}
+
+// CreateUser creates a user unless the circuit is open
+func (c *CircuitBreakerStorage) CreateUser(ctx context.Context, user *models.OauthUser) error {
+	return c.do(func() error { return c.Storage.CreateUser(ctx, user) })
+}
+
+// AuthenticateUser checks a user's credentials unless the circuit is open,
+// wrong credentials are not failures
+func (c *CircuitBreakerStorage) AuthenticateUser(ctx context.Context, username, password string) (user *models.OauthUser, err error) {
+	err = c.do(func() error {
+		user, err = c.Storage.AuthenticateUser(ctx, username, password)
+		return err
+	})
+	return user, err
+}
+
+// StoreAccessToken stores an access token unless the circuit is open
+func (c *CircuitBreakerStorage) StoreAccessToken(ctx context.Context, token *models.OauthAccessToken) error {
+	return c.do(func() error { return c.Storage.StoreAccessToken(ctx, token) })
+}
+
+// GetAccessToken retrieves an access token unless the circuit is open
+func (c *CircuitBreakerStorage) GetAccessToken(ctx context.Context, tokenStr string) (token *models.OauthAccessToken, err error) {
+	err = c.do(func() error {
+		token, err = c.Storage.GetAccessToken(ctx, tokenStr)
+		return err
+	})
+	return token, err
+}
+
+// DeleteAccessToken deletes an access token unless the circuit is open
+func (c *CircuitBreakerStorage) DeleteAccessToken(ctx context.Context, tokenStr string) error {
+	return c.do(func() error { return c.Storage.DeleteAccessToken(ctx, tokenStr) })
+}
+
+// CleanupExpiredTokens removes expired tokens unless the circuit is open
+func (c *CircuitBreakerStorage) CleanupExpiredTokens(ctx context.Context) error {
+	return c.do(func() error { return c.Storage.CleanupExpiredTokens(ctx) })
+}
+
+// CleanupExpiredTokensBatch passes batched cleanup through to the backend
+func (c *CircuitBreakerStorage) CleanupExpiredTokensBatch(ctx context.Context, ids IDRange, limit int) (removed int, err error) {
+	err = c.do(func() error {
+		removed, err = CleanupExpiredTokensBatch(ctx, c.Storage, ids, limit)
+		return err
+	})
+	return removed, err
+}
+
+// StoreRefreshToken stores a refresh token unless the circuit is open
+func (c *CircuitBreakerStorage) StoreRefreshToken(ctx context.Context, token *models.OauthRefreshToken) error {
+	return c.do(func() error { return c.Storage.StoreRefreshToken(ctx, token) })
+}
+
+// GetRefreshToken retrieves a refresh token unless the circuit is open
+func (c *CircuitBreakerStorage) GetRefreshToken(ctx context.Context, tokenStr string) (token *models.OauthRefreshToken, err error) {
+	err = c.do(func() error {
+		token, err = c.Storage.GetRefreshToken(ctx, tokenStr)
+		return err
+	})
+	return token, err
+}
+
+// DeleteRefreshToken deletes a refresh token unless the circuit is open
+func (c *CircuitBreakerStorage) DeleteRefreshToken(ctx context.Context, tokenStr string) error {
+	return c.do(func() error { return c.Storage.DeleteRefreshToken(ctx, tokenStr) })
+}
+
+// StoreAuthorizationCode stores an authorization code unless the circuit
+// is open
+func (c *CircuitBreakerStorage) StoreAuthorizationCode(ctx context.Context, code *models.OauthAuthorizationCode) error {
+	return c.do(func() error { return c.Storage.StoreAuthorizationCode(ctx, code) })
+}
+
+// GetAuthorizationCode retrieves an authorization code unless the circuit
+// is open
+func (c *CircuitBreakerStorage) GetAuthorizationCode(ctx context.Context, codeStr string) (code *models.OauthAuthorizationCode, err error) {
+	err = c.do(func() error {
+		code, err = c.Storage.GetAuthorizationCode(ctx, codeStr)
+		return err
+	})
+	return code, err
+}
+
+// DeleteAuthorizationCode deletes an authorization code unless the
+// circuit is open
+func (c *CircuitBreakerStorage) DeleteAuthorizationCode(ctx context.Context, codeStr string) error {
+	return c.do(func() error { return c.Storage.DeleteAuthorizationCode(ctx, codeStr) })
+}
+
+// GetScope retrieves a scope unless the circuit is open
+func (c *CircuitBreakerStorage) GetScope(ctx context.Context, scope string) (oauthScope *models.OauthScope, err error) {
+	err = c.do(func() error {
+		oauthScope, err = c.Storage.GetScope(ctx, scope)
+		return err
+	})
+	return oauthScope, err
+}
+
+// GetDefaultScope returns the default scope unless the circuit is open
+func (c *CircuitBreakerStorage) GetDefaultScope(ctx context.Context) (scope string, err error) {
+	err = c.do(func() error {
+		scope, err = c.Storage.GetDefaultScope(ctx)
+		return err
+	})
+	return scope, err
+}
+
+// ListClients lists a page of clients unless the circuit is open
+func (c *CircuitBreakerStorage) ListClients(ctx context.Context, options ListOptions) (page *ClientPage, err error) {
+	err = c.do(func() error {
+		page, err = c.Storage.ListClients(ctx, options)
+		return err
+	})
+	return page, err
+}
+
+// ListUsers lists a page of users unless the circuit is open
+func (c *CircuitBreakerStorage) ListUsers(ctx context.Context, options ListOptions) (page *UserPage, err error) {
+	err = c.do(func() error {
+		page, err = c.Storage.ListUsers(ctx, options)
+		return err
+	})
+	return page, err
+}
+
+// ListScopes lists a page of scopes unless the circuit is open
+func (c *CircuitBreakerStorage) ListScopes(ctx context.Context, options ListOptions) (page *ScopePage, err error) {
+	err = c.do(func() error {
+		page, err = c.Storage.ListScopes(ctx, options)
+		return err
+	})
+	return page, err
+}
+
+// ListTokens lists a page of tokens unless the circuit is open
+func (c *CircuitBreakerStorage) ListTokens(ctx context.Context, filter TokenFilter, options ListOptions) (page *TokenPage, err error) {
+	err = c.do(func() error {
+		page, err = c.Storage.ListTokens(ctx, filter, options)
+		return err
+	})
+	return page, err
+}
+
+// CountActiveTokens counts unexpired access tokens unless the circuit is
+// open
+func (c *CircuitBreakerStorage) CountActiveTokens(ctx context.Context) (count int, err error) {
+	err = c.do(func() error {
+		count, err = c.Storage.CountActiveTokens(ctx)
+		return err
+	})
+	return count, err
+}
+
+// RevokeUserTokens revokes a user's tokens unless the circuit is open
+func (c *CircuitBreakerStorage) RevokeUserTokens(ctx context.Context, userID string) (result *RevokeResult, err error) {
+	err = c.do(func() error {
+		result, err = c.Storage.RevokeUserTokens(ctx, userID)
+		return err
+	})
+	return result, err
+}
+
+// RevokeClientTokens revokes a client's tokens unless the circuit is open
+func (c *CircuitBreakerStorage) RevokeClientTokens(ctx context.Context, clientID string) (result *RevokeResult, err error) {
+	err = c.do(func() error {
+		result, err = c.Storage.RevokeClientTokens(ctx, clientID)
+		return err
+	})
+	return result, err
+}
+
+// RevokeTokensWithScope revokes the tokens granted scope unless the
+// circuit is open
+func (c *CircuitBreakerStorage) RevokeTokensWithScope(ctx context.Context, scope string) (result *RevokeResult, err error) {
+	err = c.do(func() error {
+		result, err = c.Storage.RevokeTokensWithScope(ctx, scope)
+		return err
+	})
+	return result, err
+}
+
+// WithTx runs the whole transaction, retries included, as a single call.
+// It fails when beginning or committing the transaction fails or when a
+// storage call made by fn does, other errors fn returns are not failures.
+func (c *CircuitBreakerStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	if c.txFailed != nil {
+		return c.Storage.WithTx(ctx, c.observed(c.txFailed, fn))
+	}
+
+	generation, err := c.before()
+	if err != nil {
+		return err
+	}
+	var (
+		failed   bool
+		fnCalled bool
+		fnErr    error
+	)
+	defer func() { c.after(generation, failed) }()
+
+	err = c.Storage.WithTx(ctx, func(tx Storage) error {
+		// Only the last attempt counts, retries are up to the backend
+		failed, fnCalled = false, true
+		fnErr = c.observed(&failed, fn)(tx)
+		return fnErr
+	})
+	// Errors fn returned are rolled back and returned as they are, any other
+	// error comes from beginning or committing the transaction
+	if !fnCalled || fnErr == nil {
+		failed = c.isFailure(err)
+	}
+	return err
+}
+
+// observed runs fn on a storage that records in failed whether any of its
+// calls failed
+func (c *CircuitBreakerStorage) observed(failed *bool, fn func(tx Storage) error) func(tx Storage) error {
+	return func(tx Storage) error {
+		return fn(&CircuitBreakerStorage{Storage: tx, metrics: c.metrics, unavailable: c.unavailable, txFailed: failed})
+	}
+}
+
+// BatchGetTokens retrieves access tokens unless the circuit is open
+func (c *CircuitBreakerStorage) BatchGetTokens(ctx context.Context, tokens []string) (found []*models.OauthAccessToken, err error) {
+	err = c.do(func() error {
+		found, err = c.Storage.BatchGetTokens(ctx, tokens)
+		return err
+	})
+	return found, err
+}
+
+// BatchDeleteTokens deletes access tokens unless the circuit is open
+func (c *CircuitBreakerStorage) BatchDeleteTokens(ctx context.Context, tokens []string) error {
+	return c.do(func() error { return c.Storage.BatchDeleteTokens(ctx, tokens) })
+}
+
+// HealthCheck reports an open circuit without touching the backend,
+// otherwise it checks the backend like any other call
+func (c *CircuitBreakerStorage) HealthCheck(ctx context.Context) error {
+	c.mu.Lock()
+	state, openedAt := c.currentState(time.Now()), c.openedAt
+	c.mu.Unlock()
+	if state == CircuitOpen {
+		return fmt.Errorf("%w since %s", ErrCircuitOpen, openedAt.Format(time.RFC3339))
+	}
+	return c.do(func() error { return c.Storage.HealthCheck(ctx) })
+}
+
+// do runs call unless the circuit is open and counts its outcome, a call
+// that panics counts as failed
+func (c *CircuitBreakerStorage) do(call func() error) (err error) {
+	if c.txFailed != nil {
+		if err = call(); c.isFailure(err) {
+			*c.txFailed = true
+		}
+		return err
+	}
+
+	generation, err := c.before()
+	if err != nil {
+		return err
+	}
+	failed := true
+	defer func() { c.after(generation, failed) }()
+
+	err = call()
+	failed = c.isFailure(err)
+	return err
+}
+
+func (c *CircuitBreakerStorage) before() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.currentState(time.Now()) {
+	case CircuitOpen:
+		return 0, ErrCircuitOpen
+	case CircuitHalfOpen:
+		if c.requests >= c.maxRequests {
+			return 0, ErrCircuitOpen
+		}
+		c.requests++
+	}
+	return c.generation, nil
+}
+
+func (c *CircuitBreakerStorage) after(generation uint64, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	state := c.currentState(now)
+	if generation != c.generation {
+		return
+	}
+
+	switch {
+	case state == CircuitClosed && failed:
+		c.failures++
+		if c.failures >= c.threshold {
+			c.setState(CircuitOpen, now)
+		}
+	case state == CircuitClosed:
+		c.failures = 0
+	case state == CircuitHalfOpen && failed:
+		c.setState(CircuitOpen, now)
+	case state == CircuitHalfOpen:
+		c.successes++
+		if c.successes >= c.maxRequests {
+			c.setState(CircuitClosed, now)
+		}
+	}
+}
+
+// currentState moves an open circuit to half-open once the recovery timeout
+// has passed, the caller must hold the lock
+func (c *CircuitBreakerStorage) currentState(now time.Time) CircuitState {
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= c.timeout {
+		c.setState(CircuitHalfOpen, now)
+	}
+	return c.state
+}
+
+// setState starts a new generation in state, the caller must hold the lock
+func (c *CircuitBreakerStorage) setState(state CircuitState, now time.Time) {
+	c.state = state
+	c.generation++
+	c.failures, c.requests, c.successes = 0, 0, 0
+	if state == CircuitOpen {
+		c.openedAt = now
+	}
+	c.recordState()
+}
+
+func (c *CircuitBreakerStorage) recordState() {
+	if recorder, ok := c.metrics.(CircuitStateRecorder); ok {
+		recorder.RecordCircuitBreakerState(c.state)
+	}
+}
+
+// isFailure tells whether err means the backend is in trouble, only
+// connection, driver and timeout errors do. Errors about the data asked for,
+// constraint violations and calls cancelled by the caller do not.
+func (c *CircuitBreakerStorage) isFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	for _, target := range []error{
+		context.DeadlineExceeded,
+		driver.ErrBadConn,
+		sql.ErrConnDone,
+		io.EOF,
+		io.ErrUnexpectedEOF,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return c.unavailable != nil && c.unavailable(err)
+}
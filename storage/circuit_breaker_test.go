@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errBackendDown  error = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	errDuplicateKey       = errors.New("duplicate key value violates unique constraint")
+)
+
+// flakyStorage fails every call that reaches it while down is set
+type flakyStorage struct {
+	Storage
+	down  atomic.Bool
+	calls int32
+}
+
+func (s *flakyStorage) GetDefaultScope(ctx context.Context) (string, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.down.Load() {
+		return "", errBackendDown
+	}
+	return s.Storage.GetDefaultScope(ctx)
+}
+
+// WithTx runs fn on the flaky storage itself, so its calls fail while down
+func (s *flakyStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	return fn(s)
+}
+
+// CreateClient always fails on a constraint, whether or not the backend is up
+func (s *flakyStorage) CreateClient(ctx context.Context, client *models.OauthClient) error {
+	return errDuplicateKey
+}
+
+func (s *flakyStorage) HealthCheck(ctx context.Context) error {
+	if s.down.Load() {
+		return errBackendDown
+	}
+	return nil
+}
+
+// stateRecorder keeps the circuit states it is told about
+type stateRecorder struct {
+	NoOpMetrics
+	mu     sync.Mutex
+	states []CircuitState
+}
+
+func (r *stateRecorder) RecordCircuitBreakerState(state CircuitState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+}
+
+func TestCircuitBreakerStorage(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyStorage{Storage: NewMemoryStorage()}
+	breaker := NewCircuitBreakerStorage(backend, &CircuitBreakerConfig{
+		FailureThreshold: 3,
+		RecoveryTimeout:  50 * time.Millisecond,
+		MaxRequests:      2,
+	})
+	recorder := new(stateRecorder)
+	breaker.SetMetrics(recorder)
+
+	// Lookups that find nothing are not failures
+	for i := 0; i < 5; i++ {
+		_, err := breaker.GetClient(ctx, "bogus")
+		assert.Equal(t, ErrClientNotFound, err)
+	}
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	// Neither are errors about the data, such as duplicate keys
+	for i := 0; i < 5; i++ {
+		err := breaker.CreateClient(ctx, &models.OauthClient{Key: "test_client_1"})
+		assert.Equal(t, errDuplicateKey, err)
+	}
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	// A success resets the count of consecutive failures
+	backend.down.Store(true)
+	for i := 0; i < 2; i++ {
+		_, err := breaker.GetDefaultScope(ctx)
+		assert.Equal(t, errBackendDown, err)
+	}
+	backend.down.Store(false)
+	_, err := breaker.GetDefaultScope(ctx)
+	require.NoError(t, err)
+
+	backend.down.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err := breaker.GetDefaultScope(ctx)
+		assert.Equal(t, errBackendDown, err)
+	}
+	assert.Equal(t, CircuitOpen, breaker.State())
+
+	// An open circuit fails fast without reaching the backend
+	calls := atomic.LoadInt32(&backend.calls)
+	_, err = breaker.GetDefaultScope(ctx)
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, calls, atomic.LoadInt32(&backend.calls))
+	assert.True(t, errors.Is(breaker.HealthCheck(ctx), ErrCircuitOpen))
+
+	// A failed trial call opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	_, err = breaker.GetDefaultScope(ctx)
+	assert.Equal(t, errBackendDown, err)
+	assert.Equal(t, CircuitOpen, breaker.State())
+
+	// The circuit closes once MaxRequests trial calls succeed
+	backend.down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	_, err = breaker.GetDefaultScope(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	require.NoError(t, breaker.HealthCheck(ctx))
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	assert.Equal(t, []CircuitState{
+		CircuitClosed,
+		CircuitOpen,
+		CircuitHalfOpen,
+		CircuitOpen,
+		CircuitHalfOpen,
+		CircuitClosed,
+	}, recorder.states)
+}
+
+func TestCircuitBreakerHalfOpenLimit(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyStorage{Storage: NewMemoryStorage()}
+	breaker := NewCircuitBreakerStorage(backend, &CircuitBreakerConfig{
+		FailureThreshold: 1,
+		RecoveryTimeout:  time.Millisecond,
+	})
+
+	backend.down.Store(true)
+	_, err := breaker.GetDefaultScope(ctx)
+	assert.Equal(t, errBackendDown, err)
+	time.Sleep(5 * time.Millisecond)
+
+	// Only one trial call is let through until it completes
+	generation, err := breaker.before()
+	require.NoError(t, err)
+	_, err = breaker.GetDefaultScope(ctx)
+	assert.Equal(t, ErrCircuitOpen, err)
+	breaker.after(generation, false)
+	assert.Equal(t, CircuitClosed, breaker.State())
+}
+
+func TestCircuitBreakerPanic(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyStorage{Storage: NewMemoryStorage()}
+	breaker := NewCircuitBreakerStorage(backend, &CircuitBreakerConfig{
+		FailureThreshold: 1,
+		RecoveryTimeout:  time.Millisecond,
+	})
+
+	backend.down.Store(true)
+	_, err := breaker.GetDefaultScope(ctx)
+	assert.Equal(t, errBackendDown, err)
+	time.Sleep(5 * time.Millisecond)
+
+	// A trial call that panics counts as failed instead of keeping its slot
+	assert.Panics(t, func() { breaker.do(func() error { panic("boom") }) })
+	assert.Equal(t, CircuitOpen, breaker.State())
+
+	backend.down.Store(false)
+	time.Sleep(5 * time.Millisecond)
+	_, err = breaker.GetDefaultScope(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, CircuitClosed, breaker.State())
+}
+
+func TestCircuitBreakerTransactions(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyStorage{Storage: NewMemoryStorage()}
+	breaker := NewCircuitBreakerStorage(backend, &CircuitBreakerConfig{FailureThreshold: 2})
+
+	// Errors of the transaction's own making are not failures
+	errInvalid := errors.New("invalid grant")
+	for i := 0; i < 3; i++ {
+		err := breaker.WithTx(ctx, func(tx Storage) error {
+			if _, err := tx.GetDefaultScope(ctx); err != nil {
+				return err
+			}
+			return errInvalid
+		})
+		assert.Equal(t, errInvalid, err)
+	}
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	// Failed storage calls are, whatever fn makes of them
+	backend.down.Store(true)
+	for i := 0; i < 2; i++ {
+		err := breaker.WithTx(ctx, func(tx Storage) error {
+			if _, err := tx.GetDefaultScope(ctx); err != nil {
+				return fmt.Errorf("failed to get scope: %w", err)
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, errBackendDown)
+	}
+	assert.Equal(t, CircuitOpen, breaker.State())
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// IDRange selects the records whose ID sorts in [From, To), an empty From or
+// To leaves that end open. Ranges from SplitIDs let several cleanup workers
+// remove expired rows without ever picking the same ones.
+type IDRange struct {
+	From string
+	To   string
+}
+
+// AllIDs is the range of every ID
+var AllIDs = IDRange{}
+
+// Contains reports whether id falls in the range
+func (r IDRange) Contains(id string) bool {
+	return (r.From == "" || id >= r.From) && (r.To == "" || id < r.To)
+}
+
+// SplitIDs splits the ID space into n disjoint ranges covering all of it.
+// IDs are UUIDs, so the bounds are spread over their first two hex digits and
+// the ranges hold about as many records each.
+func SplitIDs(n int) []IDRange {
+	if n < 1 {
+		n = 1
+	}
+	if n > 256 {
+		n = 256
+	}
+
+	ranges := make([]IDRange, n)
+	for i := range ranges {
+		if i > 0 {
+			ranges[i].From = fmt.Sprintf("%02x", i*256/n)
+			ranges[i-1].To = ranges[i].From
+		}
+	}
+	return ranges
+}
+
+// CleanupExpiredTokensBatch removes a batch of expired tokens with IDs in ids
+// when s is a BatchCleaner. Other backends remove every expired token at
+// once, only for the range starting at the lowest ID so workers cleaning up
+// the other ranges at the same time do not repeat it.
+func CleanupExpiredTokensBatch(ctx context.Context, s Storage, ids IDRange, limit int) (int, error) {
+	if cleaner, ok := s.(BatchCleaner); ok {
+		return cleaner.CleanupExpiredTokensBatch(ctx, ids, limit)
+	}
+	if ids.From != "" {
+		return 0, nil
+	}
+	return 0, s.CleanupExpiredTokens(ctx)
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitIDs(t *testing.T) {
+	assert.Equal(t, []IDRange{AllIDs}, SplitIDs(0))
+	assert.Equal(t, []IDRange{{To: "55"}, {From: "55", To: "aa"}, {From: "aa"}}, SplitIDs(3))
+	assert.Len(t, SplitIDs(1000), 256)
+
+	// Every ID falls in exactly one range
+	ranges := SplitIDs(7)
+	for _, id := range []string{"", "1", "00000000", "ffffffff", "zz", uuid.New(), uuid.New(), uuid.New()} {
+		matched := 0
+		for _, ids := range ranges {
+			if ids.Contains(id) {
+				matched++
+			}
+		}
+		assert.Equal(t, 1, matched, id)
+	}
+}
+
+func TestCleanupExpiredTokensBatchByRange(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage().(*MemoryStorage)
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	for _, id := range []string{"0a", "5a", "aa"} {
+		accessToken := models.NewOauthAccessToken(client, nil, -60, "read")
+		accessToken.ID = id
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	}
+
+	ranges := SplitIDs(3)
+	removed, err := s.CleanupExpiredTokensBatch(ctx, ranges[1], 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	removed, err = s.CleanupExpiredTokensBatch(ctx, ranges[1], 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = s.CleanupExpiredTokensBatch(ctx, AllIDs, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+}
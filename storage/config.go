@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeConfig copies a backend's Config map into the struct dest points to,
+// keys are matched against the json tags of the struct fields. Durations may
+// be given as strings such as "5m" or as nanoseconds, keys without a matching
+// field are ignored.
+func DecodeConfig(config map[string]interface{}, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config destination must be a pointer to a struct")
+	}
+	v = v.Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		value, exists := config[key]
+		if !exists || value == nil {
+			continue
+		}
+		if err := setConfigValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func setConfigValue(field reflect.Value, value interface{}) error {
+	if field.Type() == durationType {
+		if s, ok := value.(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+		field.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected a bool, got %T", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := configInt(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		var items []string
+		switch v := value.(type) {
+		case []string:
+			items = v
+		case []interface{}:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("expected a list of strings, got %T", item)
+				}
+				items = append(items, s)
+			}
+		default:
+			return fmt.Errorf("expected a list of strings, got %T", value)
+		}
+		field.Set(reflect.ValueOf(items).Convert(field.Type()))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// configInt accepts Go integers as well as the float64 numbers produced by
+// decoding JSON into a map
+func configInt(value interface{}) (int64, error) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case time.Duration:
+		return int64(n), nil
+	case float64:
+		if n != float64(int64(n)) {
+			return 0, fmt.Errorf("expected an integer, got %v", n)
+		}
+		return int64(n), nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", value)
+	}
+}
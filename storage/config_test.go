@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	type testConfig struct {
+		Addr     string        `json:"addr"`
+		Addrs    []string      `json:"addrs,omitempty"`
+		PoolSize int           `json:"pool_size"`
+		Timeout  time.Duration `json:"timeout"`
+		WAL      bool          `json:"wal"`
+		Ignored  string
+	}
+
+	cnf := &testConfig{PoolSize: 10}
+	require.NoError(t, DecodeConfig(map[string]interface{}{
+		"addr":    "localhost:6379",
+		"addrs":   []interface{}{"a:6379", "b:6379"},
+		"timeout": "150ms",
+		"wal":     true,
+		"unknown": "ignored",
+	}, cnf))
+	assert.Equal(t, &testConfig{
+		Addr:     "localhost:6379",
+		Addrs:    []string{"a:6379", "b:6379"},
+		PoolSize: 10,
+		Timeout:  150 * time.Millisecond,
+		WAL:      true,
+	}, cnf)
+
+	// Durations may also be given in nanoseconds
+	require.NoError(t, DecodeConfig(map[string]interface{}{"timeout": float64(time.Second)}, cnf))
+	assert.Equal(t, time.Second, cnf.Timeout)
+
+	assert.EqualError(t, DecodeConfig(map[string]interface{}{"pool_size": "ten"}, cnf), "invalid pool_size: expected a number, got string")
+	assert.EqualError(t, DecodeConfig(map[string]interface{}{"pool_size": 1.5}, cnf), "invalid pool_size: expected an integer, got 1.5")
+	assert.Error(t, DecodeConfig(map[string]interface{}{"timeout": "soon"}, cnf))
+	assert.Error(t, DecodeConfig(nil, *cnf))
+}
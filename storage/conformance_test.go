@@ -0,0 +1,56 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/storagetest"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/stretchr/testify/require"
+)
+
+func newMemoryCache(t *testing.T) *storage.MemoryCache {
+	cache, err := storage.NewMemoryCache(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestPersistentMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		m, err := storage.OpenMemoryStorage(map[string]interface{}{
+			"path": filepath.Join(t.TempDir(), "oauth2.json"),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		return m
+	})
+}
+
+// The decorators must not change what their backend does
+func TestDecoratorConformance(t *testing.T) {
+	t.Run("CachedStorage", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Storage {
+			return storage.NewCachedStorage(storage.NewMemoryStorage(), newMemoryCache(t), nil)
+		})
+	})
+	t.Run("HashedStorage", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Storage {
+			hasher, err := tokenhash.New("secret_key")
+			require.NoError(t, err)
+			return storage.NewHashedStorage(storage.NewMemoryStorage(), hasher)
+		})
+	})
+	t.Run("CircuitBreakerStorage", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Storage {
+			return storage.NewCircuitBreakerStorage(storage.NewMemoryStorage(), nil)
+		})
+	})
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDatadogAddress is where the local Datadog agent listens for
+	// DogStatsD packets
+	DefaultDatadogAddress = "127.0.0.1:8125"
+
+	// DefaultDatadogBufferSize is the number of metrics queued for the
+	// flusher, metrics recorded while the queue is full are dropped
+	DefaultDatadogBufferSize = 8192
+
+	// DefaultDatadogFlushInterval is how often queued metrics are sent
+	DefaultDatadogFlushInterval = 100 * time.Millisecond
+
+	// datadogMaxPacketSize keeps packets under the MTU of most networks
+	datadogMaxPacketSize = 1432
+)
+
+// DatadogConfig defines DogStatsD exporter configuration
+type DatadogConfig struct {
+	// Agent address in host:port form
+	Address string `json:"address"`
+
+	// Tags added to every metric, such as "env:prod"
+	Tags []string `json:"tags"`
+
+	BufferSize    int           `json:"buffer_size"`
+	FlushInterval time.Duration `json:"flush_interval"`
+}
+
+// DatadogMetrics sends metrics to a Datadog agent as DogStatsD UDP packets.
+// Recording a metric only queues a line, a background flusher packs queued
+// lines into packets, so callers never wait on the network.
+type DatadogMetrics struct {
+	conn    net.Conn
+	prefix  string
+	tags    string
+	lines   chan string
+	dropped atomic.Uint64
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewDatadogMetrics creates a DogStatsD exporter from a
+// MonitoringConfig.Config map and starts its flusher, Close stops it. Metric
+// names are prefixed with namespace and subsystem when they are not empty.
+func NewDatadogMetrics(namespace, subsystem string, config map[string]interface{}) (*DatadogMetrics, error) {
+	cnf := &DatadogConfig{
+		Address:       DefaultDatadogAddress,
+		BufferSize:    DefaultDatadogBufferSize,
+		FlushInterval: DefaultDatadogFlushInterval,
+	}
+	if err := DecodeConfig(config, cnf); err != nil {
+		return nil, fmt.Errorf("invalid datadog config: %w", err)
+	}
+	if cnf.BufferSize <= 0 || cnf.FlushInterval <= 0 {
+		return nil, fmt.Errorf("invalid datadog config: buffer_size and flush_interval must be positive")
+	}
+
+	// Dialing UDP does not send anything, an agent that is down only
+	// loses packets
+	conn, err := net.Dial("udp", cnf.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to datadog agent: %w", err)
+	}
+
+	d := &DatadogMetrics{
+		conn:   conn,
+		prefix: datadogPrefix(namespace, subsystem),
+		lines:  make(chan string, cnf.BufferSize),
+		stop:   make(chan struct{}),
+	}
+	if len(cnf.Tags) > 0 {
+		d.tags = strings.Join(cnf.Tags, ",")
+	}
+	d.wg.Add(1)
+	go d.flusher(cnf.FlushInterval)
+	return d, nil
+}
+
+func (d *DatadogMetrics) RecordTokenGeneration(clientID, grantType string, duration time.Duration) {
+	d.timing("token.generation.duration", duration, "client_id", clientID, "grant_type", grantType)
+}
+
+func (d *DatadogMetrics) RecordTokenValidation(valid bool, duration time.Duration) {
+	d.timing("token.validation.duration", duration, "result", result(valid, "valid", "invalid"))
+}
+
+func (d *DatadogMetrics) RecordDatabaseQuery(operation string, duration time.Duration, success bool) {
+	d.timing("database.query.duration", duration, "operation", operation, "status", result(success, "success", "error"))
+}
+
+func (d *DatadogMetrics) RecordCacheOperation(operation string, hit bool, duration time.Duration) {
+	d.timing("cache.operation.duration", duration, "operation", operation, "result", result(hit, "hit", "miss"))
+}
+
+// IncrementActiveTokens does nothing, see RecordActiveTokens
+func (d *DatadogMetrics) IncrementActiveTokens(clientID string) {}
+
+// DecrementActiveTokens does nothing, see RecordActiveTokens
+func (d *DatadogMetrics) DecrementActiveTokens(clientID string) {}
+
+func (d *DatadogMetrics) RecordActiveTokens(count int) {
+	d.send("active_tokens", strconv.Itoa(count), "g")
+}
+
+// RecordRateLimit tags requests limited per IP address with kind:ip and no
+// client ID, as anyone can send them from any number of addresses
+func (d *DatadogMetrics) RecordRateLimit(clientID string, limited bool) {
+	kind := result(clientID == "", "ip", "client")
+	d.send("rate_limit.requests", "1", "c", "kind", kind, "client_id", clientID, "result", result(limited, "limited", "allowed"))
+}
+
+func (d *DatadogMetrics) RecordMemoryUsage(bytes int64) {
+	d.send("memory_usage", strconv.FormatInt(bytes, 10), "g")
+}
+
+func (d *DatadogMetrics) RecordGoroutineCount(count int) {
+	d.send("goroutines", strconv.Itoa(count), "g")
+}
+
+func (d *DatadogMetrics) RecordRequestCount(endpoint, method, status string) {
+	d.send("requests", "1", "c", "endpoint", endpoint, "method", method, "status", status)
+}
+
+func (d *DatadogMetrics) RecordCircuitBreakerState(state CircuitState) {
+	d.send("circuit_breaker.state", strconv.Itoa(int(state)), "g", "state", state.String())
+}
+
+// Dropped returns how many metrics were discarded because the queue was full
+func (d *DatadogMetrics) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Close sends the metrics still queued and closes the connection, metrics
+// recorded afterwards are discarded
+func (d *DatadogMetrics) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		d.wg.Wait()
+		err = d.conn.Close()
+	})
+	return err
+}
+
+func (d *DatadogMetrics) timing(name string, duration time.Duration, tags ...string) {
+	ms := strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', -1, 64)
+	d.send(name, ms, "ms", tags...)
+}
+
+// send formats a DogStatsD line and queues it without blocking, tags are
+// given as name, value pairs
+func (d *DatadogMetrics) send(name, value, kind string, tags ...string) {
+	var b strings.Builder
+	b.WriteString(d.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+
+	separator := "|#"
+	if d.tags != "" {
+		b.WriteString(separator)
+		b.WriteString(d.tags)
+		separator = ","
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] == "" {
+			continue
+		}
+		b.WriteString(separator)
+		b.WriteString(tags[i])
+		b.WriteByte(':')
+		b.WriteString(datadogTagReplacer.Replace(tags[i+1]))
+		separator = ","
+	}
+
+	select {
+	case d.lines <- b.String():
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// flusher packs queued lines into packets, a packet is sent when the next
+// line would not fit and on every tick
+func (d *DatadogMetrics) flusher(interval time.Duration) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	packet := make([]byte, 0, datadogMaxPacketSize)
+	add := func(line string) {
+		if len(packet) > 0 && len(packet)+1+len(line) > datadogMaxPacketSize {
+			d.write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	for {
+		select {
+		case line := <-d.lines:
+			add(line)
+		case <-ticker.C:
+			d.write(packet)
+			packet = packet[:0]
+		case <-d.stop:
+			for {
+				select {
+				case line := <-d.lines:
+					add(line)
+				default:
+					d.write(packet)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *DatadogMetrics) write(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+	// UDP errors, such as no agent listening, are not worth surfacing
+	d.conn.Write(packet)
+}
+
+// datadogTagReplacer strips characters with a meaning in the DogStatsD format
+var datadogTagReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+func datadogPrefix(namespace, subsystem string) string {
+	var prefix string
+	for _, part := range []string{namespace, subsystem} {
+		if part != "" {
+			prefix += part + "."
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenUDP starts a local agent stand-in and returns a function reading the
+// metric lines it received until none arrive for a while
+func listenUDP(t *testing.T) (string, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	read := func() []string {
+		var lines []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return lines
+			}
+			assert.LessOrEqual(t, n, datadogMaxPacketSize)
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+	}
+	return conn.LocalAddr().String(), read
+}
+
+func TestDatadogMetrics(t *testing.T) {
+	addr, read := listenUDP(t)
+
+	factory, err := NewFactory()
+	require.NoError(t, err)
+	provider, err := factory.CreateMetrics(MonitoringConfig{
+		Enabled:   true,
+		Provider:  "datadog",
+		Namespace: "oauth2",
+		Config: map[string]interface{}{
+			"address": addr,
+			"tags":    []string{"env:test"},
+		},
+	})
+	require.NoError(t, err)
+	metrics := provider.(*DatadogMetrics)
+
+	metrics.RecordTokenGeneration("test_client_1", "client_credentials", 1500*time.Microsecond)
+	metrics.RecordTokenValidation(false, time.Millisecond)
+	metrics.RecordRequestCount("/v1/oauth/tokens", "POST", "200")
+	metrics.RecordRateLimit("a|b,c", true)
+	metrics.RecordRateLimit("", false)
+	metrics.RecordActiveTokens(2)
+	metrics.RecordActiveTokens(1)
+	metrics.RecordGoroutineCount(12)
+
+	assert.Equal(t, []string{
+		"oauth2.token.generation.duration:1.5|ms|#env:test,client_id:test_client_1,grant_type:client_credentials",
+		"oauth2.token.validation.duration:1|ms|#env:test,result:invalid",
+		"oauth2.requests:1|c|#env:test,endpoint:/v1/oauth/tokens,method:POST,status:200",
+		"oauth2.rate_limit.requests:1|c|#env:test,kind:client,client_id:a_b_c,result:limited",
+		"oauth2.rate_limit.requests:1|c|#env:test,kind:ip,result:allowed",
+		"oauth2.active_tokens:2|g|#env:test",
+		"oauth2.active_tokens:1|g|#env:test",
+		"oauth2.goroutines:12|g|#env:test",
+	}, read())
+	require.NoError(t, metrics.Close())
+}
+
+func TestDatadogMetricsBuffering(t *testing.T) {
+	addr, read := listenUDP(t)
+
+	metrics, err := NewDatadogMetrics("", "", map[string]interface{}{
+		"address":        addr,
+		"buffer_size":    500,
+		"flush_interval": "1h",
+	})
+	require.NoError(t, err)
+
+	// Nothing is sent until a packet fills up or the metrics are flushed
+	metrics.RecordGoroutineCount(1)
+	assert.Empty(t, read())
+
+	// Full packets go out at once, Close sends the rest
+	for i := 0; i < 1000; i++ {
+		metrics.RecordRequestCount("/tokens", "POST", "200")
+	}
+	require.NoError(t, metrics.Close())
+	lines := read()
+	assert.Equal(t, 1001, len(lines)+int(metrics.Dropped()))
+	assert.Equal(t, "goroutines:1|g", lines[0])
+
+	// Closed exporters discard metrics
+	metrics.RecordGoroutineCount(2)
+	assert.Empty(t, read())
+
+	_, err = NewDatadogMetrics("", "", map[string]interface{}{"buffer_size": 0})
+	assert.Error(t, err)
+}
+
+func TestDatadogMetricsDropsWhenFull(t *testing.T) {
+	// Without a flusher draining it the queue stays full
+	metrics := &DatadogMetrics{lines: make(chan string, 1)}
+	metrics.RecordGoroutineCount(1)
+	metrics.RecordGoroutineCount(2)
+	assert.Equal(t, uint64(1), metrics.Dropped())
+	assert.Equal(t, "goroutines:1|g", <-metrics.lines)
+}
@@ -13,4 +13,7 @@ var (
 	ErrScopeNotFound   = errors.New("oauth scope not found")
 	ErrRoleNotFound    = errors.New("oauth role not found")
 	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrCacheMiss       = errors.New("cache miss")
+	ErrCircuitOpen     = errors.New("storage circuit breaker is open")
+	ErrInvalidCursor   = errors.New("invalid list cursor")
 )
\ No newline at end of file
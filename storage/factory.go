@@ -1,11 +1,72 @@
 package storage
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
+// BackendConstructor creates a storage backend from its Config map
+type BackendConstructor func(config map[string]interface{}) (Storage, error)
+
+// LayeredBackendConstructor creates a storage backend from its Config map
+// that keeps some records itself and delegates the rest to relational
+type LayeredBackendConstructor func(config map[string]interface{}, relational Storage) (Storage, error)
+
+// CacheConstructor creates a cache provider from its Config map
+type CacheConstructor func(config map[string]interface{}) (CacheProvider, error)
+
+var (
+	backendsMu      sync.RWMutex
+	backends        = make(map[string]BackendConstructor)
+	layeredBackends = make(map[string]LayeredBackendConstructor)
+	caches          = make(map[string]CacheConstructor)
+)
+
+// RegisterBackend makes a storage backend available to DefaultFactory under
+// the given type. Backends in subpackages register themselves when imported,
+// registering the same type twice panics.
+func RegisterBackend(backendType string, constructor BackendConstructor) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, exists := backends[backendType]; exists {
+		panic(fmt.Sprintf("storage backend %s registered twice", backendType))
+	}
+	if _, exists := layeredBackends[backendType]; exists {
+		panic(fmt.Sprintf("storage backend %s registered twice", backendType))
+	}
+	backends[backendType] = constructor
+}
+
+// RegisterLayeredBackend makes a backend that sits in front of a relational
+// one available to DefaultFactory, like RegisterBackend does for the others.
+// The factory creates the relational backend from the "relational" key of
+// the Config map, a StorageBackend or a map with "type" and "config" keys,
+// and closes it again when the layered backend cannot be created.
+func RegisterLayeredBackend(backendType string, constructor LayeredBackendConstructor) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, exists := backends[backendType]; exists {
+		panic(fmt.Sprintf("storage backend %s registered twice", backendType))
+	}
+	if _, exists := layeredBackends[backendType]; exists {
+		panic(fmt.Sprintf("storage backend %s registered twice", backendType))
+	}
+	layeredBackends[backendType] = constructor
+}
+
+// RegisterCache makes a cache provider available to DefaultFactory, like
+// RegisterBackend does for storage backends
+func RegisterCache(provider string, constructor CacheConstructor) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, exists := caches[provider]; exists {
+		panic(fmt.Sprintf("cache provider %s registered twice", provider))
+	}
+	caches[provider] = constructor
+}
+
 // DefaultFactory implements the Factory interface
 type DefaultFactory struct {
 	// Internal state for managing provider instances
@@ -20,30 +81,93 @@ func NewFactory() (Factory, error) {
 func (f *DefaultFactory) CreateStorage(config StorageConfig) (Storage, error) {
 	switch config.Primary.Type {
 	case "memory", "":
-		// Create in-memory storage for development
-		return NewMemoryStorage(), nil
-	case "postgres":
-		// Create PostgreSQL storage - placeholder for now
-		return nil, fmt.Errorf("postgres storage implementation needed")
+		// Create in-memory storage for development, optionally persisted
+		s, err := OpenMemoryStorage(config.Primary.Config)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
 	case "mongodb":
 		return nil, fmt.Errorf("mongodb storage not yet implemented")
-	case "mysql":
-		return nil, fmt.Errorf("mysql storage not yet implemented")
-	default:
+	}
+
+	// SQL backends live in subpackages and register themselves
+	backendsMu.RLock()
+	constructor, exists := backends[config.Primary.Type]
+	layered, isLayered := layeredBackends[config.Primary.Type]
+	backendsMu.RUnlock()
+	if isLayered {
+		return f.createLayeredStorage(config.Primary, layered)
+	}
+	if !exists {
 		return nil, fmt.Errorf("unsupported storage type: %s", config.Primary.Type)
 	}
+	return constructor(config.Primary.Config)
+}
+
+// createLayeredStorage creates the relational backend of a layered one and
+// passes it to constructor
+func (f *DefaultFactory) createLayeredStorage(backend StorageBackend, constructor LayeredBackendConstructor) (Storage, error) {
+	relationalBackend, err := parseRelationalBackend(backend.Config["relational"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", backend.Type, err)
+	}
+	backendsMu.RLock()
+	_, nested := layeredBackends[relationalBackend.Type]
+	backendsMu.RUnlock()
+	if nested {
+		return nil, fmt.Errorf("invalid %s config: the relational backend cannot be %s", backend.Type, relationalBackend.Type)
+	}
+
+	relational, err := f.CreateStorage(StorageConfig{Primary: *relationalBackend})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create relational storage: %w", err)
+	}
+	s, err := constructor(backend.Config, relational)
+	if err != nil {
+		relational.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseRelationalBackend reads the relational backend of a layered one
+func parseRelationalBackend(value interface{}) (*StorageBackend, error) {
+	switch v := value.(type) {
+	case StorageBackend:
+		return &v, nil
+	case *StorageBackend:
+		return v, nil
+	case map[string]interface{}:
+		backend := new(StorageBackend)
+		if backendType, ok := v["type"].(string); ok {
+			backend.Type = backendType
+		}
+		if backendConfig, ok := v["config"].(map[string]interface{}); ok {
+			backend.Config = backendConfig
+		}
+		return backend, nil
+	case nil:
+		return nil, errors.New("relational is required")
+	default:
+		return nil, fmt.Errorf("unexpected relational %T", value)
+	}
 }
 
 // CreateCache creates a cache provider based on configuration
 func (f *DefaultFactory) CreateCache(config CacheConfig) (CacheProvider, error) {
-	switch config.Provider {
-	case "redis":
-		return nil, fmt.Errorf("redis cache implementation needed")
-	case "memory":
+	if config.Provider == "memory" {
 		return NewMemoryCache(config.Config)
-	default:
+	}
+
+	// Redis lives in a subpackage and registers itself
+	backendsMu.RLock()
+	constructor, exists := caches[config.Provider]
+	backendsMu.RUnlock()
+	if !exists {
 		return nil, fmt.Errorf("unsupported cache provider: %s", config.Provider)
 	}
+	return constructor(config.Config)
 }
 
 // CreateMetrics creates a metrics provider based on configuration
@@ -52,7 +176,7 @@ func (f *DefaultFactory) CreateMetrics(config MonitoringConfig) (MetricsProvider
 	case "prometheus":
 		return NewPrometheusMetrics(config.Namespace, config.Subsystem)
 	case "datadog":
-		return nil, fmt.Errorf("datadog metrics not yet implemented")
+		return NewDatadogMetrics(config.Namespace, config.Subsystem, config.Config)
 	case "noop":
 		return NewNoOpMetrics(), nil
 	default:
@@ -60,59 +184,6 @@ func (f *DefaultFactory) CreateMetrics(config MonitoringConfig) (MetricsProvider
 	}
 }
 
-// PrometheusMetrics placeholder - simplified version
-type PrometheusMetrics struct {
-	namespace string
-	subsystem string
-}
-
-func NewPrometheusMetrics(namespace, subsystem string) (*PrometheusMetrics, error) {
-	return &PrometheusMetrics{
-		namespace: namespace,
-		subsystem: subsystem,
-	}, nil
-}
-
-func (p *PrometheusMetrics) RecordTokenGeneration(clientID, grantType string, duration time.Duration) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordTokenValidation(valid bool, duration time.Duration) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordDatabaseQuery(operation string, duration time.Duration, success bool) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordCacheOperation(operation string, hit bool, duration time.Duration) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) IncrementActiveTokens(clientID string) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) DecrementActiveTokens(clientID string) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordRateLimit(clientID string, limited bool) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordMemoryUsage(bytes int64) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordGoroutineCount(count int) {
-	// Placeholder implementation
-}
-
-func (p *PrometheusMetrics) RecordRequestCount(endpoint, method, status string) {
-	// Placeholder implementation
-}
-
 // No-op metrics implementation for development/testing
 type NoOpMetrics struct{}
 
@@ -126,88 +197,8 @@ func (n *NoOpMetrics) RecordDatabaseQuery(operation string, duration time.Durati
 func (n *NoOpMetrics) RecordCacheOperation(operation string, hit bool, duration time.Duration) {}
 func (n *NoOpMetrics) IncrementActiveTokens(clientID string)                                   {}
 func (n *NoOpMetrics) DecrementActiveTokens(clientID string)                                  {}
+func (n *NoOpMetrics) RecordActiveTokens(count int)                                           {}
 func (n *NoOpMetrics) RecordRateLimit(clientID string, limited bool)                         {}
 func (n *NoOpMetrics) RecordMemoryUsage(bytes int64)                                         {}
 func (n *NoOpMetrics) RecordGoroutineCount(count int)                                        {}
 func (n *NoOpMetrics) RecordRequestCount(endpoint, method, status string)                   {}
-
-// Memory cache implementation for testing/development
-type MemoryCache struct {
-	data map[string]CacheItem
-}
-
-type CacheItem struct {
-	Value     interface{}
-	ExpiresAt time.Time
-}
-
-func NewMemoryCache(config map[string]interface{}) (*MemoryCache, error) {
-	return &MemoryCache{
-		data: make(map[string]CacheItem),
-	}, nil
-}
-
-func (m *MemoryCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
-	m.data[key] = CacheItem{
-		Value:     value,
-		ExpiresAt: time.Now().Add(ttl),
-	}
-	return nil
-}
-
-func (m *MemoryCache) Get(ctx context.Context, key string, dest interface{}) error {
-	item, exists := m.data[key]
-	if !exists || time.Now().After(item.ExpiresAt) {
-		return fmt.Errorf("key not found or expired")
-	}
-	// In a real implementation, you'd use reflection or type assertion to copy to dest
-	return nil
-}
-
-func (m *MemoryCache) Delete(ctx context.Context, key string) error {
-	delete(m.data, key)
-	return nil
-}
-
-func (m *MemoryCache) SetMulti(ctx context.Context, items map[string]interface{}, ttl time.Duration) error {
-	for key, value := range items {
-		m.Set(ctx, key, value, ttl)
-	}
-	return nil
-}
-
-func (m *MemoryCache) GetMulti(ctx context.Context, keys []string) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
-	for _, key := range keys {
-		item, exists := m.data[key]
-		if exists && !time.Now().After(item.ExpiresAt) {
-			result[key] = item.Value
-		}
-	}
-	return result, nil
-}
-
-func (m *MemoryCache) DeleteMulti(ctx context.Context, keys []string) error {
-	for _, key := range keys {
-		delete(m.data, key)
-	}
-	return nil
-}
-
-func (m *MemoryCache) FlushAll(ctx context.Context) error {
-	m.data = make(map[string]CacheItem)
-	return nil
-}
-
-func (m *MemoryCache) Stats(ctx context.Context) (*CacheStats, error) {
-	return &CacheStats{
-		Hits:   0, // Not tracked in memory implementation
-		Misses: 0,
-		Keys:   int64(len(m.data)),
-	}, nil
-}
-
-func (m *MemoryCache) Close() error {
-	m.data = nil
-	return nil
-}
\ No newline at end of file
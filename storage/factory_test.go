@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCacheIncrement(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewMemoryCache(nil)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Increment(ctx, "counter", 2, time.Minute)
+		}()
+	}
+	wg.Wait()
+
+	value, err := cache.Increment(ctx, "counter", -1, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(99), value)
+
+	var stored int64
+	require.NoError(t, cache.Get(ctx, "counter", &stored))
+	assert.Equal(t, int64(99), stored)
+
+	// Expired counters start again from zero
+	_, err = cache.Increment(ctx, "expiring", 5, -time.Second)
+	require.NoError(t, err)
+	value, err = cache.Increment(ctx, "expiring", 1, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+
+	// Non integer values cannot be incremented
+	require.NoError(t, cache.Set(ctx, "string", "foo", time.Minute))
+	_, err = cache.Increment(ctx, "string", 1, time.Minute)
+	assert.Error(t, err)
+}
+
+// layeredStorage keeps the relational storage the factory passed in
+type layeredStorage struct {
+	Storage
+}
+
+func TestFactoryLayeredBackend(t *testing.T) {
+	RegisterLayeredBackend("layered_test", func(config map[string]interface{}, relational Storage) (Storage, error) {
+		return &layeredStorage{Storage: relational}, nil
+	})
+	factory, err := NewFactory()
+	require.NoError(t, err)
+	create := func(config map[string]interface{}) (Storage, error) {
+		return factory.CreateStorage(StorageConfig{
+			Primary: StorageBackend{Type: "layered_test", Config: config},
+		})
+	}
+
+	s, err := create(map[string]interface{}{"relational": StorageBackend{Type: "memory"}})
+	require.NoError(t, err)
+	if assert.IsType(t, new(layeredStorage), s) {
+		assert.IsType(t, new(MemoryStorage), s.(*layeredStorage).Storage)
+	}
+
+	_, err = create(nil)
+	assert.EqualError(t, err, "invalid layered_test config: relational is required")
+	_, err = create(map[string]interface{}{"relational": map[string]interface{}{"type": "layered_test"}})
+	assert.EqualError(t, err, "invalid layered_test config: the relational backend cannot be layered_test")
+	_, err = create(map[string]interface{}{"relational": map[string]interface{}{"type": "bogus"}})
+	assert.EqualError(t, err, "failed to create relational storage: unsupported storage type: bogus")
+
+	assert.Panics(t, func() { RegisterBackend("layered_test", nil) })
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/RichardKnop/go-oauth2-server/log"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+)
+
+// HashedStorage wraps a storage backend so access tokens, refresh tokens and
+// authorization codes are only persisted as keyed hashes. Callers keep
+// working with plaintext tokens, the returned objects carry the token that
+// was presented rather than the stored hash.
+//
+// Rows stored before hashing was enabled are still found by their plaintext
+// and rewritten as hashes on first use. ListTokens cannot recover plaintext,
+// the tokens it lists carry their stored hash.
+type HashedStorage struct {
+	Storage
+	hasher *tokenhash.Hasher
+}
+
+// NewHashedStorage wraps s so tokens are stored as hashes computed by hasher
+func NewHashedStorage(s Storage, hasher *tokenhash.Hasher) *HashedStorage {
+	return &HashedStorage{Storage: s, hasher: hasher}
+}
+
+// WithTx runs fn in a transaction of the wrapped storage, tokens stored in
+// it are hashed as well
+func (h *HashedStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	return h.Storage.WithTx(ctx, func(tx Storage) error {
+		return fn(NewHashedStorage(tx, h.hasher))
+	})
+}
+
+// migrate rewrites a row stored before hashing was enabled in a single
+// transaction. The plaintext row is deleted before the hash is stored, as
+// both keep the row's ID, which SQL backends only allow once. A failure is
+// logged and rolls back, the row is migrated again on its next use.
+func (h *HashedStorage) migrate(ctx context.Context, kind string, fn func(tx *HashedStorage) error) {
+	err := h.WithTx(ctx, func(tx Storage) error {
+		return fn(tx.(*HashedStorage))
+	})
+	if err != nil {
+		log.ERROR.Printf("Failed to hash stored %s: %s", kind, err)
+	}
+}
+
+// StoreAccessToken stores a copy of the token with the token hashed
+func (h *HashedStorage) StoreAccessToken(ctx context.Context, token *models.OauthAccessToken) error {
+	hashed := *token
+	hashed.Token = h.hasher.Hash(token.Token)
+	if err := h.Storage.StoreAccessToken(ctx, &hashed); err != nil {
+		return err
+	}
+	token.CreatedAt = hashed.CreatedAt
+	return nil
+}
+
+// GetAccessToken looks an access token up by its hash
+func (h *HashedStorage) GetAccessToken(ctx context.Context, tokenStr string) (*models.OauthAccessToken, error) {
+	accessToken, err := h.Storage.GetAccessToken(ctx, h.hasher.Hash(tokenStr))
+	if errors.Is(err, ErrTokenNotFound) && !tokenhash.IsHashed(tokenStr) {
+		// Fall back to a row stored before hashing was enabled
+		accessToken, err = h.Storage.GetAccessToken(ctx, tokenStr)
+		if err == nil {
+			h.migrate(ctx, "access token", func(tx *HashedStorage) error {
+				if err := tx.Storage.DeleteAccessToken(ctx, tokenStr); err != nil {
+					return err
+				}
+				return tx.StoreAccessToken(ctx, accessToken)
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	presented := *accessToken
+	presented.Token = tokenStr
+	return &presented, nil
+}
+
+// DeleteAccessToken deletes an access token whether or not it was migrated
+func (h *HashedStorage) DeleteAccessToken(ctx context.Context, tokenStr string) error {
+	for _, stored := range h.hasher.Candidates(tokenStr) {
+		if err := h.Storage.DeleteAccessToken(ctx, stored); err != nil && !errors.Is(err, ErrTokenNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// StoreRefreshToken stores a copy of the token with the token hashed
+func (h *HashedStorage) StoreRefreshToken(ctx context.Context, token *models.OauthRefreshToken) error {
+	hashed := *token
+	hashed.Token = h.hasher.Hash(token.Token)
+	if err := h.Storage.StoreRefreshToken(ctx, &hashed); err != nil {
+		return err
+	}
+	token.CreatedAt = hashed.CreatedAt
+	return nil
+}
+
+// GetRefreshToken looks a refresh token up by its hash
+func (h *HashedStorage) GetRefreshToken(ctx context.Context, tokenStr string) (*models.OauthRefreshToken, error) {
+	refreshToken, err := h.Storage.GetRefreshToken(ctx, h.hasher.Hash(tokenStr))
+	if errors.Is(err, ErrTokenNotFound) && !tokenhash.IsHashed(tokenStr) {
+		// Fall back to a row stored before hashing was enabled
+		refreshToken, err = h.Storage.GetRefreshToken(ctx, tokenStr)
+		if err == nil {
+			h.migrate(ctx, "refresh token", func(tx *HashedStorage) error {
+				if err := tx.Storage.DeleteRefreshToken(ctx, tokenStr); err != nil {
+					return err
+				}
+				return tx.StoreRefreshToken(ctx, refreshToken)
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	presented := *refreshToken
+	presented.Token = tokenStr
+	return &presented, nil
+}
+
+// DeleteRefreshToken deletes a refresh token whether or not it was migrated
+func (h *HashedStorage) DeleteRefreshToken(ctx context.Context, tokenStr string) error {
+	for _, stored := range h.hasher.Candidates(tokenStr) {
+		if err := h.Storage.DeleteRefreshToken(ctx, stored); err != nil && !errors.Is(err, ErrTokenNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// StoreAuthorizationCode stores a copy of the code with the code hashed
+func (h *HashedStorage) StoreAuthorizationCode(ctx context.Context, code *models.OauthAuthorizationCode) error {
+	hashed := *code
+	hashed.Code = h.hasher.Hash(code.Code)
+	if err := h.Storage.StoreAuthorizationCode(ctx, &hashed); err != nil {
+		return err
+	}
+	code.CreatedAt = hashed.CreatedAt
+	return nil
+}
+
+// GetAuthorizationCode looks an authorization code up by its hash
+func (h *HashedStorage) GetAuthorizationCode(ctx context.Context, codeStr string) (*models.OauthAuthorizationCode, error) {
+	authorizationCode, err := h.Storage.GetAuthorizationCode(ctx, h.hasher.Hash(codeStr))
+	if errors.Is(err, ErrCodeNotFound) && !tokenhash.IsHashed(codeStr) {
+		// Fall back to a row stored before hashing was enabled
+		authorizationCode, err = h.Storage.GetAuthorizationCode(ctx, codeStr)
+		if err == nil {
+			h.migrate(ctx, "authorization code", func(tx *HashedStorage) error {
+				if err := tx.Storage.DeleteAuthorizationCode(ctx, codeStr); err != nil {
+					return err
+				}
+				return tx.StoreAuthorizationCode(ctx, authorizationCode)
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	presented := *authorizationCode
+	presented.Code = codeStr
+	return &presented, nil
+}
+
+// DeleteAuthorizationCode deletes a code whether or not it was migrated, it
+// returns ErrCodeNotFound when neither form was stored
+func (h *HashedStorage) DeleteAuthorizationCode(ctx context.Context, codeStr string) error {
+	deleted := false
+	for _, stored := range h.hasher.Candidates(codeStr) {
+		err := h.Storage.DeleteAuthorizationCode(ctx, stored)
+		if err == nil {
+			deleted = true
+		} else if !errors.Is(err, ErrCodeNotFound) {
+			return err
+		}
+	}
+	if !deleted {
+		return ErrCodeNotFound
+	}
+	return nil
+}
+
+// BatchGetTokens looks access tokens up by their hashes
+func (h *HashedStorage) BatchGetTokens(ctx context.Context, tokens []string) ([]*models.OauthAccessToken, error) {
+	presented := make(map[string]string)
+	var stored []string
+	for _, token := range tokens {
+		for _, candidate := range h.hasher.Candidates(token) {
+			presented[candidate] = token
+			stored = append(stored, candidate)
+		}
+	}
+
+	accessTokens, err := h.Storage.BatchGetTokens(ctx, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.OauthAccessToken, 0, len(accessTokens))
+	for _, accessToken := range accessTokens {
+		found := *accessToken
+		found.Token = presented[accessToken.Token]
+		result = append(result, &found)
+	}
+	return result, nil
+}
+
+// BatchDeleteTokens deletes access tokens whether or not they were migrated
+func (h *HashedStorage) BatchDeleteTokens(ctx context.Context, tokens []string) error {
+	var stored []string
+	for _, token := range tokens {
+		stored = append(stored, h.hasher.Candidates(token)...)
+	}
+	return h.Storage.BatchDeleteTokens(ctx, stored)
+}
+
+// CleanupExpiredTokensBatch passes batched cleanup through to the backend
+func (h *HashedStorage) CleanupExpiredTokensBatch(ctx context.Context, ids IDRange, limit int) (int, error) {
+	return CleanupExpiredTokensBatch(ctx, h.Storage, ids, limit)
+}
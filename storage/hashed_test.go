@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashedStorage(t *testing.T) {
+	ctx := context.Background()
+	hasher, err := tokenhash.New("secret_key")
+	require.NoError(t, err)
+	inner := NewMemoryStorage()
+	hashed := NewHashedStorage(inner, hasher)
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	user := &models.OauthUser{MyGormModel: models.MyGormModel{ID: "1"}, Username: "test@user"}
+
+	accessToken := models.NewOauthAccessToken(client, user, 60, "read")
+	require.NoError(t, hashed.StoreAccessToken(ctx, accessToken))
+
+	// Only the hash is persisted
+	_, err = inner.GetAccessToken(ctx, accessToken.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+	stored, err := inner.GetAccessToken(ctx, hasher.Hash(accessToken.Token))
+	require.NoError(t, err)
+	assert.True(t, tokenhash.IsHashed(stored.Token))
+
+	// Callers get the plaintext token back
+	found, err := hashed.GetAccessToken(ctx, accessToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, accessToken.Token, found.Token)
+	assert.True(t, tokenhash.IsHashed(stored.Token), "stored token must not be modified")
+
+	// A leaked hash does not work as a token
+	_, err = hashed.GetAccessToken(ctx, stored.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	tokens, err := hashed.BatchGetTokens(ctx, []string{accessToken.Token, "bogus"})
+	require.NoError(t, err)
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, accessToken.Token, tokens[0].Token)
+	}
+
+	require.NoError(t, hashed.DeleteAccessToken(ctx, accessToken.Token))
+	_, err = hashed.GetAccessToken(ctx, accessToken.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Expired tokens are still reported as expired
+	expired := models.NewOauthRefreshToken(client, user, 60, "read")
+	expired.ExpiresAt = time.Now().UTC().Add(-time.Second)
+	require.NoError(t, hashed.StoreRefreshToken(ctx, expired))
+	_, err = hashed.GetRefreshToken(ctx, expired.Token)
+	assert.Equal(t, ErrTokenExpired, err)
+
+	authorizationCode := models.NewOauthAuthorizationCode(client, user, 60, "https://www.example.com", "read")
+	require.NoError(t, hashed.StoreAuthorizationCode(ctx, authorizationCode))
+	_, err = inner.GetAuthorizationCode(ctx, authorizationCode.Code)
+	assert.Equal(t, ErrCodeNotFound, err)
+	foundCode, err := hashed.GetAuthorizationCode(ctx, authorizationCode.Code)
+	require.NoError(t, err)
+	assert.Equal(t, authorizationCode.Code, foundCode.Code)
+}
+
+func TestHashedStorageMigratesPlaintextTokens(t *testing.T) {
+	ctx := context.Background()
+	hasher, err := tokenhash.New("secret_key")
+	require.NoError(t, err)
+	inner := NewMemoryStorage()
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	user := &models.OauthUser{MyGormModel: models.MyGormModel{ID: "1"}, Username: "test@user"}
+
+	// Stored before hashing was enabled
+	refreshToken := models.NewOauthRefreshToken(client, user, 60, "read")
+	require.NoError(t, inner.StoreRefreshToken(ctx, refreshToken))
+
+	hashed := NewHashedStorage(inner, hasher)
+	found, err := hashed.GetRefreshToken(ctx, refreshToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, refreshToken.Token, found.Token)
+
+	// The row was rewritten as a hash on first use
+	_, err = inner.GetRefreshToken(ctx, refreshToken.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+	_, err = inner.GetRefreshToken(ctx, hasher.Hash(refreshToken.Token))
+	assert.NoError(t, err)
+
+	found, err = hashed.GetRefreshToken(ctx, refreshToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, refreshToken.Token, found.Token)
+}
+
+// failingStore fails to store refresh tokens, in transactions as well
+type failingStore struct {
+	Storage
+}
+
+func (f failingStore) StoreRefreshToken(ctx context.Context, token *models.OauthRefreshToken) error {
+	return errors.New("store failed")
+}
+
+func (f failingStore) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	return f.Storage.WithTx(ctx, func(tx Storage) error { return fn(failingStore{tx}) })
+}
+
+func TestHashedStorageKeepsPlaintextTokenWhenMigrationFails(t *testing.T) {
+	ctx := context.Background()
+	hasher, err := tokenhash.New("secret_key")
+	require.NoError(t, err)
+	inner := NewMemoryStorage()
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	refreshToken := models.NewOauthRefreshToken(client, nil, 60, "read")
+	require.NoError(t, inner.StoreRefreshToken(ctx, refreshToken))
+
+	// The token is still returned and migrated again on its next use
+	hashed := NewHashedStorage(failingStore{inner}, hasher)
+	for i := 0; i < 2; i++ {
+		found, err := hashed.GetRefreshToken(ctx, refreshToken.Token)
+		require.NoError(t, err)
+		assert.Equal(t, refreshToken.Token, found.Token)
+	}
+	_, err = inner.GetRefreshToken(ctx, refreshToken.Token)
+	assert.NoError(t, err)
+}
@@ -37,21 +37,65 @@ type Storage interface {
 	// Authorization code operations
 	StoreAuthorizationCode(ctx context.Context, code *models.OauthAuthorizationCode) error
 	GetAuthorizationCode(ctx context.Context, codeStr string) (*models.OauthAuthorizationCode, error)
+	// DeleteAuthorizationCode returns ErrCodeNotFound when there was no code
+	// to delete, so only one caller can consume a code
 	DeleteAuthorizationCode(ctx context.Context, codeStr string) error
 
 	// Scope operations
 	GetScope(ctx context.Context, scope string) (*models.OauthScope, error)
 	GetDefaultScope(ctx context.Context) (string, error)
 	
+	// Listing, pages are ordered by key and continue from options.Cursor
+	ListClients(ctx context.Context, options ListOptions) (*ClientPage, error)
+	ListUsers(ctx context.Context, options ListOptions) (*UserPage, error)
+	ListScopes(ctx context.Context, options ListOptions) (*ScopePage, error)
+	// ListTokens lists access tokens that have not expired
+	ListTokens(ctx context.Context, filter TokenFilter, options ListOptions) (*TokenPage, error)
+	// CountActiveTokens counts access tokens that have not expired
+	CountActiveTokens(ctx context.Context) (int, error)
+
+	// Bulk revocation deletes the access tokens, refresh tokens and
+	// authorization codes of a user or client, by their IDs, or those
+	// granted a scope
+	RevokeUserTokens(ctx context.Context, userID string) (*RevokeResult, error)
+	RevokeClientTokens(ctx context.Context, clientID string) (*RevokeResult, error)
+	RevokeTokensWithScope(ctx context.Context, scope string) (*RevokeResult, error)
+
 	// Batch operations for performance
 	BatchGetTokens(ctx context.Context, tokens []string) ([]*models.OauthAccessToken, error)
 	BatchDeleteTokens(ctx context.Context, tokens []string) error
 
+	// WithTx calls fn with a storage whose operations are committed together
+	// when fn returns nil and rolled back when it returns an error or panics.
+	// A transaction that fails on a serialization failure or deadlock may be
+	// run again, so fn must not have side effects outside the storage it is
+	// given. Calling WithTx on that storage joins the running transaction.
+	// The storage must not be used once fn returns, nor by several
+	// goroutines at once. Backends that cannot roll back, such as Redis,
+	// document it and call fn with themselves, keeping whatever fn wrote
+	// before an error.
+	WithTx(ctx context.Context, fn func(tx Storage) error) error
+
 	// Health and maintenance
 	HealthCheck(ctx context.Context) error
 	Close() error
 }
 
+// BatchCleaner is implemented by backends that can remove expired tokens in
+// bounded batches, so maintenance never holds long locks on large tables
+type BatchCleaner interface {
+	// CleanupExpiredTokensBatch removes up to limit expired access tokens,
+	// refresh tokens and authorization codes with IDs in ids and returns how
+	// many were removed
+	CleanupExpiredTokensBatch(ctx context.Context, ids IDRange, limit int) (int, error)
+}
+
+// Instrumented is implemented by backends and caches that report to a
+// metrics provider, the SDK sets its provider before first use
+type Instrumented interface {
+	SetMetrics(metrics MetricsProvider)
+}
+
 // CacheProvider defines caching interface for performance optimization
 type CacheProvider interface {
 	// Basic cache operations
@@ -64,6 +108,9 @@ type CacheProvider interface {
 	GetMulti(ctx context.Context, keys []string) (map[string]interface{}, error)
 	DeleteMulti(ctx context.Context, keys []string) error
 	
+	// Atomic counters, the TTL is only applied when the key is created
+	Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	
 	// Cache management
 	FlushAll(ctx context.Context) error
 	Stats(ctx context.Context) (*CacheStats, error)
@@ -87,17 +134,28 @@ type MetricsProvider interface {
 	RecordDatabaseQuery(operation string, duration time.Duration, success bool)
 	RecordCacheOperation(operation string, hit bool, duration time.Duration)
 	
-	// Business metrics
+	// Business metrics, rate limited requests have an empty client ID until
+	// the client has authenticated
+	//
+	// Deprecated: IncrementActiveTokens and DecrementActiveTokens are no
+	// longer called, active tokens are counted in storage periodically and
+	// reported to providers that implement ActiveTokensRecorder.
 	IncrementActiveTokens(clientID string)
 	DecrementActiveTokens(clientID string)
 	RecordRateLimit(clientID string, limited bool)
 	
-	// System metrics
+	// System metrics, memory usage and goroutines are reported periodically
 	RecordMemoryUsage(bytes int64)
 	RecordGoroutineCount(count int)
 	RecordRequestCount(endpoint, method, status string)
 }
 
+// ActiveTokensRecorder is implemented by metrics providers that can report
+// the number of access tokens that have not expired, as counted in storage
+type ActiveTokensRecorder interface {
+	RecordActiveTokens(count int)
+}
+
 // StorageConfig provides configuration for storage backends
 type StorageConfig struct {
 	// Primary storage configuration
@@ -155,6 +213,9 @@ type MonitoringConfig struct {
 	Provider  string `json:"provider"` // "prometheus", "datadog"
 	Namespace string `json:"namespace"`
 	Subsystem string `json:"subsystem"`
+
+	// Provider specific settings, such as the agent address for datadog
+	Config map[string]interface{} `json:"config,omitempty"`
 }
 
 // Factory creates storage instances based on configuration
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"encoding/base64"
+	"sort"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+)
+
+const (
+	// DefaultListLimit is the page size when ListOptions.Limit is not set
+	DefaultListLimit = 100
+
+	// MaxListLimit caps the page size, larger limits are lowered to it
+	MaxListLimit = 1000
+)
+
+// ListOptions selects a page of a listing. Records are ordered by their
+// unique key: clients by key, users by username, scopes by scope and tokens
+// by token.
+type ListOptions struct {
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor string
+
+	// Limit is the maximum number of records on the page
+	Limit int
+}
+
+// TokenFilter narrows ListTokens, zero fields match every token
+type TokenFilter struct {
+	// ClientID and UserID match the IDs of the client and user, not the
+	// client key or username
+	ClientID string
+	UserID   string
+
+	// ExpiresBefore matches tokens that expire before the given time
+	ExpiresBefore time.Time
+}
+
+// ClientPage is a page of ListClients
+type ClientPage struct {
+	Clients []*models.OauthClient
+
+	// NextCursor is empty on the last page
+	NextCursor string
+}
+
+// UserPage is a page of ListUsers
+type UserPage struct {
+	Users      []*models.OauthUser
+	NextCursor string
+}
+
+// ScopePage is a page of ListScopes
+type ScopePage struct {
+	Scopes     []*models.OauthScope
+	NextCursor string
+}
+
+// TokenPage is a page of ListTokens
+type TokenPage struct {
+	Tokens     []*models.OauthAccessToken
+	NextCursor string
+}
+
+// PageSize returns the limit to apply, DefaultListLimit when none was set
+func (o ListOptions) PageSize() int {
+	switch {
+	case o.Limit <= 0:
+		return DefaultListLimit
+	case o.Limit > MaxListLimit:
+		return MaxListLimit
+	default:
+		return o.Limit
+	}
+}
+
+// After returns the key the page starts after, empty for the first page. It
+// returns ErrInvalidCursor when the cursor was not made by EncodeCursor.
+func (o ListOptions) After() (string, error) {
+	if o.Cursor == "" {
+		return "", nil
+	}
+	after, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil || len(after) == 0 {
+		return "", ErrInvalidCursor
+	}
+	return string(after), nil
+}
+
+// EncodeCursor returns the cursor of the page after the record with key
+func EncodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// PageKeys sorts keys and returns the ones on the page options selects with
+// the cursor of the next page, for backends that cannot query keys in order
+func PageKeys(keys []string, options ListOptions) ([]string, string, error) {
+	after, err := options.After()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(keys)
+	if after != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > after }):]
+	}
+
+	limit := options.PageSize()
+	if len(keys) <= limit {
+		return keys, "", nil
+	}
+	return keys[:limit], EncodeCursor(keys[limit-1]), nil
+}
+
+// Matches reports whether token passes the filter at now, expired tokens
+// never do
+func (f TokenFilter) Matches(token *models.OauthAccessToken, now time.Time) bool {
+	if !token.ExpiresAt.After(now) {
+		return false
+	}
+	if f.ClientID != "" && token.ClientID.String != f.ClientID {
+		return false
+	}
+	if f.UserID != "" && token.UserID.String != f.UserID {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !token.ExpiresAt.Before(f.ExpiresBefore) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListOptions(t *testing.T) {
+	assert.Equal(t, DefaultListLimit, ListOptions{}.PageSize())
+	assert.Equal(t, DefaultListLimit, ListOptions{Limit: -1}.PageSize())
+	assert.Equal(t, 10, ListOptions{Limit: 10}.PageSize())
+	assert.Equal(t, MaxListLimit, ListOptions{Limit: MaxListLimit + 1}.PageSize())
+
+	after, err := ListOptions{}.After()
+	require.NoError(t, err)
+	assert.Empty(t, after)
+	after, err = ListOptions{Cursor: EncodeCursor("test_client_1")}.After()
+	require.NoError(t, err)
+	assert.Equal(t, "test_client_1", after)
+	_, err = ListOptions{Cursor: "not a cursor"}.After()
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestPageKeys(t *testing.T) {
+	keys := []string{"d", "b", "e", "a", "c"}
+
+	page, next, err := PageKeys(keys, ListOptions{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, page)
+	page, next, err = PageKeys(keys, ListOptions{Cursor: next, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "d"}, page)
+	page, next, err = PageKeys(keys, ListOptions{Cursor: next, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"e"}, page)
+	assert.Empty(t, next)
+
+	// A full last page has no next page either
+	page, next, err = PageKeys(keys, ListOptions{Limit: 5})
+	require.NoError(t, err)
+	assert.Len(t, page, 5)
+	assert.Empty(t, next)
+}
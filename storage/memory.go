@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+	"maps"
+	"strings"
 	"sync"
 	"time"
 	
@@ -19,6 +21,12 @@ type MemoryStorage struct {
 	refreshTokens map[string]*models.OauthRefreshToken
 	authCodes    map[string]*models.OauthAuthorizationCode
 	scopes       map[string]*models.OauthScope
+
+	// Set when changes are persisted, see OpenMemoryStorage
+	persistence *memoryPersistence
+
+	// Set on the copy of the records a transaction runs on
+	tx *memoryTx
 }
 
 // NewMemoryStorage creates a new in-memory storage instance
@@ -34,11 +42,11 @@ func NewMemoryStorage() Storage {
 	}
 }
 
-// Client operations
+// Client operations, client keys are case insensitive and stored lower case
 func (m *MemoryStorage) GetClient(ctx context.Context, clientID string) (*models.OauthClient, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	if client, exists := m.clients[clientID]; exists {
+	if client, exists := m.clients[strings.ToLower(clientID)]; exists {
 		return client, nil
 	}
 	return nil, ErrClientNotFound
@@ -48,6 +56,10 @@ func (m *MemoryStorage) CreateClient(ctx context.Context, client *models.OauthCl
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	client.CreatedAt = time.Now().UTC()
+	client.Key = strings.ToLower(client.Key)
+	if err := m.record(changeClient, client.Key, client); err != nil {
+		return err
+	}
 	m.clients[client.Key] = client
 	return nil
 }
@@ -55,9 +67,13 @@ func (m *MemoryStorage) CreateClient(ctx context.Context, client *models.OauthCl
 func (m *MemoryStorage) UpdateClient(ctx context.Context, client *models.OauthClient) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	client.Key = strings.ToLower(client.Key)
 	if _, exists := m.clients[client.Key]; !exists {
 		return ErrClientNotFound
 	}
+	if err := m.record(changeClient, client.Key, client); err != nil {
+		return err
+	}
 	m.clients[client.Key] = client
 	return nil
 }
@@ -65,15 +81,22 @@ func (m *MemoryStorage) UpdateClient(ctx context.Context, client *models.OauthCl
 func (m *MemoryStorage) DeleteClient(ctx context.Context, clientID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	clientID = strings.ToLower(clientID)
+	if _, exists := m.clients[clientID]; !exists {
+		return nil
+	}
+	if err := m.record(changeClient, clientID, nil); err != nil {
+		return err
+	}
 	delete(m.clients, clientID)
 	return nil
 }
 
-// User operations
+// User operations, usernames are case insensitive and stored lower case
 func (m *MemoryStorage) GetUser(ctx context.Context, username string) (*models.OauthUser, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	if user, exists := m.users[username]; exists {
+	if user, exists := m.users[strings.ToLower(username)]; exists {
 		return user, nil
 	}
 	return nil, ErrUserNotFound
@@ -92,6 +115,10 @@ func (m *MemoryStorage) CreateUser(ctx context.Context, user *models.OauthUser)
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	user.CreatedAt = time.Now().UTC()
+	user.Username = strings.ToLower(user.Username)
+	if err := m.record(changeUser, user.Username, user); err != nil {
+		return err
+	}
 	m.users[user.Username] = user
 	m.usersByID[user.ID] = user
 	return nil
@@ -123,6 +150,9 @@ func (m *MemoryStorage) StoreAccessToken(ctx context.Context, token *models.Oaut
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	token.CreatedAt = time.Now().UTC()
+	if err := m.record(changeAccessToken, token.Token, token); err != nil {
+		return err
+	}
 	m.accessTokens[token.Token] = token
 	return nil
 }
@@ -142,6 +172,12 @@ func (m *MemoryStorage) GetAccessToken(ctx context.Context, tokenStr string) (*m
 func (m *MemoryStorage) DeleteAccessToken(ctx context.Context, tokenStr string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, exists := m.accessTokens[tokenStr]; !exists {
+		return nil
+	}
+	if err := m.record(changeAccessToken, tokenStr, nil); err != nil {
+		return err
+	}
 	delete(m.accessTokens, tokenStr)
 	return nil
 }
@@ -150,20 +186,68 @@ func (m *MemoryStorage) CleanupExpiredTokens(ctx context.Context) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
+	_, err := m.cleanupExpired(AllIDs, -1)
+	return err
+}
+
+// CleanupExpiredTokensBatch removes up to limit expired tokens and codes
+// with IDs in ids
+func (m *MemoryStorage) CleanupExpiredTokensBatch(ctx context.Context, ids IDRange, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit <= 0 {
+		return 0, nil
+	}
+	return m.cleanupExpired(ids, limit)
+}
+
+// cleanupExpired removes up to limit expired tokens and codes with IDs in
+// ids, all of them when limit is negative. The caller must hold the lock.
+func (m *MemoryStorage) cleanupExpired(ids IDRange, limit int) (int, error) {
 	now := time.Now().UTC()
+	removed := 0
+	full := func() bool { return limit >= 0 && removed >= limit }
+
 	for token, accessToken := range m.accessTokens {
-		if accessToken.ExpiresAt.Before(now) {
+		if full() {
+			return removed, nil
+		}
+		if accessToken.ExpiresAt.Before(now) && ids.Contains(accessToken.ID) {
+			if err := m.record(changeAccessToken, token, nil); err != nil {
+				return removed, err
+			}
 			delete(m.accessTokens, token)
+			removed++
 		}
 	}
-	
+
 	for token, refreshToken := range m.refreshTokens {
-		if refreshToken.ExpiresAt.Before(now) {
+		if full() {
+			return removed, nil
+		}
+		if refreshToken.ExpiresAt.Before(now) && ids.Contains(refreshToken.ID) {
+			if err := m.record(changeRefreshToken, token, nil); err != nil {
+				return removed, err
+			}
 			delete(m.refreshTokens, token)
+			removed++
 		}
 	}
-	
-	return nil
+
+	for code, authCode := range m.authCodes {
+		if full() {
+			return removed, nil
+		}
+		if authCode.ExpiresAt.Before(now) && ids.Contains(authCode.ID) {
+			if err := m.record(changeAuthorizationCode, code, nil); err != nil {
+				return removed, err
+			}
+			delete(m.authCodes, code)
+			removed++
+		}
+	}
+
+	return removed, nil
 }
 
 // Refresh token operations
@@ -171,6 +255,9 @@ func (m *MemoryStorage) StoreRefreshToken(ctx context.Context, token *models.Oau
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	token.CreatedAt = time.Now().UTC()
+	if err := m.record(changeRefreshToken, token.Token, token); err != nil {
+		return err
+	}
 	m.refreshTokens[token.Token] = token
 	return nil
 }
@@ -190,6 +277,12 @@ func (m *MemoryStorage) GetRefreshToken(ctx context.Context, tokenStr string) (*
 func (m *MemoryStorage) DeleteRefreshToken(ctx context.Context, tokenStr string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, exists := m.refreshTokens[tokenStr]; !exists {
+		return nil
+	}
+	if err := m.record(changeRefreshToken, tokenStr, nil); err != nil {
+		return err
+	}
 	delete(m.refreshTokens, tokenStr)
 	return nil
 }
@@ -199,6 +292,9 @@ func (m *MemoryStorage) StoreAuthorizationCode(ctx context.Context, code *models
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	code.CreatedAt = time.Now().UTC()
+	if err := m.record(changeAuthorizationCode, code.Code, code); err != nil {
+		return err
+	}
 	m.authCodes[code.Code] = code
 	return nil
 }
@@ -218,6 +314,12 @@ func (m *MemoryStorage) GetAuthorizationCode(ctx context.Context, codeStr string
 func (m *MemoryStorage) DeleteAuthorizationCode(ctx context.Context, codeStr string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, exists := m.authCodes[codeStr]; !exists {
+		return ErrCodeNotFound
+	}
+	if err := m.record(changeAuthorizationCode, codeStr, nil); err != nil {
+		return err
+	}
 	delete(m.authCodes, codeStr)
 	return nil
 }
@@ -236,6 +338,156 @@ func (m *MemoryStorage) GetDefaultScope(ctx context.Context) (string, error) {
 	return "read", nil // Default scope for development
 }
 
+// ListClients lists clients ordered by key
+func (m *MemoryStorage) ListClients(ctx context.Context, options ListOptions) (*ClientPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.clients))
+	for key := range m.clients {
+		keys = append(keys, key)
+	}
+	keys, next, err := PageKeys(keys, options)
+	if err != nil {
+		return nil, err
+	}
+	page := &ClientPage{Clients: make([]*models.OauthClient, 0, len(keys)), NextCursor: next}
+	for _, key := range keys {
+		page.Clients = append(page.Clients, m.clients[key])
+	}
+	return page, nil
+}
+
+// ListUsers lists users ordered by username
+func (m *MemoryStorage) ListUsers(ctx context.Context, options ListOptions) (*UserPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.users))
+	for key := range m.users {
+		keys = append(keys, key)
+	}
+	keys, next, err := PageKeys(keys, options)
+	if err != nil {
+		return nil, err
+	}
+	page := &UserPage{Users: make([]*models.OauthUser, 0, len(keys)), NextCursor: next}
+	for _, key := range keys {
+		page.Users = append(page.Users, m.users[key])
+	}
+	return page, nil
+}
+
+// ListScopes lists scopes ordered by scope
+func (m *MemoryStorage) ListScopes(ctx context.Context, options ListOptions) (*ScopePage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.scopes))
+	for key := range m.scopes {
+		keys = append(keys, key)
+	}
+	keys, next, err := PageKeys(keys, options)
+	if err != nil {
+		return nil, err
+	}
+	page := &ScopePage{Scopes: make([]*models.OauthScope, 0, len(keys)), NextCursor: next}
+	for _, key := range keys {
+		page.Scopes = append(page.Scopes, m.scopes[key])
+	}
+	return page, nil
+}
+
+// ListTokens lists the access tokens matching filter ordered by token
+func (m *MemoryStorage) ListTokens(ctx context.Context, filter TokenFilter, options ListOptions) (*TokenPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	var keys []string
+	for key, token := range m.accessTokens {
+		if filter.Matches(token, now) {
+			keys = append(keys, key)
+		}
+	}
+	keys, next, err := PageKeys(keys, options)
+	if err != nil {
+		return nil, err
+	}
+	page := &TokenPage{Tokens: make([]*models.OauthAccessToken, 0, len(keys)), NextCursor: next}
+	for _, key := range keys {
+		page.Tokens = append(page.Tokens, m.accessTokens[key])
+	}
+	return page, nil
+}
+
+// CountActiveTokens counts the access tokens that have not expired
+func (m *MemoryStorage) CountActiveTokens(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	count := 0
+	for _, token := range m.accessTokens {
+		if token.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RevokeUserTokens deletes everything issued to the user with userID
+func (m *MemoryStorage) RevokeUserTokens(ctx context.Context, userID string) (*RevokeResult, error) {
+	return m.revoke(userID, func(clientID, tokenUserID, scope string) bool { return tokenUserID == userID })
+}
+
+// RevokeClientTokens deletes everything issued to the client with clientID
+func (m *MemoryStorage) RevokeClientTokens(ctx context.Context, clientID string) (*RevokeResult, error) {
+	return m.revoke(clientID, func(tokenClientID, userID, scope string) bool { return tokenClientID == clientID })
+}
+
+// RevokeTokensWithScope deletes everything granted scope
+func (m *MemoryStorage) RevokeTokensWithScope(ctx context.Context, scope string) (*RevokeResult, error) {
+	return m.revoke(scope, func(clientID, userID, granted string) bool { return HasScope(granted, scope) })
+}
+
+// revoke deletes the tokens and codes match selects by their client ID,
+// user ID and scope, nothing is deleted for an empty value
+func (m *MemoryStorage) revoke(value string, match func(clientID, userID, scope string) bool) (*RevokeResult, error) {
+	result := new(RevokeResult)
+	if value == "" {
+		return result, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, token := range m.accessTokens {
+		if match(token.ClientID.String, token.UserID.String, token.Scope) {
+			if err := m.record(changeAccessToken, key, nil); err != nil {
+				return result, err
+			}
+			delete(m.accessTokens, key)
+			result.AccessTokens++
+			result.Tokens = append(result.Tokens, key)
+		}
+	}
+	for key, token := range m.refreshTokens {
+		if match(token.ClientID.String, token.UserID.String, token.Scope) {
+			if err := m.record(changeRefreshToken, key, nil); err != nil {
+				return result, err
+			}
+			delete(m.refreshTokens, key)
+			result.RefreshTokens++
+			result.RefreshTokenValues = append(result.RefreshTokenValues, key)
+		}
+	}
+	for key, code := range m.authCodes {
+		if match(code.ClientID.String, code.UserID.String, code.Scope) {
+			if err := m.record(changeAuthorizationCode, key, nil); err != nil {
+				return result, err
+			}
+			delete(m.authCodes, key)
+			result.AuthorizationCodes++
+		}
+	}
+	return result, nil
+}
+
 // Batch operations (simplified stubs)
 func (m *MemoryStorage) BatchGetTokens(ctx context.Context, tokens []string) ([]*models.OauthAccessToken, error) {
 	var result []*models.OauthAccessToken
@@ -249,18 +501,65 @@ func (m *MemoryStorage) BatchGetTokens(ctx context.Context, tokens []string) ([]
 
 func (m *MemoryStorage) BatchDeleteTokens(ctx context.Context, tokens []string) error {
 	for _, token := range tokens {
-		m.DeleteAccessToken(ctx, token)
+		if err := m.DeleteAccessToken(ctx, token); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// WithTx runs fn on a copy of the records and swaps it in when fn succeeds,
+// other callers wait until the transaction is over. Copying makes every
+// transaction linear in the number of records, which suits the development
+// and test use this backend is meant for.
+func (m *MemoryStorage) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &MemoryStorage{
+		clients:       maps.Clone(m.clients),
+		users:         maps.Clone(m.users),
+		usersByID:     maps.Clone(m.usersByID),
+		accessTokens:  maps.Clone(m.accessTokens),
+		refreshTokens: maps.Clone(m.refreshTokens),
+		authCodes:     maps.Clone(m.authCodes),
+		scopes:        maps.Clone(m.scopes),
+		tx:            new(memoryTx),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	// The changes are logged at once before they are applied, like those of
+	// a single operation
+	if err := m.commit(tx.tx); err != nil {
+		return err
+	}
+	m.clients = tx.clients
+	m.users = tx.users
+	m.usersByID = tx.usersByID
+	m.accessTokens = tx.accessTokens
+	m.refreshTokens = tx.refreshTokens
+	m.authCodes = tx.authCodes
+	m.scopes = tx.scopes
+	return nil
+}
+
 // Health check
 func (m *MemoryStorage) HealthCheck(ctx context.Context) error {
 	return nil // Always healthy for memory storage
 }
 
-// Close
+// Close writes a final snapshot when changes are persisted
 func (m *MemoryStorage) Close() error {
+	if err := m.closePersistence(); err != nil {
+		return err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
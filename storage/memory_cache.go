@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMemoryCacheSize is the number of entries kept when no max_size
+	// is configured
+	DefaultMemoryCacheSize = 10000
+
+	// DefaultCleanupInterval is how often expired entries are swept
+	DefaultCleanupInterval = time.Minute
+)
+
+// MemoryCacheConfig defines in-memory cache configuration
+type MemoryCacheConfig struct {
+	// Maximum number of entries, the least recently used entry is evicted
+	// to make room for a new one
+	MaxSize int `json:"max_size"`
+
+	// How often the janitor removes expired entries, entries are never
+	// returned once expired whether or not they have been swept
+	CleanupInterval time.Duration `json:"cleanup_interval"`
+}
+
+// MemoryCache is a bounded LRU cache safe for concurrent use. Values are
+// stored as JSON, so they decode into dest exactly as they would with Redis
+// and later changes to the cached value are not seen by readers.
+type MemoryCache struct {
+	mu      sync.Mutex
+	maxSize int
+	items   map[string]*list.Element
+	lru     *list.List // front is the most recently used entry
+	memory  int64
+	hits    int64
+	misses  int64
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryCacheEntry struct {
+	key       string
+	data      []byte
+	expiresAt time.Time // zero means the entry never expires
+}
+
+func (e *memoryCacheEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+func (e *memoryCacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.data))
+}
+
+// NewMemoryCache creates an in-memory cache from a CacheConfig.Config map
+// and starts its expiry janitor, Close stops it
+func NewMemoryCache(config map[string]interface{}) (*MemoryCache, error) {
+	cnf := &MemoryCacheConfig{
+		MaxSize:         DefaultMemoryCacheSize,
+		CleanupInterval: DefaultCleanupInterval,
+	}
+	if err := DecodeConfig(config, cnf); err != nil {
+		return nil, fmt.Errorf("invalid memory cache config: %w", err)
+	}
+	if cnf.MaxSize <= 0 {
+		return nil, fmt.Errorf("invalid memory cache config: max_size must be positive")
+	}
+
+	m := &MemoryCache{
+		maxSize: cnf.MaxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		stop:    make(chan struct{}),
+	}
+	if cnf.CleanupInterval > 0 {
+		go m.janitor(cnf.CleanupInterval)
+	}
+	return m, nil
+}
+
+// Set stores a value in cache with TTL, a TTL of zero never expires
+func (m *MemoryCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, data, ttl)
+	return nil
+}
+
+// Get decodes a cached value into dest, it returns ErrCacheMiss for missing
+// and expired keys
+func (m *MemoryCache) Get(ctx context.Context, key string, dest interface{}) error {
+	m.mu.Lock()
+	entry := m.lookup(key, time.Now())
+	if entry == nil {
+		m.misses++
+		m.mu.Unlock()
+		return ErrCacheMiss
+	}
+	m.hits++
+	data := entry.data
+	m.mu.Unlock()
+
+	if err := json.Unmarshal(data, dest); err != nil {
+		return fmt.Errorf("failed to unmarshal value: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a value from cache
+func (m *MemoryCache) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, exists := m.items[key]; exists {
+		m.remove(element)
+	}
+	return nil
+}
+
+// SetMulti stores multiple values in cache with TTL
+func (m *MemoryCache) SetMulti(ctx context.Context, items map[string]interface{}, ttl time.Duration) error {
+	encoded := make(map[string][]byte, len(items))
+	for key, value := range items {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal value for key %s: %w", key, err)
+		}
+		encoded[key] = data
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, data := range encoded {
+		m.set(key, data, ttl)
+	}
+	return nil
+}
+
+// GetMulti retrieves multiple values decoded as generic JSON values, missing
+// and expired keys are left out of the result
+func (m *MemoryCache) GetMulti(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	found := make(map[string][]byte, len(keys))
+
+	m.mu.Lock()
+	now := time.Now()
+	for _, key := range keys {
+		if entry := m.lookup(key, now); entry != nil {
+			m.hits++
+			found[key] = entry.data
+		} else {
+			m.misses++
+		}
+	}
+	m.mu.Unlock()
+
+	result := make(map[string]interface{}, len(found))
+	for key, data := range found {
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err == nil {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// TTLs returns the time left of each key found, zero for keys that never
+// expire
+func (m *MemoryCache) TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	ttls := make(map[string]time.Duration, len(keys))
+	for _, key := range keys {
+		element, exists := m.items[key]
+		if !exists {
+			continue
+		}
+		entry := element.Value.(*memoryCacheEntry)
+		switch {
+		case entry.expiresAt.IsZero():
+			ttls[key] = 0
+		case !entry.expired(now):
+			ttls[key] = entry.expiresAt.Sub(now)
+		}
+	}
+	return ttls, nil
+}
+
+// DeleteMulti removes multiple values from cache
+func (m *MemoryCache) DeleteMulti(ctx context.Context, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		if element, exists := m.items[key]; exists {
+			m.remove(element)
+		}
+	}
+	return nil
+}
+
+// Increment atomically adds delta to a counter, creating it with the given TTL
+func (m *MemoryCache) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key, time.Now())
+	if entry == nil {
+		// Like Redis INCRBY on a missing key, start from zero
+		m.set(key, []byte(strconv.FormatInt(delta, 10)), ttl)
+		return delta, nil
+	}
+
+	value, err := strconv.ParseInt(string(entry.data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value is not an integer")
+	}
+	value += delta
+
+	m.memory -= entry.size()
+	entry.data = []byte(strconv.FormatInt(value, 10))
+	m.memory += entry.size()
+	return value, nil
+}
+
+// FlushAll clears all cache entries, the hit and miss counters are kept
+func (m *MemoryCache) FlushAll(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = make(map[string]*list.Element)
+	m.lru.Init()
+	m.memory = 0
+	return nil
+}
+
+// Stats returns cache statistics, Memory counts the bytes of keys and
+// encoded values
+func (m *MemoryCache) Stats(ctx context.Context) (*CacheStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := &CacheStats{
+		Hits:   m.hits,
+		Misses: m.misses,
+		Keys:   int64(len(m.items)),
+		Memory: m.memory,
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+	return stats, nil
+}
+
+// Close stops the janitor and drops all entries
+func (m *MemoryCache) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	return m.FlushAll(context.Background())
+}
+
+// DeleteExpired removes all expired entries and returns how many were removed
+func (m *MemoryCache) DeleteExpired() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for element := m.lru.Back(); element != nil; {
+		previous := element.Prev()
+		if element.Value.(*memoryCacheEntry).expired(now) {
+			m.remove(element)
+			removed++
+		}
+		element = previous
+	}
+	return removed
+}
+
+func (m *MemoryCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.DeleteExpired()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// set stores data under key and evicts the least recently used entries
+// while the cache is over its size, the caller must hold the lock
+func (m *MemoryCache) set(key string, data []byte, ttl time.Duration) {
+	if element, exists := m.items[key]; exists {
+		m.remove(element)
+	}
+	if ttl < 0 {
+		// Already expired, there is nothing to keep
+		return
+	}
+
+	entry := &memoryCacheEntry{key: key, data: data}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	m.items[key] = m.lru.PushFront(entry)
+	m.memory += entry.size()
+
+	for m.lru.Len() > m.maxSize {
+		m.remove(m.lru.Back())
+	}
+}
+
+// lookup returns the live entry under key and marks it as recently used,
+// expired entries are removed, the caller must hold the lock
+func (m *MemoryCache) lookup(key string, now time.Time) *memoryCacheEntry {
+	element, exists := m.items[key]
+	if !exists {
+		return nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if entry.expired(now) {
+		m.remove(element)
+		return nil
+	}
+	m.lru.MoveToFront(element)
+	return entry
+}
+
+// remove drops an entry, the caller must hold the lock
+func (m *MemoryCache) remove(element *list.Element) {
+	entry := m.lru.Remove(element).(*memoryCacheEntry)
+	delete(m.items, entry.key)
+	m.memory -= entry.size()
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCacheGet(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewMemoryCache(nil)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	type item struct {
+		Name  string
+		Count int
+	}
+	value := &item{Name: "foo", Count: 1}
+	require.NoError(t, cache.Set(ctx, "item", value, time.Minute))
+
+	// Changing the original does not change the cached copy
+	value.Count = 2
+
+	cached := new(item)
+	require.NoError(t, cache.Get(ctx, "item", cached))
+	assert.Equal(t, &item{Name: "foo", Count: 1}, cached)
+
+	err = cache.Get(ctx, "bogus", cached)
+	assert.Equal(t, ErrCacheMiss, err)
+
+	// Expired entries are misses even before the janitor runs
+	require.NoError(t, cache.Set(ctx, "expired", "bar", time.Nanosecond))
+	time.Sleep(time.Millisecond)
+	var s string
+	assert.Equal(t, ErrCacheMiss, cache.Get(ctx, "expired", &s))
+
+	values, err := cache.GetMulti(ctx, []string{"item", "bogus"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"item": map[string]interface{}{"Name": "foo", "Count": float64(1)},
+	}, values)
+
+	stats, err := cache.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, int64(1), stats.Keys)
+	assert.Equal(t, int64(len("item")+len(`{"Name":"foo","Count":1}`)), stats.Memory)
+	assert.InDelta(t, 0.4, stats.HitRatio, 0.001)
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewMemoryCache(map[string]interface{}{"max_size": 3})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, cache.Set(ctx, key, key, time.Minute))
+	}
+
+	// Reading a makes b the least recently used entry
+	var s string
+	require.NoError(t, cache.Get(ctx, "a", &s))
+	require.NoError(t, cache.Set(ctx, "d", "d", time.Minute))
+
+	assert.Equal(t, ErrCacheMiss, cache.Get(ctx, "b", &s))
+	for _, key := range []string{"a", "c", "d"} {
+		assert.NoError(t, cache.Get(ctx, key, &s), key)
+	}
+
+	stats, err := cache.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Keys)
+	assert.Equal(t, int64(3*len(`a"a"`)), stats.Memory)
+
+	_, err = NewMemoryCache(map[string]interface{}{"max_size": -1})
+	assert.Error(t, err)
+}
+
+func TestMemoryCacheJanitor(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewMemoryCache(map[string]interface{}{"cleanup_interval": "5ms"})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	require.NoError(t, cache.Set(ctx, "expiring", "foo", 10*time.Millisecond))
+	require.NoError(t, cache.Set(ctx, "forever", "bar", 0))
+
+	assert.Eventually(t, func() bool {
+		stats, err := cache.Stats(ctx)
+		return err == nil && stats.Keys == 1
+	}, time.Second, 5*time.Millisecond)
+
+	var s string
+	require.NoError(t, cache.Get(ctx, "forever", &s))
+	assert.Equal(t, "bar", s)
+}
+
+func TestMemoryCacheConcurrency(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewMemoryCache(map[string]interface{}{"max_size": 50})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key-%d", (i*100+j)%80)
+				cache.Set(ctx, key, j, time.Minute)
+				var n int
+				cache.Get(ctx, key, &n)
+				cache.GetMulti(ctx, []string{key})
+				if j%10 == 0 {
+					cache.Delete(ctx, key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats, err := cache.Stats(ctx)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, stats.Keys, int64(50))
+	assert.Equal(t, int64(20*100*2), stats.Hits+stats.Misses)
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+)
+
+// DefaultSnapshotInterval is how often persistent memory storage writes a
+// snapshot and starts a new change log
+const DefaultSnapshotInterval = 5 * time.Minute
+
+// MemoryStorageConfig defines in-memory storage configuration
+type MemoryStorageConfig struct {
+	// Snapshot file, changes made since the last snapshot are appended to a
+	// log next to it with a .log suffix. Nothing is persisted when empty.
+	Path string `json:"path"`
+
+	// How often a snapshot is written, the change log is emptied each time
+	SnapshotInterval time.Duration `json:"snapshot_interval"`
+}
+
+// Kinds of records in the change log
+const (
+	changeClient            = "client"
+	changeUser              = "user"
+	changeAccessToken       = "access_token"
+	changeRefreshToken      = "refresh_token"
+	changeAuthorizationCode = "authorization_code"
+)
+
+// memoryChange is a line of the change log, a change without a value
+// deletes the record
+type memoryChange struct {
+	Kind  string          `json:"kind"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// memorySnapshot is the content of a snapshot file
+type memorySnapshot struct {
+	Clients       map[string]*models.OauthClient            `json:"clients"`
+	Users         map[string]*models.OauthUser              `json:"users"`
+	AccessTokens  map[string]*models.OauthAccessToken       `json:"access_tokens"`
+	RefreshTokens map[string]*models.OauthRefreshToken      `json:"refresh_tokens"`
+	AuthCodes     map[string]*models.OauthAuthorizationCode `json:"authorization_codes"`
+	Scopes        map[string]*models.OauthScope             `json:"scopes"`
+}
+
+// memoryPersistence holds the files of persistent memory storage
+type memoryPersistence struct {
+	path      string
+	log       *os.File
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// OpenMemoryStorage creates in-memory storage from a StorageBackend.Config
+// map. With a path it restores the last snapshot and replays the change log
+// written after it, then logs every change and snapshots periodically until
+// Close writes a final snapshot. Changes reach the operating system before
+// they are applied, so they survive the process crashing but not the
+// machine losing power before a snapshot.
+func OpenMemoryStorage(config map[string]interface{}) (*MemoryStorage, error) {
+	cnf := &MemoryStorageConfig{SnapshotInterval: DefaultSnapshotInterval}
+	if err := DecodeConfig(config, cnf); err != nil {
+		return nil, fmt.Errorf("invalid memory storage config: %w", err)
+	}
+
+	m := NewMemoryStorage().(*MemoryStorage)
+	if cnf.Path == "" {
+		return m, nil
+	}
+
+	if err := m.restore(cnf.Path); err != nil {
+		return nil, err
+	}
+	p := &memoryPersistence{path: cnf.Path, stop: make(chan struct{})}
+
+	// A fresh snapshot also drops a change cut short by a crash, which
+	// would corrupt the next one appended after it
+	if err := writeSnapshot(cnf.Path, m.snapshot()); err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(cnf.Path+".log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open change log: %w", err)
+	}
+	p.log = log
+	m.persistence = p
+
+	if cnf.SnapshotInterval > 0 {
+		p.wg.Add(1)
+		go m.snapshotter(cnf.SnapshotInterval)
+	}
+	return m, nil
+}
+
+// Snapshot writes all records to the snapshot file and empties the change
+// log, it does nothing when the storage is not persistent
+func (m *MemoryStorage) Snapshot() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.writeSnapshot()
+}
+
+// writeSnapshot snapshots the records, the caller must hold the lock
+func (m *MemoryStorage) writeSnapshot() error {
+	if m.persistence == nil {
+		return nil
+	}
+	if err := writeSnapshot(m.persistence.path, m.snapshot()); err != nil {
+		return err
+	}
+	// The log is opened for appending, so writes continue from the start
+	if err := m.persistence.log.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate change log: %w", err)
+	}
+	return nil
+}
+
+// closePersistence stops the snapshotter and writes a final snapshot, the
+// caller must not hold the lock
+func (m *MemoryStorage) closePersistence() error {
+	p := m.persistence
+	if p == nil {
+		return nil
+	}
+
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		err = m.writeSnapshot()
+		if closeErr := p.log.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+func (m *MemoryStorage) snapshotter(interval time.Duration) {
+	defer m.persistence.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A failed snapshot leaves the log in place, nothing is lost
+			m.Snapshot()
+		case <-m.persistence.stop:
+			return
+		}
+	}
+}
+
+// memoryTx collects the changes of a transaction until it commits
+type memoryTx struct {
+	log []byte
+}
+
+// record appends a change to the log before it is applied, a nil value
+// records a delete. The caller must hold the lock.
+func (m *MemoryStorage) record(kind, key string, value interface{}) error {
+	if m.persistence == nil && m.tx == nil {
+		return nil
+	}
+
+	change := memoryChange{Kind: kind, Key: key}
+	if value != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", kind, err)
+		}
+		change.Value = data
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("failed to marshal change: %w", err)
+	}
+	if m.tx != nil {
+		m.tx.log = append(append(m.tx.log, line...), '\n')
+		return nil
+	}
+	if _, err := m.persistence.log.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write change log: %w", err)
+	}
+	return nil
+}
+
+// commit appends the changes of a transaction to the log in a single write,
+// the caller must hold the lock
+func (m *MemoryStorage) commit(tx *memoryTx) error {
+	if m.persistence == nil || len(tx.log) == 0 {
+		return nil
+	}
+	if _, err := m.persistence.log.Write(tx.log); err != nil {
+		return fmt.Errorf("failed to write change log: %w", err)
+	}
+	return nil
+}
+
+// snapshot returns the records to persist, the caller must hold the lock
+func (m *MemoryStorage) snapshot() *memorySnapshot {
+	return &memorySnapshot{
+		Clients:       m.clients,
+		Users:         m.users,
+		AccessTokens:  m.accessTokens,
+		RefreshTokens: m.refreshTokens,
+		AuthCodes:     m.authCodes,
+		Scopes:        m.scopes,
+	}
+}
+
+// restore loads the snapshot at path and replays the change log after it
+func (m *MemoryStorage) restore(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if err == nil {
+		snapshot := new(memorySnapshot)
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return fmt.Errorf("failed to decode snapshot %s: %w", path, err)
+		}
+		for key, client := range snapshot.Clients {
+			m.clients[key] = client
+		}
+		for key, user := range snapshot.Users {
+			m.users[key] = user
+			m.usersByID[user.ID] = user
+		}
+		for key, token := range snapshot.AccessTokens {
+			m.accessTokens[key] = token
+		}
+		for key, token := range snapshot.RefreshTokens {
+			m.refreshTokens[key] = token
+		}
+		for key, code := range snapshot.AuthCodes {
+			m.authCodes[key] = code
+		}
+		for key, scope := range snapshot.Scopes {
+			m.scopes[key] = scope
+		}
+	}
+
+	data, err = os.ReadFile(path + ".log")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read change log: %w", err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	// The last line is empty, or a change cut short by a crash that was
+	// never applied
+	for i, line := range lines[:len(lines)-1] {
+		change := new(memoryChange)
+		if err := json.Unmarshal(line, change); err != nil {
+			return fmt.Errorf("failed to decode change log line %d: %w", i+1, err)
+		}
+		if err := m.apply(change); err != nil {
+			return fmt.Errorf("failed to replay change log line %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// apply replays a change from the log
+func (m *MemoryStorage) apply(change *memoryChange) error {
+	deleted := len(change.Value) == 0
+	switch change.Kind {
+	case changeClient:
+		delete(m.clients, change.Key)
+		if !deleted {
+			client := new(models.OauthClient)
+			if err := json.Unmarshal(change.Value, client); err != nil {
+				return err
+			}
+			m.clients[change.Key] = client
+		}
+	case changeUser:
+		if user, exists := m.users[change.Key]; exists {
+			delete(m.usersByID, user.ID)
+			delete(m.users, change.Key)
+		}
+		if !deleted {
+			user := new(models.OauthUser)
+			if err := json.Unmarshal(change.Value, user); err != nil {
+				return err
+			}
+			m.users[change.Key] = user
+			m.usersByID[user.ID] = user
+		}
+	case changeAccessToken:
+		delete(m.accessTokens, change.Key)
+		if !deleted {
+			token := new(models.OauthAccessToken)
+			if err := json.Unmarshal(change.Value, token); err != nil {
+				return err
+			}
+			m.accessTokens[change.Key] = token
+		}
+	case changeRefreshToken:
+		delete(m.refreshTokens, change.Key)
+		if !deleted {
+			token := new(models.OauthRefreshToken)
+			if err := json.Unmarshal(change.Value, token); err != nil {
+				return err
+			}
+			m.refreshTokens[change.Key] = token
+		}
+	case changeAuthorizationCode:
+		delete(m.authCodes, change.Key)
+		if !deleted {
+			code := new(models.OauthAuthorizationCode)
+			if err := json.Unmarshal(change.Value, code); err != nil {
+				return err
+			}
+			m.authCodes[change.Key] = code
+		}
+	default:
+		return fmt.Errorf("unknown record kind %q", change.Kind)
+	}
+	return nil
+}
+
+// writeSnapshot replaces the snapshot at path, a crash leaves either the old
+// or the new snapshot in place
+func writeSnapshot(path string, snapshot *memorySnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
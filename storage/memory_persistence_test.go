@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestMemoryStorage(t *testing.T, path string) *MemoryStorage {
+	m, err := OpenMemoryStorage(map[string]interface{}{"path": path, "snapshot_interval": 0})
+	require.NoError(t, err)
+	return m
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestMemoryStoragePersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "oauth2.json")
+
+	m := openTestMemoryStorage(t, path)
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1", Secret: "secret"}
+	require.NoError(t, m.CreateClient(ctx, client))
+	require.NoError(t, m.CreateUser(ctx, &models.OauthUser{MyGormModel: models.MyGormModel{ID: "1"}, Username: "test@user"}))
+	kept := models.NewOauthAccessToken(client, nil, 3600, "read")
+	require.NoError(t, m.StoreAccessToken(ctx, kept))
+	revoked := models.NewOauthAccessToken(client, nil, 3600, "read")
+	require.NoError(t, m.StoreAccessToken(ctx, revoked))
+	require.NoError(t, m.DeleteAccessToken(ctx, revoked.Token))
+	assert.Greater(t, fileSize(t, path+".log"), int64(0))
+
+	// Without Close, as after a crash, the changes are replayed from the log
+	restored := openTestMemoryStorage(t, path)
+	_, err := restored.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	user, err := restored.GetUserByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "test@user", user.Username)
+	found, err := restored.GetAccessToken(ctx, kept.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "1", found.ClientID.String)
+	_, err = restored.GetAccessToken(ctx, revoked.Token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Restoring compacts the log into a snapshot
+	assert.Equal(t, int64(0), fileSize(t, path+".log"))
+
+	// Close writes a final snapshot
+	require.NoError(t, restored.DeleteClient(ctx, "test_client_1"))
+	require.NoError(t, restored.Close())
+	assert.NoError(t, restored.Close())
+	assert.Equal(t, int64(0), fileSize(t, path+".log"))
+
+	restored = openTestMemoryStorage(t, path)
+	defer restored.Close()
+	_, err = restored.GetClient(ctx, "test_client_1")
+	assert.Equal(t, ErrClientNotFound, err)
+	_, err = restored.GetUser(ctx, "test@user")
+	assert.NoError(t, err)
+}
+
+func TestMemoryStorageChangeLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "oauth2.json")
+
+	m := openTestMemoryStorage(t, path)
+	require.NoError(t, m.CreateClient(ctx, &models.OauthClient{Key: "test_client_1"}))
+
+	// A change cut short by a crash is dropped
+	log, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = log.WriteString(`{"kind":"client","key":"test_cl`)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	restored := openTestMemoryStorage(t, path)
+	_, err = restored.GetClient(ctx, "test_client_1")
+	assert.NoError(t, err)
+	require.NoError(t, restored.CreateClient(ctx, &models.OauthClient{Key: "test_client_2"}))
+
+	// Anything else that cannot be read is an error
+	require.NoError(t, os.WriteFile(path+".log", []byte("bogus\n"), 0600))
+	_, err = OpenMemoryStorage(map[string]interface{}{"path": path})
+	assert.EqualError(t, err, "failed to decode change log line 1: invalid character 'b' looking for beginning of value")
+}
+
+func TestMemoryStorageSnapshots(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "oauth2.json")
+
+	m, err := OpenMemoryStorage(map[string]interface{}{"path": path, "snapshot_interval": "10ms"})
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.NoError(t, m.CreateClient(ctx, &models.OauthClient{Key: "test_client_1"}))
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		if err != nil || !bytes.Contains(data, []byte("test_client_1")) {
+			return false
+		}
+		info, err := os.Stat(path + ".log")
+		return err == nil && info.Size() == 0
+	}, time.Second, 5*time.Millisecond)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestMemoryStorageTransactionLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "oauth2.json")
+
+	m := openTestMemoryStorage(t, path)
+	require.NoError(t, m.WithTx(ctx, func(tx Storage) error {
+		return tx.CreateClient(ctx, &models.OauthClient{Key: "test_client_1"})
+	}))
+
+	// Nothing a rolled back transaction wrote reaches the log
+	size := fileSize(t, path+".log")
+	assert.Greater(t, size, int64(0))
+	assert.Equal(t, ErrClientNotFound, m.WithTx(ctx, func(tx Storage) error {
+		require.NoError(t, tx.CreateClient(ctx, &models.OauthClient{Key: "test_client_2"}))
+		return ErrClientNotFound
+	}))
+	assert.Equal(t, size, fileSize(t, path+".log"))
+
+	restored := openTestMemoryStorage(t, path)
+	defer restored.Close()
+	_, err := restored.GetClient(ctx, "test_client_1")
+	assert.NoError(t, err)
+	_, err = restored.GetClient(ctx, "test_client_2")
+	assert.Equal(t, ErrClientNotFound, err)
+}
@@ -0,0 +1,204 @@
+// Package mysql provides MySQL and MariaDB storage implementation
+package mysql
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/config"
+	"github.com/RichardKnop/go-oauth2-server/database"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/sqlstore"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+)
+
+func init() {
+	storage.RegisterBackend("mysql", Open)
+	database.RegisterType("mysql", openDatabase)
+}
+
+// MySQLStorage implements storage on MySQL or MariaDB
+type MySQLStorage struct {
+	*sqlstore.Store
+	config *MySQLConfig
+}
+
+// MySQLConfig defines MySQL-specific configuration
+type MySQLConfig struct {
+	// Connection settings, a connection string takes precedence over the
+	// individual settings and uses the user:pass@tcp(host:port)/dbname format
+	ConnectionString string `json:"connection_string"`
+	Host             string `json:"host"`
+	Port             int    `json:"port"`
+	Database         string `json:"database"`
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+
+	// Performance settings
+	MaxOpenConnections int           `json:"max_open_connections"`
+	MaxIdleConnections int           `json:"max_idle_connections"`
+	ConnMaxLifetime    time.Duration `json:"connection_max_lifetime"`
+
+	// I/O timeouts
+	DialTimeout  time.Duration `json:"dial_timeout"`
+	ReadTimeout  time.Duration `json:"read_timeout"`
+	WriteTimeout time.Duration `json:"write_timeout"`
+
+	// Run the schema migrations when connecting
+	AutoMigrate bool `json:"auto_migrate"`
+}
+
+// ParseConfig reads a MySQLConfig from a StorageBackend.Config map
+func ParseConfig(config map[string]interface{}) (*MySQLConfig, error) {
+	cnf := &MySQLConfig{
+		Port:               3306,
+		MaxOpenConnections: 100,
+		MaxIdleConnections: 25,
+		ConnMaxLifetime:    5 * time.Minute,
+	}
+	if err := storage.DecodeConfig(config, cnf); err != nil {
+		return nil, fmt.Errorf("invalid mysql config: %w", err)
+	}
+	if cnf.ConnectionString == "" && cnf.Host == "" {
+		return nil, fmt.Errorf("invalid mysql config: connection_string or host is required")
+	}
+	return cnf, nil
+}
+
+// DSN returns the data source name passed to the driver. Times are always
+// parsed and stored as UTC, whatever the connection string says.
+func (c *MySQLConfig) DSN() (string, error) {
+	dsn := driver.NewConfig()
+	if c.ConnectionString != "" {
+		var err error
+		if dsn, err = driver.ParseDSN(c.ConnectionString); err != nil {
+			return "", fmt.Errorf("invalid connection string: %w", err)
+		}
+	} else {
+		dsn.User = c.Username
+		dsn.Passwd = c.Password
+		dsn.Net = "tcp"
+		dsn.Addr = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+		dsn.DBName = c.Database
+	}
+
+	dsn.ParseTime = true
+	dsn.Loc = time.UTC
+	if c.DialTimeout > 0 {
+		dsn.Timeout = c.DialTimeout
+	}
+	if c.ReadTimeout > 0 {
+		dsn.ReadTimeout = c.ReadTimeout
+	}
+	if c.WriteTimeout > 0 {
+		dsn.WriteTimeout = c.WriteTimeout
+	}
+
+	return dsn.FormatDSN(), nil
+}
+
+// Open creates MySQL storage from a StorageBackend.Config map, it is
+// registered with the storage factory as the "mysql" backend
+func Open(config map[string]interface{}) (storage.Storage, error) {
+	cnf, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewMySQLStorage(cnf, nil, nil)
+}
+
+// NewMySQLStorage creates a new MySQL storage instance
+func NewMySQLStorage(config *MySQLConfig, cache storage.CacheProvider, metrics storage.MetricsProvider) (*MySQLStorage, error) {
+	dsn, err := config.DSN()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+
+	// Configure connection pool, the lifetime should stay below the
+	// server's wait_timeout so no connection is closed under our feet
+	db.DB().SetMaxOpenConns(config.MaxOpenConnections)
+	db.DB().SetMaxIdleConns(config.MaxIdleConnections)
+	db.DB().SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.LogMode(false)
+
+	if config.AutoMigrate {
+		if err := models.MigrateAll(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate MySQL: %w", err)
+		}
+	}
+
+	store := sqlstore.New(db, cache, metrics)
+	store.SetRetryable(isRetryable)
+	store.SetUnavailable(isUnavailable)
+	return &MySQLStorage{
+		Store:  store,
+		config: config,
+	}, nil
+}
+
+// isRetryable reports deadlocks, InnoDB rolled the transaction back and it
+// can be run again
+func isRetryable(err error) bool {
+	var mysqlErr *driver.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1213
+}
+
+// isUnavailable reports broken connections, too many connections, a server
+// shutting down and queries that ran past max_execution_time
+func isUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrInvalidConn) {
+		return true
+	}
+	var mysqlErr *driver.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1040, 1053, 3024:
+		return true
+	}
+	return false
+}
+
+// openDatabase opens the "mysql" database type of database.NewDatabase
+func openDatabase(cnf *config.Config) (*gorm.DB, error) {
+	// Times are parsed and stored as UTC
+	args, err := (&MySQLConfig{
+		Host:     cnf.Database.Host,
+		Port:     cnf.Database.Port,
+		Username: cnf.Database.User,
+		Password: cnf.Database.Password,
+		Database: cnf.Database.DatabaseName,
+	}).DSN()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open("mysql", args)
+	if err != nil {
+		return db, err
+	}
+
+	// Max idle connections
+	db.DB().SetMaxIdleConns(cnf.Database.MaxIdleConns)
+
+	// Max open connections
+	db.DB().SetMaxOpenConns(cnf.Database.MaxOpenConns)
+
+	// Database logging
+	db.LogMode(cnf.IsDevelopment)
+
+	return db, nil
+}
@@ -0,0 +1,80 @@
+package mysql_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/mysql"
+	"github.com/RichardKnop/go-oauth2-server/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	_, err := mysql.ParseConfig(map[string]interface{}{})
+	assert.EqualError(t, err, "invalid mysql config: connection_string or host is required")
+
+	cnf, err := mysql.ParseConfig(map[string]interface{}{
+		"host":         "localhost",
+		"username":     "go_oauth2_server",
+		"password":     "secret",
+		"database":     "go_oauth2_server",
+		"dial_timeout": "3s",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3306, cnf.Port)
+	assert.Equal(t, 5*time.Minute, cnf.ConnMaxLifetime)
+
+	dsn, err := cnf.DSN()
+	require.NoError(t, err)
+	assert.Equal(t, "go_oauth2_server:secret@tcp(localhost:3306)/go_oauth2_server?parseTime=true&timeout=3s", dsn)
+}
+
+func TestDSNConnectionString(t *testing.T) {
+	// Times are always parsed as UTC
+	cnf := &mysql.MySQLConfig{ConnectionString: "user:pass@tcp(db:3306)/oauth2?loc=Local&charset=utf8mb4"}
+	dsn, err := cnf.DSN()
+	require.NoError(t, err)
+	assert.Equal(t, "user:pass@tcp(db:3306)/oauth2?parseTime=true&charset=utf8mb4", dsn)
+
+	cnf.ConnectionString = "bogus"
+	_, err = cnf.DSN()
+	assert.Error(t, err)
+}
+
+func TestRegisteredWithFactory(t *testing.T) {
+	factory, err := storage.NewFactory()
+	require.NoError(t, err)
+
+	_, err = factory.CreateStorage(storage.StorageConfig{
+		Primary: storage.StorageBackend{Type: "mysql"},
+	})
+	assert.EqualError(t, err, "invalid mysql config: connection_string or host is required")
+}
+
+// TestConformance needs a database to run against, such as
+// MYSQL_TEST_URL=user:pass@tcp(localhost:3306)/oauth2_test?parseTime=true
+func TestConformance(t *testing.T) {
+	connectionString := os.Getenv("MYSQL_TEST_URL")
+	if connectionString == "" {
+		t.Skip("MYSQL_TEST_URL is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		cnf, err := mysql.ParseConfig(map[string]interface{}{
+			"connection_string": connectionString,
+			"auto_migrate":      true,
+		})
+		require.NoError(t, err)
+		s, err := mysql.NewMySQLStorage(cnf, nil, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+
+		role := &models.OauthRole{ID: storagetest.RoleID, Name: "User"}
+		require.NoError(t, s.DB().FirstOrCreate(role, models.OauthRole{ID: role.ID}).Error)
+		return s
+	})
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusMetrics records metrics in a Prometheus registry of its own, so
+// several SDK instances can live in one process. Client IDs are not used as
+// labels to keep the number of series bounded.
+type PrometheusMetrics struct {
+	registry *prometheus.Registry
+
+	tokensGenerated   *prometheus.HistogramVec
+	tokenValidations  *prometheus.HistogramVec
+	databaseQueries   *prometheus.HistogramVec
+	cacheOperations   *prometheus.HistogramVec
+	activeTokens      prometheus.Gauge
+	rateLimitRequests *prometheus.CounterVec
+	memoryUsage       prometheus.Gauge
+	goroutines        prometheus.Gauge
+	requests          *prometheus.CounterVec
+	circuitState      prometheus.Gauge
+}
+
+// NewPrometheusMetrics creates a Prometheus metrics provider, metric names
+// are prefixed with namespace and subsystem when they are not empty
+func NewPrometheusMetrics(namespace, subsystem string) (*PrometheusMetrics, error) {
+	p := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		tokensGenerated: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "token_generation_duration_seconds",
+			Help:      "Time taken to issue tokens by grant type.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"grant_type"}),
+		tokenValidations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "token_validation_duration_seconds",
+			Help:      "Time taken to validate access tokens by result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"result"}),
+		databaseQueries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "database_query_duration_seconds",
+			Help:      "Time taken by storage queries by operation and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "status"}),
+		cacheOperations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cache_operation_duration_seconds",
+			Help:      "Time taken by cache operations by operation and result.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"operation", "result"}),
+		activeTokens: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "active_tokens",
+			Help:      "Access tokens that have not expired, as last counted in storage.",
+		}),
+		rateLimitRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rate_limit_requests_total",
+			Help:      "Requests checked by the rate limiter by result.",
+		}, []string{"result"}),
+		memoryUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "memory_usage_bytes",
+			Help:      "Memory obtained from the OS, as last reported by the SDK.",
+		}),
+		goroutines: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "goroutines",
+			Help:      "Goroutine count last reported by the SDK.",
+		}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "requests_total",
+			Help:      "HTTP requests by endpoint, method and status.",
+		}, []string{"endpoint", "method", "status"}),
+		circuitState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "Storage circuit breaker state: 0 closed, 1 half-open, 2 open.",
+		}),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		p.tokensGenerated,
+		p.tokenValidations,
+		p.databaseQueries,
+		p.cacheOperations,
+		p.activeTokens,
+		p.rateLimitRequests,
+		p.memoryUsage,
+		p.goroutines,
+		p.requests,
+		p.circuitState,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		if err := p.registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Registry returns the registry the metrics are recorded in, so callers can
+// add collectors of their own
+func (p *PrometheusMetrics) Registry() *prometheus.Registry {
+	return p.registry
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (p *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+func (p *PrometheusMetrics) RecordTokenGeneration(clientID, grantType string, duration time.Duration) {
+	p.tokensGenerated.WithLabelValues(grantType).Observe(duration.Seconds())
+}
+
+func (p *PrometheusMetrics) RecordTokenValidation(valid bool, duration time.Duration) {
+	p.tokenValidations.WithLabelValues(result(valid, "valid", "invalid")).Observe(duration.Seconds())
+}
+
+func (p *PrometheusMetrics) RecordDatabaseQuery(operation string, duration time.Duration, success bool) {
+	p.databaseQueries.WithLabelValues(operation, result(success, "success", "error")).Observe(duration.Seconds())
+}
+
+func (p *PrometheusMetrics) RecordCacheOperation(operation string, hit bool, duration time.Duration) {
+	p.cacheOperations.WithLabelValues(operation, result(hit, "hit", "miss")).Observe(duration.Seconds())
+}
+
+// IncrementActiveTokens does nothing, see RecordActiveTokens
+func (p *PrometheusMetrics) IncrementActiveTokens(clientID string) {}
+
+// DecrementActiveTokens does nothing, see RecordActiveTokens
+func (p *PrometheusMetrics) DecrementActiveTokens(clientID string) {}
+
+func (p *PrometheusMetrics) RecordActiveTokens(count int) {
+	p.activeTokens.Set(float64(count))
+}
+
+func (p *PrometheusMetrics) RecordRateLimit(clientID string, limited bool) {
+	p.rateLimitRequests.WithLabelValues(result(limited, "limited", "allowed")).Inc()
+}
+
+func (p *PrometheusMetrics) RecordMemoryUsage(bytes int64) {
+	p.memoryUsage.Set(float64(bytes))
+}
+
+func (p *PrometheusMetrics) RecordGoroutineCount(count int) {
+	p.goroutines.Set(float64(count))
+}
+
+func (p *PrometheusMetrics) RecordRequestCount(endpoint, method, status string) {
+	p.requests.WithLabelValues(endpoint, method, status).Inc()
+}
+
+func (p *PrometheusMetrics) RecordCircuitBreakerState(state CircuitState) {
+	p.circuitState.Set(float64(state))
+}
+
+func result(ok bool, yes, no string) string {
+	if ok {
+		return yes
+	}
+	return no
+}
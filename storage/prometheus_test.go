@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics, err := NewPrometheusMetrics("oauth2", "server")
+	require.NoError(t, err)
+
+	metrics.RecordTokenGeneration("test_client_1", "password", 10*time.Millisecond)
+	metrics.RecordTokenValidation(true, time.Millisecond)
+	metrics.RecordTokenValidation(false, time.Millisecond)
+	metrics.RecordDatabaseQuery("get_client", time.Millisecond, true)
+	metrics.RecordCacheOperation("get_client", false, time.Microsecond)
+	metrics.RecordActiveTokens(2)
+	metrics.RecordActiveTokens(1)
+	metrics.RecordRateLimit("test_client_1", true)
+	metrics.RecordRequestCount("/v1/oauth/tokens", "POST", "200")
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		`oauth2_server_token_generation_duration_seconds_count{grant_type="password"} 1`,
+		`oauth2_server_token_validation_duration_seconds_count{result="valid"} 1`,
+		`oauth2_server_token_validation_duration_seconds_count{result="invalid"} 1`,
+		`oauth2_server_database_query_duration_seconds_count{operation="get_client",status="success"} 1`,
+		`oauth2_server_cache_operation_duration_seconds_count{operation="get_client",result="miss"} 1`,
+		`oauth2_server_active_tokens 1`,
+		`oauth2_server_rate_limit_requests_total{result="limited"} 1`,
+		`oauth2_server_requests_total{endpoint="/v1/oauth/tokens",method="POST",status="200"} 1`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, string(body), line)
+	}
+
+	// Every provider has a registry of its own
+	_, err = NewPrometheusMetrics("oauth2", "server")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCluster returns a cluster client whose slots are split between two
+// miniredis servers, which do not support cluster mode themselves
+func newTestCluster(t *testing.T) (*redis.ClusterClient, []*miniredis.Miniredis) {
+	servers := []*miniredis.Miniredis{miniredis.RunT(t), miniredis.RunT(t)}
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{
+				{Start: 0, End: 8191, Nodes: []redis.ClusterNode{{Addr: servers[0].Addr()}}},
+				{Start: 8192, End: 16383, Nodes: []redis.ClusterNode{{Addr: servers[1].Addr()}}},
+			}, nil
+		},
+	})
+	t.Cleanup(func() { client.Close() })
+	return client, servers
+}
+
+func TestRedisCacheCluster(t *testing.T) {
+	client, servers := newTestCluster(t)
+	ctx := context.Background()
+	cache := &RedisCache{client: client, metrics: storage.NewNoOpMetrics(), prefix: "cache"}
+
+	// Enough keys to land on both servers
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, "item"+string(rune('a'+i)))
+	}
+	set := func() {
+		for _, key := range keys {
+			require.NoError(t, cache.Set(ctx, key, key, time.Minute))
+		}
+		for _, server := range servers {
+			require.NotEmpty(t, server.Keys())
+		}
+	}
+
+	set()
+	require.NoError(t, cache.DeleteMulti(ctx, keys))
+	for _, server := range servers {
+		assert.Empty(t, server.Keys())
+	}
+
+	set()
+	require.NoError(t, cache.FlushAll(ctx))
+	for _, server := range servers {
+		assert.Empty(t, server.Keys())
+	}
+}
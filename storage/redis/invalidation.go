@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultInvalidationChannel is the pub/sub channel invalidations are sent on
+const DefaultInvalidationChannel = "oauth2:cache:invalidate"
+
+// InvalidationBus sends cache invalidations over Redis pub/sub. Messages
+// published while a node is disconnected are lost, the L1 TTL of the tiered
+// cache bounds how long that node may serve stale entries.
+type InvalidationBus struct {
+	client  redis.UniversalClient
+	channel string
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+	done   chan struct{}
+}
+
+// NewInvalidationBus creates a bus on the given channel
+func NewInvalidationBus(client redis.UniversalClient, channel string) *InvalidationBus {
+	if channel == "" {
+		channel = DefaultInvalidationChannel
+	}
+	return &InvalidationBus{client: client, channel: channel}
+}
+
+// Publish sends an invalidation to every subscribed node
+func (b *InvalidationBus) Publish(ctx context.Context, invalidation *storage.Invalidation) error {
+	data, err := json.Marshal(invalidation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal invalidation: %w", err)
+	}
+	return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+// Subscribe calls handler for every invalidation received until Close
+func (b *InvalidationBus) Subscribe(ctx context.Context, handler func(invalidation *storage.Invalidation)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pubsub != nil {
+		return fmt.Errorf("already subscribed to %s", b.channel)
+	}
+
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	// Wait for the confirmation so no invalidation published after
+	// Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+	b.pubsub = pubsub
+	b.done = make(chan struct{})
+
+	go func(messages <-chan *redis.Message, done chan struct{}) {
+		defer close(done)
+		for message := range messages {
+			invalidation := new(storage.Invalidation)
+			if err := json.Unmarshal([]byte(message.Payload), invalidation); err != nil {
+				continue
+			}
+			handler(invalidation)
+		}
+	}(pubsub.Channel(), b.done)
+
+	return nil
+}
+
+// Close unsubscribes and waits for the handler to return, the Redis client
+// is left open as it is shared with the cache
+func (b *InvalidationBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pubsub == nil {
+		return nil
+	}
+
+	err := b.pubsub.Close()
+	<-b.done
+	b.pubsub = nil
+	return err
+}
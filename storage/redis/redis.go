@@ -1,4 +1,3 @@
-package redis
 // Package redis provides high-performance Redis cache implementation
 package redis
 
@@ -6,6 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/RichardKnop/go-oauth2-server/storage"
@@ -17,12 +19,14 @@ type RedisCache struct {
 	client  redis.UniversalClient
 	metrics storage.MetricsProvider
 	prefix  string
+	db      int
 }
 
 // RedisConfig defines Redis-specific configuration
 type RedisConfig struct {
 	// Single Redis instance
 	Addr     string `json:"addr"`
+	Username string `json:"username"`
 	Password string `json:"password"`
 	DB       int    `json:"db"`
 
@@ -41,14 +45,125 @@ type RedisConfig struct {
 	KeyPrefix string `json:"key_prefix"`
 }
 
+func init() {
+	storage.RegisterCache("redis", OpenCache)
+}
+
+// ParseConfig reads a RedisConfig from a Config map. Besides the RedisConfig
+// keys it accepts the keys set by the SDK builder: connection_string, a
+// redis:// or rediss:// URL for a single instance, and cluster_addresses.
+func ParseConfig(config map[string]interface{}) (*RedisConfig, error) {
+	cnf := new(RedisConfig)
+	if err := storage.DecodeConfig(config, cnf); err != nil {
+		return nil, fmt.Errorf("invalid redis config: %w", err)
+	}
+
+	var builder struct {
+		ConnectionString string   `json:"connection_string"`
+		ClusterAddresses []string `json:"cluster_addresses"`
+	}
+	if err := storage.DecodeConfig(config, &builder); err != nil {
+		return nil, fmt.Errorf("invalid redis config: %w", err)
+	}
+
+	if builder.ConnectionString != "" && cnf.Addr == "" {
+		options, err := redis.ParseURL(builder.ConnectionString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis config: invalid connection_string: %w", err)
+		}
+		cnf.Addr = options.Addr
+		if cnf.Username == "" {
+			cnf.Username = options.Username
+		}
+		if cnf.Password == "" {
+			cnf.Password = options.Password
+		}
+		if cnf.DB == 0 {
+			cnf.DB = options.DB
+		}
+	}
+	if len(cnf.Addrs) == 0 {
+		cnf.Addrs = builder.ClusterAddresses
+	}
+
+	if cnf.Addr == "" && len(cnf.Addrs) == 0 {
+		return nil, fmt.Errorf("invalid redis config: connection_string, addr or addrs is required")
+	}
+	return cnf, nil
+}
+
+// OpenCache creates a Redis cache from a CacheConfig.Config map, it is
+// registered with the storage factory as the "redis" cache provider. When
+// l1_size is set the Redis cache is fronted by an in-process LRU of that
+// many entries, kept for at most l1_ttl and invalidated across nodes on
+// invalidation_channel.
+func OpenCache(config map[string]interface{}) (storage.CacheProvider, error) {
+	cnf, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var tiered struct {
+		L1Size              int           `json:"l1_size"`
+		L1TTL               time.Duration `json:"l1_ttl"`
+		InvalidationChannel string        `json:"invalidation_channel"`
+	}
+	if err := storage.DecodeConfig(config, &tiered); err != nil {
+		return nil, fmt.Errorf("invalid redis config: %w", err)
+	}
+
+	cache, err := NewRedisCache(cnf, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tiered.L1Size <= 0 {
+		return cache, nil
+	}
+
+	l1, err := storage.NewMemoryCache(map[string]interface{}{"max_size": tiered.L1Size})
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+	bus := NewInvalidationBus(cache.client, tiered.InvalidationChannel)
+	tieredCache, err := storage.NewTieredCache(l1, cache, bus, tiered.L1TTL)
+	if err != nil {
+		l1.Close()
+		cache.Close()
+		return nil, err
+	}
+	return tieredCache, nil
+}
+
 // NewRedisCache creates a new high-performance Redis cache
 func NewRedisCache(config *RedisConfig, metrics storage.MetricsProvider) (*RedisCache, error) {
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if metrics == nil {
+		metrics = storage.NewNoOpMetrics()
+	}
+
+	return &RedisCache{
+		client:  client,
+		metrics: metrics,
+		prefix:  config.KeyPrefix,
+		db:      config.DB,
+	}, nil
+}
+
+// newClient connects to a single Redis instance or to a cluster when more
+// than one address is configured
+func newClient(config *RedisConfig) (redis.UniversalClient, error) {
 	var client redis.UniversalClient
 
 	if len(config.Addrs) > 0 {
 		// Redis Cluster configuration for high availability
 		client = redis.NewClusterClient(&redis.ClusterOptions{
 			Addrs:        config.Addrs,
+			Username:     config.Username,
 			Password:     config.Password,
 			PoolSize:     config.PoolSize,
 			MinIdleConns: config.MinIdleConns,
@@ -61,6 +176,7 @@ func NewRedisCache(config *RedisConfig, metrics storage.MetricsProvider) (*Redis
 		// Single Redis instance
 		client = redis.NewClient(&redis.Options{
 			Addr:         config.Addr,
+			Username:     config.Username,
 			Password:     config.Password,
 			DB:           config.DB,
 			PoolSize:     config.PoolSize,
@@ -75,16 +191,18 @@ func NewRedisCache(config *RedisConfig, metrics storage.MetricsProvider) (*Redis
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	
+
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisCache{
-		client:  client,
-		metrics: metrics,
-		prefix:  config.KeyPrefix,
-	}, nil
+	return client, nil
+}
+
+// SetMetrics sets the provider cache operations are reported to
+func (r *RedisCache) SetMetrics(metrics storage.MetricsProvider) {
+	r.metrics = metrics
 }
 
 // Set stores a value in cache with TTL
@@ -121,7 +239,7 @@ func (r *RedisCache) Get(ctx context.Context, key string, dest interface{}) erro
 	if err != nil {
 		if err == redis.Nil {
 			r.metrics.RecordCacheOperation("get", false, time.Since(start))
-			return fmt.Errorf("cache miss")
+			return storage.ErrCacheMiss
 		}
 		return fmt.Errorf("failed to get cache value: %w", err)
 	}
@@ -236,20 +354,81 @@ func (r *RedisCache) DeleteMulti(ctx context.Context, keys []string) error {
 		return nil
 	}
 
-	// Prepare full keys
-	fullKeys := make([]string, len(keys))
-	for i, key := range keys {
-		fullKeys[i] = r.getFullKey(key)
+	// One DEL per key, a cluster sends a DEL with several keys to the node
+	// of the first one and fails when the others hash to other slots
+	pipe := r.client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, r.getFullKey(key))
 	}
-
-	// Delete in batch
-	if err := r.client.Del(ctx, fullKeys...).Err(); err != nil {
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to delete multi: %w", err)
 	}
 
 	return nil
 }
 
+// TTLs returns the time left of each key found, zero for keys that never
+// expire. Like DeleteMulti it sends one PTTL per key.
+func (r *RedisCache) TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error) {
+	start := time.Now()
+	defer func() {
+		r.metrics.RecordCacheOperation("ttls", true, time.Since(start))
+	}()
+
+	ttls := make(map[string]time.Duration, len(keys))
+	if len(keys) == 0 {
+		return ttls, nil
+	}
+
+	pipe := r.client.Pipeline()
+	commands := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		commands[i] = pipe.PTTL(ctx, r.getFullKey(key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get ttls: %w", err)
+	}
+
+	for i, command := range commands {
+		// PTTL replies -2 for a missing key and -1 for one without expiry
+		switch ttl := command.Val(); {
+		case ttl == -2:
+		case ttl < 0:
+			ttls[keys[i]] = 0
+		default:
+			ttls[keys[i]] = ttl
+		}
+	}
+	return ttls, nil
+}
+
+// incrementScript increments a counter and sets its expiry only when the key
+// has none, so repeated increments do not keep extending the window
+var incrementScript = redis.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// Increment atomically adds delta to a counter, creating it with the given TTL
+func (r *RedisCache) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	start := time.Now()
+	defer func() {
+		r.metrics.RecordCacheOperation("increment", true, time.Since(start))
+	}()
+
+	fullKey := r.getFullKey(key)
+
+	value, err := incrementScript.Run(ctx, r.client, []string{fullKey}, delta, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment cache value: %w", err)
+	}
+
+	return value, nil
+}
+
 // FlushAll clears all cache entries
 func (r *RedisCache) FlushAll(ctx context.Context) error {
 	start := time.Now()
@@ -257,17 +436,29 @@ func (r *RedisCache) FlushAll(ctx context.Context) error {
 		r.metrics.RecordCacheOperation("flush_all", true, time.Since(start))
 	}()
 
+	// SCAN only iterates the keys of the node it is sent to, so a cluster
+	// is flushed master by master
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return r.flush(ctx, master)
+		})
+	}
+	return r.flush(ctx, r.client)
+}
+
+// flush deletes the prefixed keys of a single node
+func (r *RedisCache) flush(ctx context.Context, client redis.Cmdable) error {
 	// Use pattern matching to delete only our prefixed keys
 	pattern := r.getFullKey("*")
-	
+
 	// Scan and delete in batches to avoid blocking Redis
-	iter := r.client.Scan(ctx, 0, pattern, 1000).Iterator()
+	iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
 	for iter.Next(ctx) {
-		if err := r.client.Del(ctx, iter.Val()).Err(); err != nil {
+		if err := client.Del(ctx, iter.Val()).Err(); err != nil {
 			return fmt.Errorf("failed to delete key %s: %w", iter.Val(), err)
 		}
 	}
-	
+
 	if err := iter.Err(); err != nil {
 		return fmt.Errorf("failed to scan keys: %w", err)
 	}
@@ -275,26 +466,44 @@ func (r *RedisCache) FlushAll(ctx context.Context) error {
 	return nil
 }
 
-// Stats returns cache statistics
+// Stats returns cache statistics parsed from INFO, summed over all masters
+// of a cluster. Keys counts every key of the selected database, not only
+// the ones under the key prefix.
 func (r *RedisCache) Stats(ctx context.Context) (*storage.CacheStats, error) {
 	start := time.Now()
 	defer func() {
 		r.metrics.RecordCacheOperation("stats", true, time.Since(start))
 	}()
 
-	info, err := r.client.Info(ctx, "stats", "memory", "keyspace").Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get Redis info: %w", err)
+	// INFO without a section returns the default sections, which include
+	// stats, memory and keyspace on every Redis version
+	var infos []string
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			info, err := master.Info(ctx).Result()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			infos = append(infos, info)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Redis info: %w", err)
+		}
+	} else {
+		info, err := r.client.Info(ctx).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Redis info: %w", err)
+		}
+		infos = append(infos, info)
 	}
 
-	// Parse Redis info for statistics
-	// This is a simplified implementation - you'd parse the actual info string
-	stats := &storage.CacheStats{
-		Hits:     0, // Would parse from keyspace_hits
-		Misses:   0, // Would parse from keyspace_misses
-		Keys:     0, // Would parse from db0:keys
-		Memory:   0, // Would parse from used_memory
-		HitRatio: 0.0,
+	stats := new(storage.CacheStats)
+	for _, info := range infos {
+		parseInfo(info, r.db, stats)
 	}
 
 	// Calculate hit ratio
@@ -305,6 +514,38 @@ func (r *RedisCache) Stats(ctx context.Context) (*storage.CacheStats, error) {
 	return stats, nil
 }
 
+// parseInfo adds the counters found in the output of INFO to stats, keys
+// are read from the keyspace line of database db such as
+// "db0:keys=1,expires=0,avg_ttl=0"
+func parseInfo(info string, db int, stats *storage.CacheStats) {
+	keyspace := fmt.Sprintf("db%d", db)
+	for _, line := range strings.Split(info, "\n") {
+		name, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		switch name {
+		case "keyspace_hits":
+			stats.Hits += parseInt(value)
+		case "keyspace_misses":
+			stats.Misses += parseInt(value)
+		case "used_memory":
+			stats.Memory += parseInt(value)
+		case keyspace:
+			for _, field := range strings.Split(value, ",") {
+				if keys, found := strings.CutPrefix(field, "keys="); found {
+					stats.Keys += parseInt(keys)
+				}
+			}
+		}
+	}
+}
+
+func parseInt(value string) int64 {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
 // Close closes the Redis connection
 func (r *RedisCache) Close() error {
 	return r.client.Close()
@@ -0,0 +1,567 @@
+package redis
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/go-redis/redis/v8"
+)
+
+func init() {
+	storage.RegisterLayeredBackend("redis", Open)
+}
+
+// revokeBatchSize is the number of keys deleted in one round trip while
+// revoking
+const revokeBatchSize = 500
+
+// indexScript adds ARGV[2] to the sorted set KEYS[1] scored by its expiry
+// ARGV[1], in milliseconds, drops the members that expired before ARGV[3]
+// and keeps the set for at least ARGV[4] milliseconds, until its last
+// member expires
+var indexScript = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[3])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return 1
+`)
+
+// RedisStorage keeps access tokens, refresh tokens and authorization codes in
+// Redis, where they expire on their own at ExpiresAt. Clients, users and
+// scopes are delegated to the embedded relational storage.
+//
+// Every token and code is added to sorted set indexes of its client, user
+// and scopes, and access tokens to an index of them all, which listing and
+// bulk revocation read instead of scanning the keyspace. An index expires
+// with the last token in it, deleted tokens are left in the client, user
+// and scope indexes until they expire.
+type RedisStorage struct {
+	storage.Storage
+	client  redis.UniversalClient
+	metrics storage.MetricsProvider
+	prefix  string
+}
+
+// Open creates Redis storage from a StorageBackend.Config map in front of
+// relational, it is registered with the storage factory as the layered
+// "redis" backend, which creates relational from the "relational" key of the
+// map. The storage closes relational once it is closed itself.
+func Open(config map[string]interface{}, relational storage.Storage) (storage.Storage, error) {
+	cnf, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(cnf)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisStorage(client, relational, cnf.KeyPrefix, nil), nil
+}
+
+// NewRedisStorage stores tokens with client and delegates everything else
+// to relational
+func NewRedisStorage(client redis.UniversalClient, relational storage.Storage, prefix string, metrics storage.MetricsProvider) *RedisStorage {
+	if metrics == nil {
+		metrics = storage.NewNoOpMetrics()
+	}
+	return &RedisStorage{
+		Storage: relational,
+		client:  client,
+		metrics: metrics,
+		prefix:  prefix,
+	}
+}
+
+// SetMetrics sets the provider Redis commands and the relational queries
+// are reported to
+func (r *RedisStorage) SetMetrics(metrics storage.MetricsProvider) {
+	r.metrics = metrics
+	if instrumented, ok := r.Storage.(storage.Instrumented); ok {
+		instrumented.SetMetrics(metrics)
+	}
+}
+
+// IsUnavailable reports a closed client or an exhausted connection pool, and
+// whatever the relational storage recognises, network errors are already
+// failures to the circuit breaker
+func (r *RedisStorage) IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// go-redis does not export the pool timeout error
+	if errors.Is(err, redis.ErrClosed) || strings.Contains(err.Error(), "redis: connection pool timeout") {
+		return true
+	}
+	classifier, ok := r.Storage.(storage.UnavailableClassifier)
+	return ok && classifier.IsUnavailable(err)
+}
+
+// StoreAccessToken stores an access token until it expires
+func (r *RedisStorage) StoreAccessToken(ctx context.Context, token *models.OauthAccessToken) error {
+	token.CreatedAt = time.Now().UTC()
+
+	stored := *token
+	stored.Client, stored.User = strip(token.Client, token.User)
+	return r.set(ctx, "store_access_token", "access_token", token.Token, &stored, token.ClientID, token.UserID, token.Scope, token.ExpiresAt)
+}
+
+// GetAccessToken retrieves an access token
+func (r *RedisStorage) GetAccessToken(ctx context.Context, tokenStr string) (*models.OauthAccessToken, error) {
+	token := new(models.OauthAccessToken)
+	if err := r.get(ctx, "get_access_token", r.key("access_token", tokenStr), token); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, storage.ErrTokenNotFound
+		}
+		return nil, err
+	}
+	// Redis expiry has millisecond precision, do not trust it to the nanosecond
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrTokenExpired
+	}
+	return token, nil
+}
+
+// DeleteAccessToken deletes an access token
+func (r *RedisStorage) DeleteAccessToken(ctx context.Context, tokenStr string) error {
+	return r.BatchDeleteTokens(ctx, []string{tokenStr})
+}
+
+// StoreRefreshToken stores a refresh token until it expires
+func (r *RedisStorage) StoreRefreshToken(ctx context.Context, token *models.OauthRefreshToken) error {
+	token.CreatedAt = time.Now().UTC()
+
+	stored := *token
+	stored.Client, stored.User = strip(token.Client, token.User)
+	return r.set(ctx, "store_refresh_token", "refresh_token", token.Token, &stored, token.ClientID, token.UserID, token.Scope, token.ExpiresAt)
+}
+
+// GetRefreshToken retrieves a refresh token
+func (r *RedisStorage) GetRefreshToken(ctx context.Context, tokenStr string) (*models.OauthRefreshToken, error) {
+	token := new(models.OauthRefreshToken)
+	if err := r.get(ctx, "get_refresh_token", r.key("refresh_token", tokenStr), token); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, storage.ErrTokenNotFound
+		}
+		return nil, err
+	}
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrTokenExpired
+	}
+	return token, nil
+}
+
+// DeleteRefreshToken deletes a refresh token
+func (r *RedisStorage) DeleteRefreshToken(ctx context.Context, tokenStr string) error {
+	return r.del(ctx, "delete_refresh_token", r.key("refresh_token", tokenStr), nil)
+}
+
+// StoreAuthorizationCode stores an authorization code until it expires
+func (r *RedisStorage) StoreAuthorizationCode(ctx context.Context, code *models.OauthAuthorizationCode) error {
+	code.CreatedAt = time.Now().UTC()
+
+	stored := *code
+	stored.Client, stored.User = strip(code.Client, code.User)
+	return r.set(ctx, "store_authorization_code", "auth_code", code.Code, &stored, code.ClientID, code.UserID, code.Scope, code.ExpiresAt)
+}
+
+// GetAuthorizationCode retrieves an authorization code
+func (r *RedisStorage) GetAuthorizationCode(ctx context.Context, codeStr string) (*models.OauthAuthorizationCode, error) {
+	code := new(models.OauthAuthorizationCode)
+	if err := r.get(ctx, "get_authorization_code", r.key("auth_code", codeStr), code); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, storage.ErrCodeNotFound
+		}
+		return nil, err
+	}
+	if code.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrCodeExpired
+	}
+	return code, nil
+}
+
+// DeleteAuthorizationCode deletes an authorization code
+func (r *RedisStorage) DeleteAuthorizationCode(ctx context.Context, codeStr string) error {
+	return r.del(ctx, "delete_authorization_code", r.key("auth_code", codeStr), storage.ErrCodeNotFound)
+}
+
+// BatchGetTokens retrieves multiple access tokens, unknown and expired
+// tokens are left out
+func (r *RedisStorage) BatchGetTokens(ctx context.Context, tokens []string) ([]*models.OauthAccessToken, error) {
+	found, err := r.getAccessTokens(ctx, "batch_get_tokens", tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var accessTokens []*models.OauthAccessToken
+	for _, token := range found {
+		if token.ExpiresAt.After(now) {
+			accessTokens = append(accessTokens, token)
+		}
+	}
+
+	return accessTokens, nil
+}
+
+// ListTokens lists the access tokens matching filter ordered by token. The
+// page is built from the index of the user or client the filter selects, or
+// from the index of all access tokens, which is read in full.
+func (r *RedisStorage) ListTokens(ctx context.Context, filter storage.TokenFilter, options storage.ListOptions) (*storage.TokenPage, error) {
+	after, err := options.After()
+	if err != nil {
+		return nil, err
+	}
+
+	index := r.key("index", "access_token")
+	switch {
+	case filter.UserID != "":
+		index = r.key("index", "user:"+filter.UserID)
+	case filter.ClientID != "":
+		index = r.key("index", "client:"+filter.ClientID)
+	}
+	now := time.Now()
+	expiresBefore := "+inf"
+	if !filter.ExpiresBefore.IsZero() {
+		expiresBefore = "(" + score(filter.ExpiresBefore)
+	}
+	members, err := r.members(ctx, "list_tokens", index, "("+score(now), expiresBefore)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		kind, name, _ := strings.Cut(member, ":")
+		if kind == "access_token" && name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	limit := options.PageSize()
+	page := &storage.TokenPage{Tokens: make([]*models.OauthAccessToken, 0, limit)}
+	for len(names) > 0 && len(page.Tokens) <= limit {
+		batch := names[:min(len(names), limit+1-len(page.Tokens))]
+		names = names[len(batch):]
+		found, err := r.getAccessTokens(ctx, "list_tokens", batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, token := range found {
+			if filter.Matches(token, now) {
+				page.Tokens = append(page.Tokens, token)
+			}
+		}
+	}
+
+	if len(page.Tokens) > limit {
+		page.Tokens = page.Tokens[:limit]
+		page.NextCursor = storage.EncodeCursor(page.Tokens[limit-1].Token)
+	}
+	return page, nil
+}
+
+// CountActiveTokens counts the access tokens in the index of them all that
+// have not expired
+func (r *RedisStorage) CountActiveTokens(ctx context.Context) (int, error) {
+	start := time.Now()
+
+	count, err := r.client.ZCount(ctx, r.key("index", "access_token"), "("+score(start), "+inf").Result()
+	r.metrics.RecordDatabaseQuery("count_active_tokens", time.Since(start), err == nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count active tokens: %w", err)
+	}
+	return int(count), nil
+}
+
+// RevokeUserTokens deletes everything issued to the user with userID
+func (r *RedisStorage) RevokeUserTokens(ctx context.Context, userID string) (*storage.RevokeResult, error) {
+	return r.revoke(ctx, "revoke_user_tokens", "user", userID)
+}
+
+// RevokeClientTokens deletes everything issued to the client with clientID
+func (r *RedisStorage) RevokeClientTokens(ctx context.Context, clientID string) (*storage.RevokeResult, error) {
+	return r.revoke(ctx, "revoke_client_tokens", "client", clientID)
+}
+
+// RevokeTokensWithScope deletes everything granted scope
+func (r *RedisStorage) RevokeTokensWithScope(ctx context.Context, scope string) (*storage.RevokeResult, error) {
+	return r.revoke(ctx, "revoke_tokens_with_scope", "scope", scope)
+}
+
+// revoke deletes the tokens and codes in the index of a user, client or
+// scope, a batch at a time. Nothing is deleted for an empty value.
+func (r *RedisStorage) revoke(ctx context.Context, operation, kind, value string) (*storage.RevokeResult, error) {
+	result := new(storage.RevokeResult)
+	if value == "" {
+		return result, nil
+	}
+
+	index := r.key("index", kind+":"+value)
+	members, err := r.members(ctx, operation, index, "-inf", "+inf")
+	if err != nil {
+		return result, err
+	}
+
+	for len(members) > 0 {
+		batch := members[:min(len(members), revokeBatchSize)]
+		members = members[len(batch):]
+
+		start := time.Now()
+		pipe := r.client.Pipeline()
+		commands := make([]*redis.IntCmd, len(batch))
+		revoked := make([]interface{}, len(batch))
+		for i, member := range batch {
+			revoked[i] = member
+			kind, name, _ := strings.Cut(member, ":")
+			commands[i] = pipe.Del(ctx, r.key(kind, name))
+			if kind == "access_token" {
+				pipe.ZRem(ctx, r.key("index", "access_token"), member)
+			}
+		}
+		// Members added meanwhile stay in the index
+		pipe.ZRem(ctx, index, revoked...)
+		_, err = pipe.Exec(ctx)
+		r.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil)
+		if err != nil {
+			return result, fmt.Errorf("failed to %s: %w", operation, err)
+		}
+
+		// Tokens that expired or were deleted meanwhile were not revoked
+		for i, cmd := range commands {
+			if cmd.Val() == 0 {
+				continue
+			}
+			switch kind, name, _ := strings.Cut(batch[i], ":"); kind {
+			case "access_token":
+				result.AccessTokens++
+				result.Tokens = append(result.Tokens, name)
+			case "refresh_token":
+				result.RefreshTokens++
+				result.RefreshTokenValues = append(result.RefreshTokenValues, name)
+			case "auth_code":
+				result.AuthorizationCodes++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// BatchDeleteTokens deletes multiple access tokens
+func (r *RedisStorage) BatchDeleteTokens(ctx context.Context, tokens []string) error {
+	start := time.Now()
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	pipe := r.client.Pipeline()
+	members := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		pipe.Del(ctx, r.key("access_token", token))
+		members[i] = "access_token:" + token
+	}
+	pipe.ZRem(ctx, r.key("index", "access_token"), members...)
+	_, err := pipe.Exec(ctx)
+	r.metrics.RecordDatabaseQuery("batch_delete_tokens", time.Since(start), err == nil)
+	if err != nil {
+		return fmt.Errorf("failed to batch delete tokens: %w", err)
+	}
+
+	return nil
+}
+
+// CleanupExpiredTokens only cleans the relational storage, Redis expires
+// tokens and codes by itself
+func (r *RedisStorage) CleanupExpiredTokens(ctx context.Context) error {
+	return r.Storage.CleanupExpiredTokens(ctx)
+}
+
+// WithTx calls fn with the storage itself, it is not a transaction. Redis
+// cannot roll back, so whatever fn wrote before an error or panic is kept
+// and other callers see each write as soon as it is made, clients and users
+// are not written in a transaction of the relational storage either. An
+// authorization code is still consumed only once, DeleteAuthorizationCode
+// returns ErrCodeNotFound to all callers but one.
+func (r *RedisStorage) WithTx(ctx context.Context, fn func(tx storage.Storage) error) error {
+	return fn(r)
+}
+
+// HealthCheck verifies both Redis and the relational storage
+func (r *RedisStorage) HealthCheck(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis health check failed: %w", err)
+	}
+	return r.Storage.HealthCheck(ctx)
+}
+
+// Close closes the Redis connection and the relational storage
+func (r *RedisStorage) Close() error {
+	return errors.Join(r.client.Close(), r.Storage.Close())
+}
+
+// set stores value as JSON with a TTL ending at expiresAt and adds it to
+// its indexes, values that already expired are not stored at all
+func (r *RedisStorage) set(ctx context.Context, operation, kind, name string, value interface{}, clientID, userID sql.NullString, scope string, expiresAt time.Time) error {
+	start := time.Now()
+
+	ttl := time.Until(expiresAt)
+	if ttl < time.Millisecond {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	var indexes []string
+	if kind == "access_token" {
+		indexes = append(indexes, r.key("index", "access_token"))
+	}
+	if clientID.String != "" {
+		indexes = append(indexes, r.key("index", "client:"+clientID.String))
+	}
+	if userID.String != "" {
+		indexes = append(indexes, r.key("index", "user:"+userID.String))
+	}
+	for _, s := range strings.Fields(scope) {
+		indexes = append(indexes, r.key("index", "scope:"+s))
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.Set(ctx, r.key(kind, name), data, ttl)
+	for _, index := range indexes {
+		indexScript.Eval(ctx, pipe, []string{index}, score(expiresAt), kind+":"+name, score(start), ttl.Milliseconds())
+	}
+	_, err = pipe.Exec(ctx)
+	r.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil)
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", operation, err)
+	}
+	return nil
+}
+
+// get decodes the JSON stored under key into dest, it returns redis.Nil for
+// missing keys
+func (r *RedisStorage) get(ctx context.Context, operation, key string, dest interface{}) error {
+	start := time.Now()
+
+	data, err := r.client.Get(ctx, key).Bytes()
+	r.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil || err == redis.Nil)
+	if err != nil {
+		if err == redis.Nil {
+			return err
+		}
+		return fmt.Errorf("failed to %s: %w", operation, err)
+	}
+
+	if err := json.Unmarshal(data, dest); err != nil {
+		return fmt.Errorf("failed to unmarshal value: %w", err)
+	}
+	return nil
+}
+
+// getAccessTokens reads access tokens in one round trip, unknown tokens are
+// left out. A pipeline is used rather than MGET because the keys may live in
+// different cluster slots.
+func (r *RedisStorage) getAccessTokens(ctx context.Context, operation string, tokens []string) ([]*models.OauthAccessToken, error) {
+	start := time.Now()
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	pipe := r.client.Pipeline()
+	commands := make([]*redis.StringCmd, len(tokens))
+	for i, token := range tokens {
+		commands[i] = pipe.Get(ctx, r.key("access_token", token))
+	}
+	_, err := pipe.Exec(ctx)
+	r.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil || err == redis.Nil)
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to %s: %w", operation, err)
+	}
+
+	accessTokens := make([]*models.OauthAccessToken, 0, len(tokens))
+	for _, cmd := range commands {
+		if cmd.Err() != nil {
+			continue
+		}
+		token := new(models.OauthAccessToken)
+		if err := json.Unmarshal([]byte(cmd.Val()), token); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal access token: %w", err)
+		}
+		accessTokens = append(accessTokens, token)
+	}
+	return accessTokens, nil
+}
+
+// members returns the members of a sorted set index scored between from and
+// to
+func (r *RedisStorage) members(ctx context.Context, operation, index, from, to string) ([]string, error) {
+	start := time.Now()
+
+	members, err := r.client.ZRangeByScore(ctx, index, &redis.ZRangeBy{Min: from, Max: to}).Result()
+	r.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s: %w", operation, err)
+	}
+	return members, nil
+}
+
+// del deletes key, returning notFound when it is set and there was no key
+func (r *RedisStorage) del(ctx context.Context, operation, key string, notFound error) error {
+	start := time.Now()
+
+	deleted, err := r.client.Del(ctx, key).Result()
+	r.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil)
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", operation, err)
+	}
+	if deleted == 0 && notFound != nil {
+		return notFound
+	}
+	return nil
+}
+
+// score returns the index score of t, milliseconds since the epoch
+func score(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func (r *RedisStorage) key(kind, value string) string {
+	if r.prefix == "" {
+		return fmt.Sprintf("%s:%s", kind, value)
+	}
+	return fmt.Sprintf("%s:%s:%s", r.prefix, kind, value)
+}
+
+// strip keeps only what identifies the client and user of a token, so
+// secrets and password hashes are never copied into Redis
+func strip(client *models.OauthClient, user *models.OauthUser) (*models.OauthClient, *models.OauthUser) {
+	var strippedClient *models.OauthClient
+	if client != nil {
+		strippedClient = &models.OauthClient{
+			MyGormModel: models.MyGormModel{ID: client.ID},
+			Key:         client.Key,
+		}
+	}
+	var strippedUser *models.OauthUser
+	if user != nil {
+		strippedUser = &models.OauthUser{
+			MyGormModel: models.MyGormModel{ID: user.ID},
+			RoleID:      user.RoleID,
+			Username:    user.Username,
+		}
+	}
+	return strippedClient, strippedUser
+}
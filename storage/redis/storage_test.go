@@ -0,0 +1,225 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/redis"
+	"github.com/RichardKnop/go-oauth2-server/storage/storagetest"
+	"github.com/RichardKnop/go-oauth2-server/util"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorage(t *testing.T) (storage.Storage, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+
+	factory, err := storage.NewFactory()
+	require.NoError(t, err)
+	s, err := factory.CreateStorage(storage.StorageConfig{
+		Primary: storage.StorageBackend{
+			Type: "redis",
+			Config: map[string]interface{}{
+				"addr":       server.Addr(),
+				"key_prefix": "oauth2",
+				"relational": map[string]interface{}{"type": "memory"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s, server
+}
+
+func TestOpen(t *testing.T) {
+	_, err := redis.Open(map[string]interface{}{}, storage.NewMemoryStorage())
+	assert.EqualError(t, err, "invalid redis config: connection_string, addr or addrs is required")
+
+	// The factory creates the relational storage
+	factory, err := storage.NewFactory()
+	require.NoError(t, err)
+	create := func(config map[string]interface{}) error {
+		_, err := factory.CreateStorage(storage.StorageConfig{
+			Primary: storage.StorageBackend{Type: "redis", Config: config},
+		})
+		return err
+	}
+	assert.EqualError(t, create(map[string]interface{}{"relational": map[string]interface{}{"type": "memory"}}),
+		"invalid redis config: connection_string, addr or addrs is required")
+	assert.EqualError(t, create(map[string]interface{}{"addr": "localhost:6379"}),
+		"invalid redis config: relational is required")
+	assert.EqualError(t, create(map[string]interface{}{
+		"addr":       "localhost:6379",
+		"relational": map[string]interface{}{"type": "redis"},
+	}), "invalid redis config: the relational backend cannot be redis")
+}
+
+func TestRedisStorageTokens(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+
+	client := &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Key:         "test_client_1",
+		Secret:      "$2a$10$secret",
+	}
+	user := &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Username:    "test@user",
+		Password:    util.StringOrNull("$2a$10$password"),
+	}
+
+	// Clients and users live in the relational storage
+	require.NoError(t, s.CreateClient(ctx, client))
+	_, err := s.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.Empty(t, server.Keys())
+
+	accessToken := models.NewOauthAccessToken(client, user, 3600, "read")
+	accessToken.Client, accessToken.User = client, user
+	require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	assert.Equal(t, time.Hour, server.TTL("oauth2:access_token:"+accessToken.Token).Round(time.Minute))
+
+	// Secrets and password hashes are not copied into Redis
+	value, err := server.Get("oauth2:access_token:" + accessToken.Token)
+	require.NoError(t, err)
+	assert.NotContains(t, value, "$2a$")
+
+	found, err := s.GetAccessToken(ctx, accessToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, accessToken.ID, found.ID)
+	assert.Equal(t, "test_client_1", found.Client.Key)
+	assert.Equal(t, "test@user", found.User.Username)
+	assert.Equal(t, "1", found.UserID.String)
+
+	tokens, err := s.BatchGetTokens(ctx, []string{accessToken.Token, "bogus"})
+	require.NoError(t, err)
+	assert.Len(t, tokens, 1)
+
+	refreshToken := models.NewOauthRefreshToken(client, user, 7200, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, refreshToken))
+	code := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	require.NoError(t, err)
+
+	// Redis expires the access token and the code, the refresh token lives on
+	server.FastForward(time.Hour)
+	_, err = s.GetAccessToken(ctx, accessToken.Token)
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	assert.Equal(t, storage.ErrCodeNotFound, err)
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteRefreshToken(ctx, refreshToken.Token))
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+
+	// Tokens that already expired are never stored
+	expired := models.NewOauthAccessToken(client, nil, -60, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, expired))
+	_, err = s.GetAccessToken(ctx, expired.Token)
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+
+	assert.NoError(t, s.HealthCheck(ctx))
+	server.Close()
+	assert.Error(t, s.HealthCheck(ctx))
+}
+
+func TestRedisStorageBatchDelete(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		accessToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+		tokens = append(tokens, accessToken.Token)
+	}
+
+	require.NoError(t, s.BatchDeleteTokens(ctx, tokens[:2]))
+	for _, token := range tokens[:2] {
+		assert.False(t, server.Exists("oauth2:access_token:"+token))
+	}
+	assert.True(t, server.Exists("oauth2:access_token:"+tokens[2]))
+	members, err := server.ZMembers("oauth2:index:access_token")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"access_token:" + tokens[2]}, members)
+}
+
+func TestRedisStorageWithTx(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	failed := errors.New("failed")
+
+	// Tokens written in a transaction go to Redis, not to the relational
+	// storage, and are kept when it fails as Redis cannot roll back
+	accessToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+	err := s.WithTx(ctx, func(tx storage.Storage) error {
+		if err := tx.StoreAccessToken(ctx, accessToken); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	assert.True(t, server.Exists("oauth2:access_token:"+accessToken.Token))
+}
+
+func TestRedisStorageIndexes(t *testing.T) {
+	s, server := newTestStorage(t)
+	ctx := context.Background()
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1"}
+	user := &models.OauthUser{MyGormModel: models.MyGormModel{ID: "1"}, Username: "test@user"}
+	refreshToken := models.NewOauthRefreshToken(client, user, 7200, "read write")
+	require.NoError(t, s.StoreRefreshToken(ctx, refreshToken))
+	accessToken := models.NewOauthAccessToken(client, user, 3600, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+
+	// A shorter lived token does not cut the index short
+	assert.Equal(t, 7200*time.Second, server.TTL("oauth2:index:user:1").Round(time.Second))
+	members, err := server.ZMembers("oauth2:index:scope:read")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"access_token:" + accessToken.Token, "refresh_token:" + refreshToken.Token}, members)
+	members, err = server.ZMembers("oauth2:index:scope:write")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"refresh_token:" + refreshToken.Token}, members)
+
+	// Expired members are dropped when the next token is indexed
+	server.FastForward(time.Hour + time.Second)
+	other := models.NewOauthAccessToken(client, user, 3600, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, other))
+	members, err = server.ZMembers("oauth2:index:access_token")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"access_token:" + other.Token}, members)
+
+	// Revocation reads the index rather than scanning the keyspace
+	result, err := s.RevokeUserTokens(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.AccessTokens)
+	assert.Equal(t, 1, result.RefreshTokens)
+	assert.Equal(t, []string{other.Token}, result.Tokens)
+	assert.Equal(t, []string{refreshToken.Token}, result.RefreshTokenValues)
+	assert.False(t, server.Exists("oauth2:index:user:1"))
+
+	// Indexes expire with their last token
+	require.NoError(t, s.StoreAccessToken(ctx, models.NewOauthAccessToken(client, user, 60, "read")))
+	server.FastForward(2 * time.Hour)
+	assert.Empty(t, server.Keys())
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, _ := newTestStorage(t)
+		return s
+	}, storagetest.WithoutRollback())
+}
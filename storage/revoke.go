@@ -0,0 +1,32 @@
+package storage
+
+import "strings"
+
+// RevokeResult counts the records a bulk revocation deleted
+type RevokeResult struct {
+	AccessTokens       int `json:"access_tokens"`
+	RefreshTokens      int `json:"refresh_tokens"`
+	AuthorizationCodes int `json:"authorization_codes"`
+
+	// Tokens holds the deleted access tokens as the backend stores them,
+	// hashed behind HashedStorage, so caches can drop their copies
+	Tokens []string `json:"-"`
+
+	// RefreshTokenValues holds the deleted refresh tokens the same way
+	RefreshTokenValues []string `json:"-"`
+}
+
+// Total returns the number of records deleted
+func (r *RevokeResult) Total() int {
+	return r.AccessTokens + r.RefreshTokens + r.AuthorizationCodes
+}
+
+// HasScope reports whether the space delimited granted scopes include scope
+func HasScope(granted, scope string) bool {
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
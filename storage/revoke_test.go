@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, HasScope("read", "read"))
+	assert.True(t, HasScope("read write", "write"))
+	assert.True(t, HasScope(" read  write ", "read"))
+	assert.False(t, HasScope("read_write", "read"))
+	assert.False(t, HasScope("read write", "rea"))
+	assert.False(t, HasScope("", "read"))
+	assert.False(t, HasScope("read", ""))
+}
+
+func TestRevokeResultTotal(t *testing.T) {
+	result := &RevokeResult{AccessTokens: 3, RefreshTokens: 2, AuthorizationCodes: 1}
+	assert.Equal(t, 6, result.Total())
+}
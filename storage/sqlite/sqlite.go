@@ -0,0 +1,171 @@
+// Package sqlite provides SQLite storage for single node and embedded deployments
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/config"
+	"github.com/RichardKnop/go-oauth2-server/database"
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/sqlstore"
+	"github.com/jinzhu/gorm"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	storage.RegisterBackend("sqlite", Open)
+	database.RegisterType("sqlite", openDatabase)
+}
+
+// DefaultBusyTimeout is how long a connection waits for another one to
+// release its write lock before failing with "database is locked"
+const DefaultBusyTimeout = 5 * time.Second
+
+// SQLiteStorage implements storage on a local SQLite database
+type SQLiteStorage struct {
+	*sqlstore.Store
+	config *SQLiteConfig
+}
+
+// SQLiteConfig defines SQLite-specific configuration
+type SQLiteConfig struct {
+	// Path of the database file, ":memory:" keeps the database in memory
+	Path string `json:"path"`
+
+	// Write-ahead logging lets readers proceed while a write is in progress
+	JournalMode string        `json:"journal_mode"`
+	BusyTimeout time.Duration `json:"busy_timeout"`
+
+	MaxOpenConnections int `json:"max_open_connections"`
+
+	// Run the schema migrations when opening the database
+	AutoMigrate bool `json:"auto_migrate"`
+}
+
+// ParseConfig reads a SQLiteConfig from a StorageBackend.Config map
+func ParseConfig(config map[string]interface{}) (*SQLiteConfig, error) {
+	cnf := &SQLiteConfig{
+		JournalMode: "WAL",
+		BusyTimeout: DefaultBusyTimeout,
+		AutoMigrate: true,
+	}
+	if err := storage.DecodeConfig(config, cnf); err != nil {
+		return nil, fmt.Errorf("invalid sqlite config: %w", err)
+	}
+	if cnf.Path == "" {
+		return nil, fmt.Errorf("invalid sqlite config: path is required")
+	}
+	return cnf, nil
+}
+
+// DSN returns the data source name passed to the driver, the journal mode
+// and busy timeout are applied to every connection in the pool
+func DSN(path, journalMode string, busyTimeout time.Duration) string {
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprintf("%d", busyTimeout.Milliseconds()))
+	if journalMode != "" && !IsMemory(path) {
+		params.Set("_journal_mode", journalMode)
+	}
+	return "file:" + path + "?" + params.Encode()
+}
+
+// IsMemory returns true if path refers to an in-memory database
+func IsMemory(path string) bool {
+	return path == ":memory:"
+}
+
+// Open creates SQLite storage from a StorageBackend.Config map, it is
+// registered with the storage factory as the "sqlite" backend
+func Open(config map[string]interface{}) (storage.Storage, error) {
+	cnf, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLiteStorage(cnf, nil, nil)
+}
+
+// NewSQLiteStorage opens the database and migrates it unless disabled
+func NewSQLiteStorage(config *SQLiteConfig, cache storage.CacheProvider, metrics storage.MetricsProvider) (*SQLiteStorage, error) {
+	db, err := gorm.Open("sqlite3", DSN(config.Path, config.JournalMode, config.BusyTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+
+	// Every connection to an in-memory database gets a database of its own,
+	// so all queries have to share a single connection that is never closed
+	if IsMemory(config.Path) {
+		db.DB().SetMaxOpenConns(1)
+		db.DB().SetConnMaxLifetime(0)
+	} else {
+		db.DB().SetMaxOpenConns(config.MaxOpenConnections)
+	}
+	db.LogMode(false)
+
+	if config.AutoMigrate {
+		if err := models.MigrateAll(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate SQLite database: %w", err)
+		}
+	}
+
+	store := sqlstore.New(db, cache, metrics)
+	store.SetRetryable(isRetryable)
+	store.SetUnavailable(isUnavailable)
+	return &SQLiteStorage{
+		Store:  store,
+		config: config,
+	}, nil
+}
+
+// isRetryable reports a database that stayed busy or locked past the busy
+// timeout, or a snapshot that went stale before the transaction could write
+func isRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// isUnavailable reports a database file that cannot be opened, read or
+// written, or that is full or corrupt
+func isUnavailable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrCantOpen, sqlite3.ErrIoErr, sqlite3.ErrFull, sqlite3.ErrCorrupt, sqlite3.ErrNotADB:
+		return true
+	}
+	return false
+}
+
+// openDatabase opens the "sqlite" database type of database.NewDatabase,
+// DatabaseName is the path of the database file
+func openDatabase(cnf *config.Config) (*gorm.DB, error) {
+	db, err := gorm.Open("sqlite3", DSN(cnf.Database.DatabaseName, "WAL", DefaultBusyTimeout))
+	if err != nil {
+		return db, err
+	}
+
+	// An in-memory database only lives as long as its connection
+	if IsMemory(cnf.Database.DatabaseName) {
+		db.DB().SetMaxOpenConns(1)
+	} else {
+		db.DB().SetMaxOpenConns(cnf.Database.MaxOpenConns)
+	}
+
+	// Database logging
+	db.LogMode(cnf.IsDevelopment)
+
+	// There is no separate database server to migrate, so the schema is
+	// created when the database is opened
+	if err := models.MigrateAll(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
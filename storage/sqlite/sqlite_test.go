@@ -0,0 +1,342 @@
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/storage/sqlite"
+	"github.com/RichardKnop/go-oauth2-server/storage/storagetest"
+	"github.com/RichardKnop/go-oauth2-server/util"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStorage(t *testing.T) *sqlite.SQLiteStorage {
+	cnf, err := sqlite.ParseConfig(map[string]interface{}{
+		"path": filepath.Join(t.TempDir(), "oauth2.db"),
+	})
+	require.NoError(t, err)
+	s, err := sqlite.NewSQLiteStorage(cnf, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestParseConfig(t *testing.T) {
+	_, err := sqlite.ParseConfig(map[string]interface{}{})
+	assert.EqualError(t, err, "invalid sqlite config: path is required")
+
+	cnf, err := sqlite.ParseConfig(map[string]interface{}{
+		"path":         "/var/lib/oauth2/oauth2.db",
+		"busy_timeout": "10s",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "WAL", cnf.JournalMode)
+	assert.Equal(t, 10*time.Second, cnf.BusyTimeout)
+	assert.True(t, cnf.AutoMigrate)
+
+	assert.Equal(t, "file:/tmp/oauth2.db?_busy_timeout=5000&_journal_mode=WAL", sqlite.DSN("/tmp/oauth2.db", "WAL", sqlite.DefaultBusyTimeout))
+	assert.Equal(t, "file::memory:?_busy_timeout=5000", sqlite.DSN(":memory:", "WAL", sqlite.DefaultBusyTimeout))
+}
+
+func TestPragmas(t *testing.T) {
+	s := newTestStorage(t)
+
+	var journalMode string
+	require.NoError(t, s.DB().Raw("PRAGMA journal_mode").Row().Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+
+	var busyTimeout int
+	require.NoError(t, s.DB().Raw("PRAGMA busy_timeout").Row().Scan(&busyTimeout))
+	assert.Equal(t, 5000, busyTimeout)
+}
+
+func TestStorage(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	secret, err := pass.HashPassword("test_secret")
+	require.NoError(t, err)
+	client := &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Key:         "test_client_1",
+		Secret:      string(secret),
+	}
+	require.NoError(t, s.CreateClient(ctx, client))
+
+	// Client keys are matched case insensitively
+	found, err := s.GetClient(ctx, "TEST_client_1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", found.ID)
+	_, err = s.GetClient(ctx, "bogus")
+	assert.Equal(t, storage.ErrClientNotFound, err)
+
+	found.RedirectURI = util.StringOrNull("https://www.example.com")
+	require.NoError(t, s.UpdateClient(ctx, found))
+	found, err = s.GetClient(ctx, "test_client_1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.example.com", found.RedirectURI.String)
+	assert.Equal(t, storage.ErrClientNotFound, s.UpdateClient(ctx, &models.OauthClient{MyGormModel: models.MyGormModel{ID: "2"}}))
+
+	require.NoError(t, s.DB().Create(&models.OauthRole{ID: "user", Name: "User"}).Error)
+	password, err := pass.HashPassword("test_password")
+	require.NoError(t, err)
+	user := &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		RoleID:      util.StringOrNull("user"),
+		Username:    "test@user",
+		Password:    util.StringOrNull(string(password)),
+	}
+	require.NoError(t, s.CreateUser(ctx, user))
+
+	_, err = s.AuthenticateUser(ctx, "Test@User", "bogus")
+	assert.Equal(t, storage.ErrInvalidCredentials, err)
+	found2, err := s.AuthenticateUser(ctx, "Test@User", "test_password")
+	require.NoError(t, err)
+	assert.Equal(t, "1", found2.ID)
+	_, err = s.GetUserByID(ctx, "bogus")
+	assert.Equal(t, storage.ErrUserNotFound, err)
+
+	// Tokens are returned with their client and user
+	accessToken := models.NewOauthAccessToken(client, user, 3600, "read")
+	accessToken.Client = client
+	require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	got, err := s.GetAccessToken(ctx, accessToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "test_client_1", got.Client.Key)
+	assert.Equal(t, "test@user", got.User.Username)
+
+	tokens, err := s.BatchGetTokens(ctx, []string{accessToken.Token, "bogus"})
+	require.NoError(t, err)
+	assert.Len(t, tokens, 1)
+
+	refreshToken := models.NewOauthRefreshToken(client, user, 3600, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, refreshToken))
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteRefreshToken(ctx, refreshToken.Token))
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+
+	code := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+	gotCode, err := s.GetAuthorizationCode(ctx, code.Code)
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.example.com", gotCode.RedirectURI.String)
+	require.NoError(t, s.DeleteAuthorizationCode(ctx, code.Code))
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	assert.Equal(t, storage.ErrCodeNotFound, err)
+
+	// Expired tokens are reported as such and removed in batches
+	for i := 0; i < 3; i++ {
+		expired := models.NewOauthAccessToken(client, nil, -60, "read")
+		require.NoError(t, s.StoreAccessToken(ctx, expired))
+		if i == 0 {
+			_, err = s.GetAccessToken(ctx, expired.Token)
+			assert.Equal(t, storage.ErrTokenExpired, err)
+		}
+	}
+	removed, err := s.CleanupExpiredTokensBatch(ctx, storage.AllIDs, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	removed, err = s.CleanupExpiredTokensBatch(ctx, storage.AllIDs, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	require.NoError(t, s.BatchDeleteTokens(ctx, []string{accessToken.Token}))
+	_, err = s.GetAccessToken(ctx, accessToken.Token)
+	assert.Equal(t, storage.ErrTokenNotFound, err)
+}
+
+func TestScopes(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	for _, scope := range []*models.OauthScope{
+		{MyGormModel: models.MyGormModel{ID: "1"}, Scope: "read_write", IsDefault: false},
+		{MyGormModel: models.MyGormModel{ID: "2"}, Scope: "write", IsDefault: true},
+		{MyGormModel: models.MyGormModel{ID: "3"}, Scope: "read", IsDefault: true},
+	} {
+		require.NoError(t, s.DB().Create(scope).Error)
+	}
+
+	scope, err := s.GetDefaultScope(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "read write", scope)
+
+	_, err = s.GetScope(ctx, "read_write")
+	assert.NoError(t, err)
+	_, err = s.GetScope(ctx, "bogus")
+	assert.Equal(t, storage.ErrScopeNotFound, err)
+}
+
+func TestInMemory(t *testing.T) {
+	factory, err := storage.NewFactory()
+	require.NoError(t, err)
+
+	s, err := factory.CreateStorage(storage.StorageConfig{
+		Primary: storage.StorageBackend{
+			Type:   "sqlite",
+			Config: map[string]interface{}{"path": ":memory:"},
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The schema is visible to every query through the single connection
+	ctx := context.Background()
+	require.NoError(t, s.CreateClient(ctx, &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		Key:         "test_client_1",
+		Secret:      "secret",
+	}))
+	_, err = s.GetClient(ctx, "test_client_1")
+	assert.NoError(t, err)
+}
+
+func TestCachedClientKeys(t *testing.T) {
+	cnf, err := sqlite.ParseConfig(map[string]interface{}{
+		"path": filepath.Join(t.TempDir(), "oauth2.db"),
+	})
+	require.NoError(t, err)
+	cache, err := storage.NewMemoryCache(nil)
+	require.NoError(t, err)
+	s, err := sqlite.NewSQLiteStorage(cnf, cache, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1", Secret: "secret"}
+	require.NoError(t, s.CreateClient(ctx, client))
+
+	// Fetching the client by a differently cased key caches it under the
+	// key updates invalidate
+	_, err = s.GetClient(ctx, "TEST_Client_1")
+	require.NoError(t, err)
+	client.Secret = "new_secret"
+	client.Key = "Test_Client_1"
+	require.NoError(t, s.UpdateClient(ctx, client))
+	assert.Equal(t, "test_client_1", client.Key)
+	found, err := s.GetClient(ctx, "TEST_Client_1")
+	require.NoError(t, err)
+	assert.Equal(t, "new_secret", found.Secret)
+
+	// Renaming the client drops the entry cached under its old key
+	client.Key = "test_client_2"
+	require.NoError(t, s.UpdateClient(ctx, client))
+	_, err = s.GetClient(ctx, "test_client_1")
+	assert.Equal(t, storage.ErrClientNotFound, err)
+
+	require.NoError(t, s.DeleteClient(ctx, "TEST_CLIENT_2"))
+	_, err = s.GetClient(ctx, "test_client_2")
+	assert.Equal(t, storage.ErrClientNotFound, err)
+}
+
+func TestCachedUserKeys(t *testing.T) {
+	cnf, err := sqlite.ParseConfig(map[string]interface{}{
+		"path": filepath.Join(t.TempDir(), "oauth2.db"),
+	})
+	require.NoError(t, err)
+	cache, err := storage.NewMemoryCache(nil)
+	require.NoError(t, err)
+	s, err := sqlite.NewSQLiteStorage(cnf, cache, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+
+	user := &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: "1"},
+		RoleID:      util.StringOrNull("user"),
+		Username:    "Test@User",
+	}
+	require.NoError(t, s.CreateUser(ctx, user))
+
+	// Fetching the user by a differently cased username caches it under the
+	// key CreateUser invalidates
+	_, err = s.GetUser(ctx, "TEST@user")
+	require.NoError(t, err)
+	cached := new(models.OauthUser)
+	require.NoError(t, cache.Get(ctx, "user:test@user", cached))
+	assert.Equal(t, "test@user", cached.Username)
+	assert.Error(t, cache.Get(ctx, "user:TEST@user", cached))
+}
+
+func TestCircuitBreakerFailures(t *testing.T) {
+	s := newTestStorage(t)
+	breaker := storage.NewCircuitBreakerStorage(s, &storage.CircuitBreakerConfig{FailureThreshold: 2})
+	ctx := context.Background()
+
+	// Constraint violations are not failures
+	client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1", Secret: "secret"}
+	require.NoError(t, breaker.CreateClient(ctx, client))
+	for i := 0; i < 3; i++ {
+		assert.Error(t, breaker.CreateClient(ctx, client))
+	}
+	assert.Equal(t, storage.CircuitClosed, breaker.State())
+
+	// A closed database is
+	require.NoError(t, s.Close())
+	for i := 0; i < 2; i++ {
+		_, err := breaker.GetClient(ctx, "test_client_1")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, storage.CircuitOpen, breaker.State())
+}
+
+func TestTransactionRetries(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	conflict := errors.New("conflict")
+	s.SetRetryable(func(err error) bool { return errors.Is(err, conflict) })
+
+	// The client of the failed attempt is rolled back, or creating it again
+	// would violate the unique key
+	attempts := 0
+	err := s.WithTx(ctx, func(tx storage.Storage) error {
+		attempts++
+		client := &models.OauthClient{MyGormModel: models.MyGormModel{ID: "1"}, Key: "test_client_1", Secret: "secret"}
+		if err := tx.CreateClient(ctx, client); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return conflict
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	_, err = s.GetClient(ctx, "test_client_1")
+	assert.NoError(t, err)
+
+	// Retries are bounded
+	attempts = 0
+	err = s.WithTx(ctx, func(tx storage.Storage) error {
+		attempts++
+		return conflict
+	})
+	assert.Equal(t, conflict, err)
+	assert.Equal(t, 3, attempts)
+
+	// Other errors are returned at once
+	attempts = 0
+	err = s.WithTx(ctx, func(tx storage.Storage) error {
+		attempts++
+		return storage.ErrClientNotFound
+	})
+	assert.Equal(t, storage.ErrClientNotFound, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s := newTestStorage(t)
+		require.NoError(t, s.DB().Create(&models.OauthRole{ID: storagetest.RoleID, Name: "User"}).Error)
+		return s
+	})
+}
@@ -0,0 +1,867 @@
+// Package sqlstore implements storage.Storage on top of gorm, the SQL
+// backends embed it and only take care of connecting to their database
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/jinzhu/gorm"
+)
+
+// Store implements storage.Storage for any database gorm supports
+type Store struct {
+	db      *gorm.DB
+	metrics storage.MetricsProvider
+	cache   storage.CacheProvider
+
+	// Reports the errors WithTx retries a transaction on, see SetRetryable
+	retryable func(err error) bool
+
+	// Reports the driver's errors about the database being down, see
+	// SetUnavailable
+	unavailable func(err error) bool
+
+	// Set on the store of a running transaction, which bypasses the cache
+	// and collects the keys to drop once the transaction is over
+	txKeys *[]string
+}
+
+// New creates a Store on an open database, cache and metrics are optional
+func New(db *gorm.DB, cache storage.CacheProvider, metrics storage.MetricsProvider) *Store {
+	if metrics == nil {
+		metrics = storage.NewNoOpMetrics()
+	}
+	return &Store{
+		db:      db,
+		metrics: metrics,
+		cache:   cache,
+	}
+}
+
+// SetMetrics sets the provider queries are reported to
+func (s *Store) SetMetrics(metrics storage.MetricsProvider) {
+	s.metrics = metrics
+}
+
+// SetRetryable sets how the driver's serialization failures and deadlocks
+// are recognised, WithTx runs a transaction again when it fails on one
+func (s *Store) SetRetryable(retryable func(err error) bool) {
+	s.retryable = retryable
+}
+
+// SetUnavailable sets how the driver's errors about the database being
+// unreachable, overloaded or timing out are recognised, see IsUnavailable
+func (s *Store) SetUnavailable(unavailable func(err error) bool) {
+	s.unavailable = unavailable
+}
+
+// IsUnavailable reports errors that mean the database cannot serve queries,
+// it implements storage.UnavailableClassifier for the circuit breaker
+func (s *Store) IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// database/sql does not export the error of a closed database
+	if strings.Contains(err.Error(), "sql: database is closed") {
+		return true
+	}
+	return s.unavailable != nil && s.unavailable(err)
+}
+
+// DB returns the underlying database
+func (s *Store) DB() *gorm.DB {
+	return s.db
+}
+
+// record reports a query to the metrics provider
+func (s *Store) record(operation string, start time.Time, err error) {
+	s.metrics.RecordDatabaseQuery(operation, time.Since(start), err == nil)
+}
+
+// GetClient retrieves a client with caching support
+func (s *Store) GetClient(ctx context.Context, clientID string) (client *models.OauthClient, err error) {
+	start := time.Now()
+	defer func() { s.record("get_client", start, err) }()
+
+	// Try cache first, client keys are case insensitive so the key is cached
+	// lower case like the ones Create, Update and Delete invalidate
+	cacheKey := fmt.Sprintf("client:%s", strings.ToLower(clientID))
+	if s.cache != nil {
+		client = new(models.OauthClient)
+		if err := s.cache.Get(ctx, cacheKey, client); err == nil {
+			s.metrics.RecordCacheOperation("get_client", true, time.Since(start))
+			return client, nil
+		}
+		s.metrics.RecordCacheOperation("get_client", false, time.Since(start))
+	}
+
+	// Query database, client keys are stored lower case
+	client = new(models.OauthClient)
+	if err := s.db.Where(s.keyEquals(), clientID).First(client).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, storage.ErrClientNotFound
+		}
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+
+	// Cache the result
+	if s.cache != nil {
+		s.cache.Set(ctx, cacheKey, client, 5*time.Minute)
+	}
+
+	return client, nil
+}
+
+// CreateClient creates a new OAuth client
+func (s *Store) CreateClient(ctx context.Context, client *models.OauthClient) (err error) {
+	start := time.Now()
+	defer func() { s.record("create_client", start, err) }()
+
+	// Client keys are case insensitive
+	client.Key = strings.ToLower(client.Key)
+	if err := s.db.Create(client).Error; err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+
+	s.invalidate(ctx, fmt.Sprintf("client:%s", client.Key))
+	return nil
+}
+
+// UpdateClient updates an existing OAuth client
+func (s *Store) UpdateClient(ctx context.Context, client *models.OauthClient) (err error) {
+	start := time.Now()
+	defer func() { s.record("update_client", start, err) }()
+
+	// Save would insert a missing client
+	existing := new(models.OauthClient)
+	if s.db.Where("id = ?", client.ID).First(existing).RecordNotFound() {
+		return storage.ErrClientNotFound
+	}
+	client.Key = strings.ToLower(client.Key)
+	if err := s.db.Save(client).Error; err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+
+	// The key may have changed, the client is cached under the old one
+	s.invalidate(ctx, fmt.Sprintf("client:%s", existing.Key), fmt.Sprintf("client:%s", client.Key))
+	return nil
+}
+
+// DeleteClient deletes an OAuth client
+func (s *Store) DeleteClient(ctx context.Context, clientID string) (err error) {
+	start := time.Now()
+	defer func() { s.record("delete_client", start, err) }()
+
+	if err := s.db.Where(s.keyEquals(), clientID).Delete(new(models.OauthClient)).Error; err != nil {
+		return fmt.Errorf("failed to delete client: %w", err)
+	}
+
+	s.invalidate(ctx, fmt.Sprintf("client:%s", strings.ToLower(clientID)))
+	return nil
+}
+
+// GetUser retrieves a user with caching support
+func (s *Store) GetUser(ctx context.Context, username string) (user *models.OauthUser, err error) {
+	start := time.Now()
+	defer func() { s.record("get_user", start, err) }()
+
+	// Try cache first, usernames are case insensitive
+	cacheKey := fmt.Sprintf("user:%s", strings.ToLower(username))
+	if s.cache != nil {
+		user = new(models.OauthUser)
+		if err := s.cache.Get(ctx, cacheKey, user); err == nil {
+			s.metrics.RecordCacheOperation("get_user", true, time.Since(start))
+			return user, nil
+		}
+		s.metrics.RecordCacheOperation("get_user", false, time.Since(start))
+	}
+
+	// Query database, usernames are stored lower case
+	user = new(models.OauthUser)
+	if err := s.db.Where("username = LOWER(?)", username).First(user).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, storage.ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// Cache the result
+	if s.cache != nil {
+		s.cache.Set(ctx, cacheKey, user, 5*time.Minute)
+	}
+
+	return user, nil
+}
+
+// GetUserByID retrieves a user by ID
+func (s *Store) GetUserByID(ctx context.Context, userID string) (user *models.OauthUser, err error) {
+	start := time.Now()
+	defer func() { s.record("get_user_by_id", start, err) }()
+
+	user = new(models.OauthUser)
+	if err := s.db.Where("id = ?", userID).First(user).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, storage.ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user by ID: %w", err)
+	}
+
+	return user, nil
+}
+
+// CreateUser creates a new user
+func (s *Store) CreateUser(ctx context.Context, user *models.OauthUser) (err error) {
+	start := time.Now()
+	defer func() { s.record("create_user", start, err) }()
+
+	// Usernames are case insensitive
+	user.Username = strings.ToLower(user.Username)
+	if err := s.db.Omit("Role").Create(user).Error; err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	s.invalidate(ctx, fmt.Sprintf("user:%s", user.Username))
+	return nil
+}
+
+// AuthenticateUser authenticates a user with username and password
+func (s *Store) AuthenticateUser(ctx context.Context, username, password string) (*models.OauthUser, error) {
+	user, err := s.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users without a password can only log in through other means
+	if !user.Password.Valid {
+		return nil, storage.ErrInvalidCredentials
+	}
+	if err := pass.VerifyPassword(user.Password.String, password); err != nil {
+		return nil, storage.ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// StoreAccessToken stores an access token with optimized indexing
+func (s *Store) StoreAccessToken(ctx context.Context, token *models.OauthAccessToken) (err error) {
+	start := time.Now()
+	defer func() { s.record("store_access_token", start, err) }()
+
+	// Only the foreign keys are written, never the preloaded client or user
+	if err := s.db.Omit("Client", "User").Create(token).Error; err != nil {
+		return fmt.Errorf("failed to store access token: %w", err)
+	}
+
+	// Cache the token for fast lookup
+	if s.cache != nil {
+		cacheKey := fmt.Sprintf("access_token:%s", token.Token)
+		s.cache.Set(ctx, cacheKey, token, time.Until(token.ExpiresAt))
+	}
+
+	return nil
+}
+
+// GetAccessToken retrieves an access token with caching
+func (s *Store) GetAccessToken(ctx context.Context, tokenStr string) (token *models.OauthAccessToken, err error) {
+	start := time.Now()
+	defer func() { s.record("get_access_token", start, err) }()
+
+	// Try cache first
+	cacheKey := fmt.Sprintf("access_token:%s", tokenStr)
+	cached := false
+	if s.cache != nil {
+		token = new(models.OauthAccessToken)
+		cached = s.cache.Get(ctx, cacheKey, token) == nil
+		s.metrics.RecordCacheOperation("get_access_token", cached, time.Since(start))
+	}
+
+	// Query database with preloading for performance
+	if !cached {
+		token = new(models.OauthAccessToken)
+		if err := models.OauthAccessTokenPreload(s.db).Where("token = ?", tokenStr).First(token).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return nil, storage.ErrTokenNotFound
+			}
+			return nil, fmt.Errorf("failed to get access token: %w", err)
+		}
+	}
+
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrTokenExpired
+	}
+
+	// Cache the result until it expires
+	if s.cache != nil && !cached {
+		s.cache.Set(ctx, cacheKey, token, time.Until(token.ExpiresAt))
+	}
+
+	return token, nil
+}
+
+// DeleteAccessToken deletes an access token
+func (s *Store) DeleteAccessToken(ctx context.Context, tokenStr string) (err error) {
+	start := time.Now()
+	defer func() { s.record("delete_access_token", start, err) }()
+
+	if err := s.db.Unscoped().Where("token = ?", tokenStr).Delete(new(models.OauthAccessToken)).Error; err != nil {
+		return fmt.Errorf("failed to delete access token: %w", err)
+	}
+
+	s.invalidate(ctx, fmt.Sprintf("access_token:%s", tokenStr))
+	return nil
+}
+
+// StoreRefreshToken stores a refresh token
+func (s *Store) StoreRefreshToken(ctx context.Context, token *models.OauthRefreshToken) (err error) {
+	start := time.Now()
+	defer func() { s.record("store_refresh_token", start, err) }()
+
+	// Only the foreign keys are written, never the preloaded client or user
+	if err := s.db.Omit("Client", "User").Create(token).Error; err != nil {
+		return fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// GetRefreshToken retrieves a refresh token with its client and user
+func (s *Store) GetRefreshToken(ctx context.Context, tokenStr string) (token *models.OauthRefreshToken, err error) {
+	start := time.Now()
+	defer func() { s.record("get_refresh_token", start, err) }()
+
+	token = new(models.OauthRefreshToken)
+	if err := models.OauthRefreshTokenPreload(s.db).Where("token = ?", tokenStr).First(token).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, storage.ErrTokenNotFound
+		}
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	if token.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// DeleteRefreshToken deletes a refresh token
+func (s *Store) DeleteRefreshToken(ctx context.Context, tokenStr string) (err error) {
+	start := time.Now()
+	defer func() { s.record("delete_refresh_token", start, err) }()
+
+	if err := s.db.Unscoped().Where("token = ?", tokenStr).Delete(new(models.OauthRefreshToken)).Error; err != nil {
+		return fmt.Errorf("failed to delete refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// StoreAuthorizationCode stores an authorization code
+func (s *Store) StoreAuthorizationCode(ctx context.Context, code *models.OauthAuthorizationCode) (err error) {
+	start := time.Now()
+	defer func() { s.record("store_authorization_code", start, err) }()
+
+	// Only the foreign keys are written, never the preloaded client or user
+	if err := s.db.Omit("Client", "User").Create(code).Error; err != nil {
+		return fmt.Errorf("failed to store authorization code: %w", err)
+	}
+
+	return nil
+}
+
+// GetAuthorizationCode retrieves an authorization code with its client and user
+func (s *Store) GetAuthorizationCode(ctx context.Context, codeStr string) (code *models.OauthAuthorizationCode, err error) {
+	start := time.Now()
+	defer func() { s.record("get_authorization_code", start, err) }()
+
+	code = new(models.OauthAuthorizationCode)
+	if err := models.OauthAuthorizationCodePreload(s.db).Where("code = ?", codeStr).First(code).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, storage.ErrCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to get authorization code: %w", err)
+	}
+
+	if code.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrCodeExpired
+	}
+
+	return code, nil
+}
+
+// DeleteAuthorizationCode deletes an authorization code
+func (s *Store) DeleteAuthorizationCode(ctx context.Context, codeStr string) (err error) {
+	start := time.Now()
+	defer func() { s.record("delete_authorization_code", start, err) }()
+
+	deleted := s.db.Unscoped().Where("code = ?", codeStr).Delete(new(models.OauthAuthorizationCode))
+	if deleted.Error != nil {
+		return fmt.Errorf("failed to delete authorization code: %w", deleted.Error)
+	}
+	if deleted.RowsAffected == 0 {
+		return storage.ErrCodeNotFound
+	}
+
+	return nil
+}
+
+// GetScope retrieves a single scope
+func (s *Store) GetScope(ctx context.Context, scope string) (scopeObj *models.OauthScope, err error) {
+	start := time.Now()
+	defer func() { s.record("get_scope", start, err) }()
+
+	scopeObj = new(models.OauthScope)
+	if err := s.db.Where("scope = ?", scope).First(scopeObj).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, storage.ErrScopeNotFound
+		}
+		return nil, fmt.Errorf("failed to get scope: %w", err)
+	}
+
+	return scopeObj, nil
+}
+
+// GetDefaultScope returns the default scopes sorted and space delimited
+func (s *Store) GetDefaultScope(ctx context.Context) (scope string, err error) {
+	start := time.Now()
+	defer func() { s.record("get_default_scope", start, err) }()
+
+	var scopes []string
+	if err := s.db.Model(new(models.OauthScope)).Where("is_default = ?", true).Pluck("scope", &scopes).Error; err != nil {
+		return "", fmt.Errorf("failed to get default scope: %w", err)
+	}
+	sort.Strings(scopes)
+
+	return strings.Join(scopes, " "), nil
+}
+
+// ListClients lists clients ordered by key
+func (s *Store) ListClients(ctx context.Context, options storage.ListOptions) (page *storage.ClientPage, err error) {
+	start := time.Now()
+	defer func() { s.record("list_clients", start, err) }()
+
+	db, limit, err := s.pageQuery(s.db, s.db.Dialect().Quote("key"), options)
+	if err != nil {
+		return nil, err
+	}
+	var clients []*models.OauthClient
+	if err := db.Find(&clients).Error; err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+
+	page = &storage.ClientPage{Clients: clients}
+	if len(clients) > limit {
+		page.Clients = clients[:limit]
+		page.NextCursor = storage.EncodeCursor(clients[limit-1].Key)
+	}
+	return page, nil
+}
+
+// ListUsers lists users ordered by username
+func (s *Store) ListUsers(ctx context.Context, options storage.ListOptions) (page *storage.UserPage, err error) {
+	start := time.Now()
+	defer func() { s.record("list_users", start, err) }()
+
+	db, limit, err := s.pageQuery(s.db, "username", options)
+	if err != nil {
+		return nil, err
+	}
+	var users []*models.OauthUser
+	if err := db.Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	page = &storage.UserPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.NextCursor = storage.EncodeCursor(users[limit-1].Username)
+	}
+	return page, nil
+}
+
+// ListScopes lists scopes ordered by scope
+func (s *Store) ListScopes(ctx context.Context, options storage.ListOptions) (page *storage.ScopePage, err error) {
+	start := time.Now()
+	defer func() { s.record("list_scopes", start, err) }()
+
+	db, limit, err := s.pageQuery(s.db, "scope", options)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []*models.OauthScope
+	if err := db.Find(&scopes).Error; err != nil {
+		return nil, fmt.Errorf("failed to list scopes: %w", err)
+	}
+
+	page = &storage.ScopePage{Scopes: scopes}
+	if len(scopes) > limit {
+		page.Scopes = scopes[:limit]
+		page.NextCursor = storage.EncodeCursor(scopes[limit-1].Scope)
+	}
+	return page, nil
+}
+
+// ListTokens lists the access tokens matching filter ordered by token, with
+// their client and user
+func (s *Store) ListTokens(ctx context.Context, filter storage.TokenFilter, options storage.ListOptions) (page *storage.TokenPage, err error) {
+	start := time.Now()
+	defer func() { s.record("list_tokens", start, err) }()
+
+	db := models.OauthAccessTokenPreload(s.db).Where("expires_at > ?", time.Now())
+	if filter.ClientID != "" {
+		db = db.Where("client_id = ?", filter.ClientID)
+	}
+	if filter.UserID != "" {
+		db = db.Where("user_id = ?", filter.UserID)
+	}
+	if !filter.ExpiresBefore.IsZero() {
+		db = db.Where("expires_at < ?", filter.ExpiresBefore)
+	}
+	db, limit, err := s.pageQuery(db, "token", options)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*models.OauthAccessToken
+	if err := db.Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	page = &storage.TokenPage{Tokens: tokens}
+	if len(tokens) > limit {
+		page.Tokens = tokens[:limit]
+		page.NextCursor = storage.EncodeCursor(tokens[limit-1].Token)
+	}
+	return page, nil
+}
+
+// CountActiveTokens counts the access tokens that have not expired
+func (s *Store) CountActiveTokens(ctx context.Context) (count int, err error) {
+	start := time.Now()
+	defer func() { s.record("count_active_tokens", start, err) }()
+
+	if err := s.db.Model(new(models.OauthAccessToken)).Where("expires_at > ?", time.Now()).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count active tokens: %w", err)
+	}
+	return count, nil
+}
+
+// RevokeUserTokens deletes everything issued to the user with userID
+func (s *Store) RevokeUserTokens(ctx context.Context, userID string) (result *storage.RevokeResult, err error) {
+	start := time.Now()
+	defer func() { s.record("revoke_user_tokens", start, err) }()
+
+	return s.revoke(ctx, "user_id = ?", userID, "")
+}
+
+// RevokeClientTokens deletes everything issued to the client with clientID
+func (s *Store) RevokeClientTokens(ctx context.Context, clientID string) (result *storage.RevokeResult, err error) {
+	start := time.Now()
+	defer func() { s.record("revoke_client_tokens", start, err) }()
+
+	return s.revoke(ctx, "client_id = ?", clientID, "")
+}
+
+// RevokeTokensWithScope deletes everything granted scope. Scopes are stored
+// space delimited, so rows are matched with LIKE and checked one by one.
+func (s *Store) RevokeTokensWithScope(ctx context.Context, scope string) (result *storage.RevokeResult, err error) {
+	start := time.Now()
+	defer func() { s.record("revoke_tokens_with_scope", start, err) }()
+
+	if scope == "" {
+		return new(storage.RevokeResult), nil
+	}
+	return s.revoke(ctx, "scope LIKE ?", "%"+scope+"%", scope)
+}
+
+// revoke deletes the access tokens, refresh tokens and authorization codes
+// matching query in one transaction, only those granted scope unless it is
+// empty. Nothing is deleted for an empty value.
+func (s *Store) revoke(ctx context.Context, query, value, scope string) (*storage.RevokeResult, error) {
+	result := new(storage.RevokeResult)
+	if value == "" {
+		return result, nil
+	}
+
+	err := s.WithTx(ctx, func(tx storage.Storage) error {
+		// A retried transaction starts over
+		result = new(storage.RevokeResult)
+		return tx.(*Store).revokeRows(ctx, result, query, value, scope)
+	})
+	if err != nil {
+		return new(storage.RevokeResult), err
+	}
+	return result, nil
+}
+
+// revokeRows deletes the rows revoke selects and counts them in result
+func (s *Store) revokeRows(ctx context.Context, result *storage.RevokeResult, query, value, scope string) error {
+	for _, table := range []struct {
+		model  interface{}
+		column string
+		count  *int
+		values *[]string
+	}{
+		{new(models.OauthAccessToken), "token", &result.AccessTokens, &result.Tokens},
+		{new(models.OauthRefreshToken), "token", &result.RefreshTokens, &result.RefreshTokenValues},
+		{new(models.OauthAuthorizationCode), "code", &result.AuthorizationCodes, nil},
+	} {
+		var rows []struct {
+			ID    string
+			Value string
+			Scope string
+		}
+		err := s.db.Unscoped().Model(table.model).
+			Select(fmt.Sprintf("id, %s AS value, scope", table.column)).
+			Where(query, value).Scan(&rows).Error
+		if err != nil {
+			return fmt.Errorf("failed to revoke tokens: %w", err)
+		}
+
+		var ids, values []string
+		for _, row := range rows {
+			if scope == "" || storage.HasScope(row.Scope, scope) {
+				ids = append(ids, row.ID)
+				values = append(values, row.Value)
+			}
+		}
+		// IN lists are kept short, SQLite limits the number of parameters
+		for i := 0; i < len(ids); i += revokeBatchSize {
+			end := min(i+revokeBatchSize, len(ids))
+			deleted := s.db.Unscoped().Where("id IN (?)", ids[i:end]).Delete(table.model)
+			if deleted.Error != nil {
+				return fmt.Errorf("failed to revoke tokens: %w", deleted.Error)
+			}
+			*table.count += int(deleted.RowsAffected)
+		}
+		if table.values != nil {
+			*table.values = values
+		}
+	}
+
+	// Dropped from the cache once the transaction is over
+	cacheKeys := make([]string, 0, len(result.Tokens))
+	for _, token := range result.Tokens {
+		cacheKeys = append(cacheKeys, fmt.Sprintf("access_token:%s", token))
+	}
+	s.invalidate(ctx, cacheKeys...)
+
+	return nil
+}
+
+// BatchGetTokens retrieves multiple tokens in a single query for performance
+func (s *Store) BatchGetTokens(ctx context.Context, tokens []string) (accessTokens []*models.OauthAccessToken, err error) {
+	start := time.Now()
+	defer func() { s.record("batch_get_tokens", start, err) }()
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	if err := models.OauthAccessTokenPreload(s.db).Where("token IN (?)", tokens).Where("expires_at >= ?", time.Now()).Find(&accessTokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to batch get tokens: %w", err)
+	}
+
+	return accessTokens, nil
+}
+
+// BatchDeleteTokens deletes multiple tokens in a single query
+func (s *Store) BatchDeleteTokens(ctx context.Context, tokens []string) (err error) {
+	start := time.Now()
+	defer func() { s.record("batch_delete_tokens", start, err) }()
+
+	if len(tokens) == 0 {
+		return nil
+	}
+	if err := s.db.Unscoped().Where("token IN (?)", tokens).Delete(new(models.OauthAccessToken)).Error; err != nil {
+		return fmt.Errorf("failed to batch delete tokens: %w", err)
+	}
+
+	// Remove from cache
+	cacheKeys := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		cacheKeys = append(cacheKeys, fmt.Sprintf("access_token:%s", token))
+	}
+	s.invalidate(ctx, cacheKeys...)
+
+	return nil
+}
+
+// CleanupExpiredTokens removes expired tokens for database maintenance
+func (s *Store) CleanupExpiredTokens(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { s.record("cleanup_expired_tokens", start, err) }()
+
+	now := time.Now()
+
+	// Clean up access tokens
+	if err := s.db.Unscoped().Where("expires_at < ?", now).Delete(new(models.OauthAccessToken)).Error; err != nil {
+		return fmt.Errorf("failed to cleanup expired access tokens: %w", err)
+	}
+
+	// Clean up refresh tokens
+	if err := s.db.Unscoped().Where("expires_at < ?", now).Delete(new(models.OauthRefreshToken)).Error; err != nil {
+		return fmt.Errorf("failed to cleanup expired refresh tokens: %w", err)
+	}
+
+	// Clean up authorization codes
+	if err := s.db.Unscoped().Where("expires_at < ?", now).Delete(new(models.OauthAuthorizationCode)).Error; err != nil {
+		return fmt.Errorf("failed to cleanup expired authorization codes: %w", err)
+	}
+
+	return nil
+}
+
+// CleanupExpiredTokensBatch removes up to limit expired tokens and codes with
+// IDs in ids, each delete is bounded so it never locks large parts of the
+// tables
+func (s *Store) CleanupExpiredTokensBatch(ctx context.Context, ids storage.IDRange, limit int) (removed int, err error) {
+	start := time.Now()
+	defer func() { s.record("cleanup_expired_tokens_batch", start, err) }()
+
+	now := time.Now()
+	for _, model := range []interface{}{
+		new(models.OauthAccessToken),
+		new(models.OauthRefreshToken),
+		new(models.OauthAuthorizationCode),
+	} {
+		if removed >= limit {
+			break
+		}
+		// The IDs are fetched first, MySQL does not allow LIMIT in IN subqueries
+		db := s.db.Unscoped().Model(model).Where("expires_at < ?", now)
+		if ids.From != "" {
+			db = db.Where("id >= ?", ids.From)
+		}
+		if ids.To != "" {
+			db = db.Where("id < ?", ids.To)
+		}
+		var expired []string
+		if err := db.Limit(limit-removed).Pluck("id", &expired).Error; err != nil {
+			return removed, fmt.Errorf("failed to cleanup expired tokens: %w", err)
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		result := s.db.Unscoped().Where("id IN (?)", expired).Delete(model)
+		if result.Error != nil {
+			return removed, fmt.Errorf("failed to cleanup expired tokens: %w", result.Error)
+		}
+		removed += int(result.RowsAffected)
+	}
+
+	return removed, nil
+}
+
+// maxTxAttempts is how many times WithTx runs a transaction that keeps
+// failing on a retryable error
+const maxTxAttempts = 3
+
+// WithTx runs fn in a serializable database transaction and runs it again,
+// after a short pause, when it fails on an error SetRetryable recognises. The cache is
+// bypassed inside the transaction, entries it wrote are dropped once it is
+// over.
+func (s *Store) WithTx(ctx context.Context, fn func(tx storage.Storage) error) (err error) {
+	if s.txKeys != nil {
+		return fn(s)
+	}
+
+	start := time.Now()
+	defer func() { s.record("transaction", start, err) }()
+
+	// Rolled back attempts may have written cached entries as well
+	var cacheKeys []string
+	defer func() { s.invalidate(ctx, cacheKeys...) }()
+
+	for attempt := 1; ; attempt++ {
+		err = s.runTx(ctx, &cacheKeys, fn)
+		if err == nil || s.retryable == nil || !s.retryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+// runTx runs fn once, committing when it succeeds and rolling back otherwise
+func (s *Store) runTx(ctx context.Context, cacheKeys *[]string, fn func(tx storage.Storage) error) error {
+	// Postgres and MySQL default to weaker isolation levels, which would let
+	// concurrent transactions act on rows the other one has changed
+	db := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if db.Error != nil {
+		return fmt.Errorf("failed to begin transaction: %w", db.Error)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			db.Rollback()
+			panic(p)
+		}
+	}()
+
+	tx := &Store{db: db, metrics: s.metrics, retryable: s.retryable, unavailable: s.unavailable, txKeys: cacheKeys}
+	if err := fn(tx); err != nil {
+		db.Rollback()
+		return err
+	}
+	if err := db.Commit().Error; err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// HealthCheck verifies database connectivity
+func (s *Store) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return s.db.DB().PingContext(ctx)
+}
+
+// Close closes the database connection
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// revokeBatchSize is the number of rows deleted by a single revocation query
+const revokeBatchSize = 500
+
+// keyEquals matches client keys, key is a reserved word in some dialects
+func (s *Store) keyEquals() string {
+	return s.db.Dialect().Quote("key") + " = LOWER(?)"
+}
+
+// pageQuery orders db by column and selects the page options asks for. One
+// row more than the returned limit is fetched, it tells whether there is a
+// next page.
+func (s *Store) pageQuery(db *gorm.DB, column string, options storage.ListOptions) (*gorm.DB, int, error) {
+	after, err := options.After()
+	if err != nil {
+		return nil, 0, err
+	}
+	if after != "" {
+		db = db.Where(column+" > ?", after)
+	}
+	limit := options.PageSize()
+	return db.Order(column).Limit(limit + 1), limit, nil
+}
+
+// invalidate drops cached entries after a write, a transaction drops them
+// once it is over
+func (s *Store) invalidate(ctx context.Context, cacheKeys ...string) {
+	switch {
+	case len(cacheKeys) == 0:
+	case s.txKeys != nil:
+		*s.txKeys = append(*s.txKeys, cacheKeys...)
+	case s.cache != nil:
+		s.cache.DeleteMulti(ctx, cacheKeys)
+	}
+}
@@ -0,0 +1,897 @@
+// Package storagetest provides a conformance suite for storage.Storage
+// implementations. Backends run it from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return newTestStorage(t)
+//		})
+//	}
+//
+// The suite only creates records with unique keys, so the storage may be
+// shared between tests and need not be empty. Users are created with the
+// role ID "user", backends enforcing foreign keys must have that role.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/util"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RoleID is the role the suite's users are created with
+const RoleID = "user"
+
+// Password is the password of the suite's users
+const Password = "test_password"
+
+// Option changes what the suite expects of the storage
+type Option func(*options)
+
+type options struct {
+	rollback bool
+}
+
+// WithoutRollback is for backends whose WithTx cannot roll back, such as
+// Redis, the suite then only checks that transactions commit
+func WithoutRollback() Option {
+	return func(o *options) {
+		o.rollback = false
+	}
+}
+
+// Run runs the conformance suite, newStorage is called once per test and
+// should close the storage it returns with t.Cleanup
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage, opts ...Option) {
+	o := &options{rollback: true}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"Clients", testClients},
+		{"ClientKeysAreCaseInsensitive", testClientKeysAreCaseInsensitive},
+		{"Users", testUsers},
+		{"UsernamesAreCaseInsensitive", testUsernamesAreCaseInsensitive},
+		{"AuthenticateUser", testAuthenticateUser},
+		{"AccessTokens", testAccessTokens},
+		{"RefreshTokens", testRefreshTokens},
+		{"AuthorizationCodes", testAuthorizationCodes},
+		{"ConcurrentCodeExchange", testConcurrentCodeExchange},
+		{"Expiry", testExpiry},
+		{"Scopes", testScopes},
+		{"ListClients", testListClients},
+		{"ListUsers", testListUsers},
+		{"ListScopes", testListScopes},
+		{"ListTokens", testListTokens},
+		{"CountActiveTokens", testCountActiveTokens},
+		{"Revocation", testRevocation},
+		{"Transactions", func(t *testing.T, s storage.Storage) { testTransactions(t, s, o.rollback) }},
+		{"HashMigration", testHashMigration},
+		{"BatchOperations", testBatchOperations},
+		{"CleanupExpiredTokens", testCleanupExpiredTokens},
+		{"ConcurrentAccess", testConcurrentAccess},
+		{"HealthCheck", testHealthCheck},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+var (
+	passwordHash     string
+	passwordHashOnce sync.Once
+)
+
+// hashPassword hashes Password once, hashing is slow on purpose
+func hashPassword(t *testing.T) string {
+	passwordHashOnce.Do(func() {
+		hash, err := pass.HashPassword(Password)
+		require.NoError(t, err)
+		passwordHash = string(hash)
+	})
+	require.NotEmpty(t, passwordHash)
+	return passwordHash
+}
+
+// newClient creates a client with a unique lower case key
+func newClient(t *testing.T, s storage.Storage) *models.OauthClient {
+	client := &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: uuid.New().String()},
+		Key:         "client-" + uuid.New().String(),
+		Secret:      "$2a$10$secret",
+		RedirectURI: util.StringOrNull("https://www.example.com"),
+	}
+	require.NoError(t, s.CreateClient(context.Background(), client))
+	return client
+}
+
+// newUser creates a user with a unique lower case username
+func newUser(t *testing.T, s storage.Storage) *models.OauthUser {
+	user := &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: uuid.New().String()},
+		RoleID:      util.StringOrNull(RoleID),
+		Username:    "user-" + uuid.New().String() + "@example.com",
+		Password:    util.StringOrNull(hashPassword(t)),
+	}
+	require.NoError(t, s.CreateUser(context.Background(), user))
+	return user
+}
+
+// isGone tells whether err reports a token or code that expired, backends
+// that drop expired records report them as not found
+func isGone(err, expired, notFound error) bool {
+	return errors.Is(err, expired) || errors.Is(err, notFound)
+}
+
+func testClients(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client := newClient(t, s)
+
+	found, err := s.GetClient(ctx, client.Key)
+	require.NoError(t, err)
+	assert.Equal(t, client.ID, found.ID)
+	assert.Equal(t, client.Key, found.Key)
+	assert.Equal(t, client.Secret, found.Secret)
+	assert.Equal(t, "https://www.example.com", found.RedirectURI.String)
+
+	_, err = s.GetClient(ctx, "bogus-"+uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+
+	found.RedirectURI = util.StringOrNull("https://www.example.com/callback")
+	require.NoError(t, s.UpdateClient(ctx, found))
+	found, err = s.GetClient(ctx, client.Key)
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.example.com/callback", found.RedirectURI.String)
+
+	// Updating never creates a client
+	missing := &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: uuid.New().String()},
+		Key:         "client-" + uuid.New().String(),
+	}
+	err = s.UpdateClient(ctx, missing)
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+	_, err = s.GetClient(ctx, missing.Key)
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+
+	require.NoError(t, s.DeleteClient(ctx, client.Key))
+	_, err = s.GetClient(ctx, client.Key)
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+
+	// Deleting a missing client is not an error
+	assert.NoError(t, s.DeleteClient(ctx, client.Key))
+}
+
+func testClientKeysAreCaseInsensitive(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client := &models.OauthClient{
+		MyGormModel: models.MyGormModel{ID: uuid.New().String()},
+		Key:         "Client-" + strings.ToUpper(uuid.New().String()),
+		Secret:      "secret",
+	}
+	key := client.Key
+	require.NoError(t, s.CreateClient(ctx, client))
+
+	for _, lookup := range []string{key, strings.ToLower(key), strings.ToUpper(key)} {
+		found, err := s.GetClient(ctx, lookup)
+		if assert.NoError(t, err, lookup) {
+			assert.Equal(t, client.ID, found.ID)
+			assert.Equal(t, strings.ToLower(key), found.Key, "keys are stored lower case")
+		}
+	}
+
+	require.NoError(t, s.DeleteClient(ctx, strings.ToUpper(key)))
+	_, err := s.GetClient(ctx, key)
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+}
+
+func testUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	user := newUser(t, s)
+
+	found, err := s.GetUser(ctx, user.Username)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.Equal(t, user.Username, found.Username)
+	assert.Equal(t, RoleID, found.RoleID.String)
+
+	found, err = s.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, user.Username, found.Username)
+
+	_, err = s.GetUser(ctx, "bogus-"+uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrUserNotFound), "got %v", err)
+	_, err = s.GetUserByID(ctx, uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrUserNotFound), "got %v", err)
+}
+
+func testUsernamesAreCaseInsensitive(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	user := &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: uuid.New().String()},
+		RoleID:      util.StringOrNull(RoleID),
+		Username:    "User-" + strings.ToUpper(uuid.New().String()) + "@Example.com",
+	}
+	username := user.Username
+	require.NoError(t, s.CreateUser(ctx, user))
+
+	for _, lookup := range []string{username, strings.ToLower(username), strings.ToUpper(username)} {
+		found, err := s.GetUser(ctx, lookup)
+		if assert.NoError(t, err, lookup) {
+			assert.Equal(t, user.ID, found.ID)
+			assert.Equal(t, strings.ToLower(username), found.Username, "usernames are stored lower case")
+		}
+	}
+}
+
+func testAuthenticateUser(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	user := newUser(t, s)
+
+	found, err := s.AuthenticateUser(ctx, strings.ToUpper(user.Username), Password)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	_, err = s.AuthenticateUser(ctx, user.Username, "bogus")
+	assert.True(t, errors.Is(err, storage.ErrInvalidCredentials), "got %v", err)
+	_, err = s.AuthenticateUser(ctx, "bogus-"+uuid.New().String(), Password)
+	assert.True(t, errors.Is(err, storage.ErrUserNotFound), "got %v", err)
+
+	// Users without a password cannot log in with one
+	passwordless := &models.OauthUser{
+		MyGormModel: models.MyGormModel{ID: uuid.New().String()},
+		RoleID:      util.StringOrNull(RoleID),
+		Username:    "user-" + uuid.New().String() + "@example.com",
+	}
+	require.NoError(t, s.CreateUser(ctx, passwordless))
+	_, err = s.AuthenticateUser(ctx, passwordless.Username, "")
+	assert.True(t, errors.Is(err, storage.ErrInvalidCredentials), "got %v", err)
+}
+
+func testAccessTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+
+	accessToken := models.NewOauthAccessToken(client, user, 3600, "read write")
+	require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	found, err := s.GetAccessToken(ctx, accessToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, accessToken.Token, found.Token)
+	assert.Equal(t, client.ID, found.ClientID.String)
+	assert.Equal(t, user.ID, found.UserID.String)
+	assert.Equal(t, "read write", found.Scope)
+	assert.WithinDuration(t, accessToken.ExpiresAt, found.ExpiresAt, time.Second)
+
+	// Client credentials tokens have no user
+	clientToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, clientToken))
+	found, err = s.GetAccessToken(ctx, clientToken.Token)
+	require.NoError(t, err)
+	assert.False(t, found.UserID.Valid)
+
+	_, err = s.GetAccessToken(ctx, uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+
+	require.NoError(t, s.DeleteAccessToken(ctx, accessToken.Token))
+	_, err = s.GetAccessToken(ctx, accessToken.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	assert.NoError(t, s.DeleteAccessToken(ctx, accessToken.Token))
+
+	// Deleting one token leaves the others alone
+	_, err = s.GetAccessToken(ctx, clientToken.Token)
+	assert.NoError(t, err)
+}
+
+func testRefreshTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+
+	refreshToken := models.NewOauthRefreshToken(client, user, 7200, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, refreshToken))
+	found, err := s.GetRefreshToken(ctx, refreshToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, refreshToken.Token, found.Token)
+	assert.Equal(t, client.ID, found.ClientID.String)
+	assert.Equal(t, user.ID, found.UserID.String)
+	assert.Equal(t, "read", found.Scope)
+	assert.WithinDuration(t, refreshToken.ExpiresAt, found.ExpiresAt, time.Second)
+
+	_, err = s.GetRefreshToken(ctx, uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+
+	require.NoError(t, s.DeleteRefreshToken(ctx, refreshToken.Token))
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	assert.NoError(t, s.DeleteRefreshToken(ctx, refreshToken.Token))
+}
+
+func testAuthorizationCodes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+
+	code := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com/callback", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+	found, err := s.GetAuthorizationCode(ctx, code.Code)
+	require.NoError(t, err)
+	assert.Equal(t, code.Code, found.Code)
+	assert.Equal(t, client.ID, found.ClientID.String)
+	assert.Equal(t, user.ID, found.UserID.String)
+	assert.Equal(t, "https://www.example.com/callback", found.RedirectURI.String)
+	assert.Equal(t, "read", found.Scope)
+	assert.WithinDuration(t, code.ExpiresAt, found.ExpiresAt, time.Second)
+
+	_, err = s.GetAuthorizationCode(ctx, uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+
+	require.NoError(t, s.DeleteAuthorizationCode(ctx, code.Code))
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+	// A code is only consumed once
+	err = s.DeleteAuthorizationCode(ctx, code.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+}
+
+// testConcurrentCodeExchange consumes a code and issues a token the way the
+// authorization code grant does, only one of the concurrent exchanges wins
+func testConcurrentCodeExchange(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+	code := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+
+	const exchanges = 8
+	errs := make(chan error, exchanges)
+	var wg sync.WaitGroup
+	for i := 0; i < exchanges; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.WithTx(ctx, func(tx storage.Storage) error {
+				if err := tx.DeleteAuthorizationCode(ctx, code.Code); err != nil {
+					return err
+				}
+				return tx.StoreAccessToken(ctx, models.NewOauthAccessToken(client, user, 3600, "read"))
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	exchanged := 0
+	for err := range errs {
+		if err == nil {
+			exchanged++
+			continue
+		}
+		assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+	}
+	assert.Equal(t, 1, exchanged)
+}
+
+func testExpiry(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+
+	accessToken := models.NewOauthAccessToken(client, user, -60, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	_, err := s.GetAccessToken(ctx, accessToken.Token)
+	assert.True(t, isGone(err, storage.ErrTokenExpired, storage.ErrTokenNotFound), "got %v", err)
+
+	refreshToken := models.NewOauthRefreshToken(client, user, -60, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, refreshToken))
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	assert.True(t, isGone(err, storage.ErrTokenExpired, storage.ErrTokenNotFound), "got %v", err)
+
+	code := models.NewOauthAuthorizationCode(client, user, -60, "https://www.example.com", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	assert.True(t, isGone(err, storage.ErrCodeExpired, storage.ErrCodeNotFound), "got %v", err)
+
+	// Tokens stop working once they expire
+	expiring := models.NewOauthAccessToken(client, user, 1, "read")
+	expiring.ExpiresAt = time.Now().UTC().Add(200 * time.Millisecond)
+	require.NoError(t, s.StoreAccessToken(ctx, expiring))
+	_, err = s.GetAccessToken(ctx, expiring.Token)
+	require.NoError(t, err)
+	time.Sleep(time.Until(expiring.ExpiresAt) + 50*time.Millisecond)
+	_, err = s.GetAccessToken(ctx, expiring.Token)
+	assert.True(t, isGone(err, storage.ErrTokenExpired, storage.ErrTokenNotFound), "got %v", err)
+}
+
+func testScopes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	_, err := s.GetScope(ctx, "bogus-"+uuid.New().String())
+	assert.True(t, errors.Is(err, storage.ErrScopeNotFound), "got %v", err)
+
+	// Which scopes are default is up to the data, only the call must work
+	_, err = s.GetDefaultScope(ctx)
+	assert.NoError(t, err)
+}
+
+// listAll follows the cursors of a listing from the first page to the last
+// and returns the keys of every page, list returns the keys and cursor of
+// the page options selects
+func listAll(t *testing.T, limit int, list func(options storage.ListOptions) ([]string, string, error)) []string {
+	var all []string
+	seen := make(map[string]bool)
+	options := storage.ListOptions{Limit: limit}
+	for i := 0; ; i++ {
+		require.Less(t, i, 10000, "listing never reached the last page")
+		keys, next, err := list(options)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(keys), limit)
+		for _, key := range keys {
+			require.False(t, seen[key], "%s listed twice", key)
+			seen[key] = true
+			all = append(all, key)
+		}
+		if next == "" {
+			return all
+		}
+		require.NotEmpty(t, keys, "a page before the last one is empty")
+		options.Cursor = next
+	}
+}
+
+func testListClients(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	var keys []string
+	for i := 0; i < 3; i++ {
+		keys = append(keys, newClient(t, s).Key)
+	}
+	deleted := newClient(t, s)
+	require.NoError(t, s.DeleteClient(ctx, deleted.Key))
+
+	listed := listAll(t, 2, func(options storage.ListOptions) ([]string, string, error) {
+		page, err := s.ListClients(ctx, options)
+		if err != nil {
+			return nil, "", err
+		}
+		var keys []string
+		for _, client := range page.Clients {
+			keys = append(keys, client.Key)
+		}
+		return keys, page.NextCursor, nil
+	})
+	assert.Subset(t, listed, keys)
+	assert.NotContains(t, listed, deleted.Key)
+
+	_, err := s.ListClients(ctx, storage.ListOptions{Cursor: "!"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "got %v", err)
+}
+
+func testListUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	var usernames []string
+	for i := 0; i < 3; i++ {
+		usernames = append(usernames, newUser(t, s).Username)
+	}
+
+	listed := listAll(t, 2, func(options storage.ListOptions) ([]string, string, error) {
+		page, err := s.ListUsers(ctx, options)
+		if err != nil {
+			return nil, "", err
+		}
+		var usernames []string
+		for _, user := range page.Users {
+			usernames = append(usernames, user.Username)
+		}
+		return usernames, page.NextCursor, nil
+	})
+	assert.Subset(t, listed, usernames)
+
+	_, err := s.ListUsers(ctx, storage.ListOptions{Cursor: "!"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "got %v", err)
+}
+
+func testListScopes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	// There is no way to create scopes, every listed scope must be found
+	listed := listAll(t, 1, func(options storage.ListOptions) ([]string, string, error) {
+		page, err := s.ListScopes(ctx, options)
+		if err != nil {
+			return nil, "", err
+		}
+		var scopes []string
+		for _, scope := range page.Scopes {
+			scopes = append(scopes, scope.Scope)
+		}
+		return scopes, page.NextCursor, nil
+	})
+	for _, scope := range listed {
+		_, err := s.GetScope(ctx, scope)
+		assert.NoError(t, err, scope)
+	}
+
+	_, err := s.ListScopes(ctx, storage.ListOptions{Cursor: "!"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "got %v", err)
+}
+
+func testListTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, other, user := newClient(t, s), newClient(t, s), newUser(t, s)
+
+	userToken := models.NewOauthAccessToken(client, user, 3600, "read")
+	clientToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+	expiring := models.NewOauthAccessToken(client, user, 60, "read")
+	expired := models.NewOauthAccessToken(client, user, -60, "read")
+	otherToken := models.NewOauthAccessToken(other, user, 3600, "read")
+	for _, accessToken := range []*models.OauthAccessToken{userToken, clientToken, expiring, expired, otherToken} {
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	}
+
+	// Tokens are compared by ID, HashedStorage lists the stored hashes
+	list := func(filter storage.TokenFilter, limit int) []string {
+		return listAll(t, limit, func(options storage.ListOptions) ([]string, string, error) {
+			page, err := s.ListTokens(ctx, filter, options)
+			if err != nil {
+				return nil, "", err
+			}
+			var ids []string
+			for _, accessToken := range page.Tokens {
+				ids = append(ids, accessToken.ID)
+			}
+			return ids, page.NextCursor, nil
+		})
+	}
+
+	assert.ElementsMatch(t, []string{userToken.ID, clientToken.ID, expiring.ID}, list(storage.TokenFilter{ClientID: client.ID}, 1))
+	assert.ElementsMatch(t, []string{userToken.ID, expiring.ID, otherToken.ID}, list(storage.TokenFilter{UserID: user.ID}, 2))
+	assert.ElementsMatch(t, []string{expiring.ID}, list(storage.TokenFilter{
+		ClientID:      client.ID,
+		ExpiresBefore: time.Now().Add(10 * time.Minute),
+	}, 10))
+	assert.Empty(t, list(storage.TokenFilter{ClientID: uuid.New().String()}, 10))
+
+	require.NoError(t, s.DeleteAccessToken(ctx, userToken.Token))
+	assert.ElementsMatch(t, []string{expiring.ID, otherToken.ID}, list(storage.TokenFilter{UserID: user.ID}, 10))
+
+	_, err := s.ListTokens(ctx, storage.TokenFilter{}, storage.ListOptions{Cursor: "!"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "got %v", err)
+}
+
+func testCountActiveTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client := newClient(t, s)
+
+	before, err := s.CountActiveTokens(ctx)
+	require.NoError(t, err)
+
+	active := models.NewOauthAccessToken(client, nil, 3600, "read")
+	for _, accessToken := range []*models.OauthAccessToken{
+		active,
+		models.NewOauthAccessToken(client, nil, 3600, "read"),
+		models.NewOauthAccessToken(client, nil, -60, "read"),
+	} {
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	}
+	count, err := s.CountActiveTokens(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before+2, count)
+
+	require.NoError(t, s.DeleteAccessToken(ctx, active.Token))
+	count, err = s.CountActiveTokens(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before+1, count)
+}
+
+func testRevocation(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, other := newClient(t, s), newClient(t, s)
+	user, otherUser := newUser(t, s), newUser(t, s)
+	// A scope of its own, so other records in the storage are left alone
+	admin := "admin-" + uuid.New().String()
+
+	userToken := models.NewOauthAccessToken(client, user, 3600, "read "+admin)
+	userRefresh := models.NewOauthRefreshToken(client, user, 3600, "read "+admin)
+	userCode := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com", "read")
+	otherClientToken := models.NewOauthAccessToken(other, user, 3600, admin)
+	clientToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+	otherToken := models.NewOauthAccessToken(other, otherUser, 3600, admin+" write")
+	otherRefresh := models.NewOauthRefreshToken(other, otherUser, 3600, admin+"-write")
+	otherCode := models.NewOauthAuthorizationCode(other, otherUser, 600, "https://www.example.com", admin)
+	otherClientOnly := models.NewOauthAccessToken(other, nil, 3600, "read")
+	for _, accessToken := range []*models.OauthAccessToken{userToken, otherClientToken, clientToken, otherToken, otherClientOnly} {
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+		// Looked up first so caches hold a copy
+		_, err := s.GetAccessToken(ctx, accessToken.Token)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.StoreRefreshToken(ctx, userRefresh))
+	require.NoError(t, s.StoreRefreshToken(ctx, otherRefresh))
+	require.NoError(t, s.StoreAuthorizationCode(ctx, userCode))
+	require.NoError(t, s.StoreAuthorizationCode(ctx, otherCode))
+
+	revoked := func(result *storage.RevokeResult, err error) [3]int {
+		require.NoError(t, err)
+		assert.Len(t, result.Tokens, result.AccessTokens)
+		assert.Len(t, result.RefreshTokenValues, result.RefreshTokens)
+		return [3]int{result.AccessTokens, result.RefreshTokens, result.AuthorizationCodes}
+	}
+	gone := func(accessTokens ...*models.OauthAccessToken) {
+		for _, accessToken := range accessTokens {
+			_, err := s.GetAccessToken(ctx, accessToken.Token)
+			assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+		}
+	}
+
+	// An empty ID or scope revokes nothing
+	assert.Equal(t, [3]int{}, revoked(s.RevokeUserTokens(ctx, "")))
+	assert.Equal(t, [3]int{}, revoked(s.RevokeClientTokens(ctx, "")))
+	assert.Equal(t, [3]int{}, revoked(s.RevokeTokensWithScope(ctx, "")))
+
+	assert.Equal(t, [3]int{2, 1, 1}, revoked(s.RevokeUserTokens(ctx, user.ID)))
+	gone(userToken, otherClientToken)
+	_, err := s.GetRefreshToken(ctx, userRefresh.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	_, err = s.GetAuthorizationCode(ctx, userCode.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+
+	// Scopes only match whole words
+	assert.Equal(t, [3]int{1, 0, 1}, revoked(s.RevokeTokensWithScope(ctx, admin)))
+	gone(otherToken)
+	_, err = s.GetRefreshToken(ctx, otherRefresh.Token)
+	assert.NoError(t, err)
+	_, err = s.GetAuthorizationCode(ctx, otherCode.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+
+	assert.Equal(t, [3]int{1, 0, 0}, revoked(s.RevokeClientTokens(ctx, client.ID)))
+	gone(clientToken)
+	assert.Equal(t, [3]int{}, revoked(s.RevokeClientTokens(ctx, client.ID)))
+
+	_, err = s.GetAccessToken(ctx, otherClientOnly.Token)
+	assert.NoError(t, err)
+}
+
+// testTransactions only checks rollbacks when the storage can roll back
+func testTransactions(t *testing.T, s storage.Storage, rollback bool) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+	failed := errors.New("failed")
+
+	// Consuming a code and issuing a token commit together
+	code := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+	accessToken := models.NewOauthAccessToken(client, user, 3600, "read")
+	err := s.WithTx(ctx, func(tx storage.Storage) error {
+		if err := tx.DeleteAuthorizationCode(ctx, code.Code); err != nil {
+			return err
+		}
+		if err := tx.StoreAccessToken(ctx, accessToken); err != nil {
+			return err
+		}
+		// The transaction reads its own writes
+		_, err := tx.GetAccessToken(ctx, accessToken.Token)
+		return err
+	})
+	require.NoError(t, err)
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+	_, err = s.GetAccessToken(ctx, accessToken.Token)
+	assert.NoError(t, err)
+	if !rollback {
+		return
+	}
+
+	// An error rolls everything back, including writes of nested calls.
+	// The records are looked up first so caches hold a copy or a miss.
+	var created *models.OauthClient
+	rolledBack := models.NewOauthAccessToken(client, user, 3600, "read")
+	_, err = s.GetAccessToken(ctx, rolledBack.Token)
+	require.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	err = s.WithTx(ctx, func(tx storage.Storage) error {
+		created = newClient(t, tx)
+		if err := tx.DeleteAccessToken(ctx, accessToken.Token); err != nil {
+			return err
+		}
+		if err := tx.WithTx(ctx, func(nested storage.Storage) error {
+			return nested.StoreAccessToken(ctx, rolledBack)
+		}); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	_, err = s.GetClient(ctx, created.Key)
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+	_, err = s.GetAccessToken(ctx, accessToken.Token)
+	assert.NoError(t, err)
+	_, err = s.GetAccessToken(ctx, rolledBack.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+
+	// So does a panic, which is passed on
+	assert.PanicsWithValue(t, "boom", func() {
+		s.WithTx(ctx, func(tx storage.Storage) error {
+			created = newClient(t, tx)
+			panic("boom")
+		})
+	})
+	_, err = s.GetClient(ctx, created.Key)
+	assert.True(t, errors.Is(err, storage.ErrClientNotFound), "got %v", err)
+
+	// The storage is usable again after a rollback
+	newClient(t, s)
+}
+
+// testHashMigration stores tokens and codes in plaintext, as before hashing
+// was enabled, and checks HashedStorage rewrites them as hashes on first use
+func testHashMigration(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+	hasher, err := tokenhash.New("test_encryption_key")
+	require.NoError(t, err)
+	hashed := storage.NewHashedStorage(s, hasher)
+
+	accessToken := models.NewOauthAccessToken(client, user, 3600, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+	found, err := hashed.GetAccessToken(ctx, accessToken.Token)
+	require.NoError(t, err)
+	assert.Equal(t, accessToken.Token, found.Token)
+	_, err = s.GetAccessToken(ctx, accessToken.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	_, err = s.GetAccessToken(ctx, hasher.Hash(accessToken.Token))
+	assert.NoError(t, err)
+
+	refreshToken := models.NewOauthRefreshToken(client, user, 7200, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, refreshToken))
+	_, err = hashed.GetRefreshToken(ctx, refreshToken.Token)
+	require.NoError(t, err)
+	_, err = s.GetRefreshToken(ctx, refreshToken.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	_, err = s.GetRefreshToken(ctx, hasher.Hash(refreshToken.Token))
+	assert.NoError(t, err)
+
+	code := models.NewOauthAuthorizationCode(client, user, 600, "https://www.example.com/callback", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, code))
+	_, err = hashed.GetAuthorizationCode(ctx, code.Code)
+	require.NoError(t, err)
+	_, err = s.GetAuthorizationCode(ctx, code.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+	_, err = s.GetAuthorizationCode(ctx, hasher.Hash(code.Code))
+	assert.NoError(t, err)
+
+	// Migrated rows are found by their hash from then on
+	_, err = hashed.GetAccessToken(ctx, accessToken.Token)
+	assert.NoError(t, err)
+}
+
+func testBatchOperations(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client := newClient(t, s)
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		accessToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+		tokens = append(tokens, accessToken.Token)
+	}
+	expired := models.NewOauthAccessToken(client, nil, -60, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, expired))
+
+	// Missing and expired tokens are left out
+	found, err := s.BatchGetTokens(ctx, append([]string{expired.Token, uuid.New().String()}, tokens...))
+	require.NoError(t, err)
+	var foundTokens []string
+	for _, accessToken := range found {
+		foundTokens = append(foundTokens, accessToken.Token)
+	}
+	assert.ElementsMatch(t, tokens, foundTokens)
+
+	found, err = s.BatchGetTokens(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+
+	require.NoError(t, s.BatchDeleteTokens(ctx, append(tokens[:2:2], uuid.New().String())))
+	for i, token := range tokens {
+		_, err := s.GetAccessToken(ctx, token)
+		if i < 2 {
+			assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, s.BatchDeleteTokens(ctx, nil))
+}
+
+func testCleanupExpiredTokens(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client, user := newClient(t, s), newUser(t, s)
+
+	live := models.NewOauthAccessToken(client, user, 3600, "read")
+	require.NoError(t, s.StoreAccessToken(ctx, live))
+	liveRefresh := models.NewOauthRefreshToken(client, user, 3600, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, liveRefresh))
+
+	var expired []string
+	for i := 0; i < 3; i++ {
+		accessToken := models.NewOauthAccessToken(client, user, -60, "read")
+		require.NoError(t, s.StoreAccessToken(ctx, accessToken))
+		expired = append(expired, accessToken.Token)
+	}
+	expiredRefresh := models.NewOauthRefreshToken(client, user, -60, "read")
+	require.NoError(t, s.StoreRefreshToken(ctx, expiredRefresh))
+	expiredCode := models.NewOauthAuthorizationCode(client, user, -60, "https://www.example.com", "read")
+	require.NoError(t, s.StoreAuthorizationCode(ctx, expiredCode))
+
+	if cleaner, ok := s.(storage.BatchCleaner); ok {
+		// Batches never go over the limit and eventually run dry
+		for i := 0; ; i++ {
+			require.Less(t, i, 1000, "batch cleanup never ran dry")
+			removed, err := cleaner.CleanupExpiredTokensBatch(ctx, storage.AllIDs, 2)
+			require.NoError(t, err)
+			require.LessOrEqual(t, removed, 2)
+			if removed == 0 {
+				break
+			}
+		}
+	} else {
+		require.NoError(t, s.CleanupExpiredTokens(ctx))
+	}
+
+	// Expired records are gone rather than expired
+	for _, token := range expired {
+		_, err := s.GetAccessToken(ctx, token)
+		assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	}
+	_, err := s.GetRefreshToken(ctx, expiredRefresh.Token)
+	assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+	_, err = s.GetAuthorizationCode(ctx, expiredCode.Code)
+	assert.True(t, errors.Is(err, storage.ErrCodeNotFound), "got %v", err)
+
+	_, err = s.GetAccessToken(ctx, live.Token)
+	assert.NoError(t, err)
+	_, err = s.GetRefreshToken(ctx, liveRefresh.Token)
+	assert.NoError(t, err)
+}
+
+func testConcurrentAccess(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	client := newClient(t, s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := s.GetClient(ctx, client.Key)
+				assert.NoError(t, err)
+
+				accessToken := models.NewOauthAccessToken(client, nil, 3600, "read")
+				if !assert.NoError(t, s.StoreAccessToken(ctx, accessToken)) {
+					return
+				}
+				found, err := s.GetAccessToken(ctx, accessToken.Token)
+				if assert.NoError(t, err) {
+					assert.Equal(t, accessToken.Token, found.Token)
+				}
+				assert.NoError(t, s.DeleteAccessToken(ctx, accessToken.Token))
+				_, err = s.GetAccessToken(ctx, accessToken.Token)
+				assert.True(t, errors.Is(err, storage.ErrTokenNotFound), "got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func testHealthCheck(t *testing.T, s storage.Storage) {
+	assert.NoError(t, s.HealthCheck(context.Background()))
+}
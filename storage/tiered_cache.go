@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultL1TTL bounds how long a node may serve an entry from its local
+// cache after it was changed or deleted elsewhere, should the invalidation
+// message be lost
+const DefaultL1TTL = 10 * time.Second
+
+// Invalidation tells the other nodes which keys to drop from their local
+// cache, Flush drops everything
+type Invalidation struct {
+	Node  string   `json:"node"`
+	Keys  []string `json:"keys,omitempty"`
+	Flush bool     `json:"flush,omitempty"`
+}
+
+// InvalidationBus carries invalidations between the nodes sharing an L2 cache
+type InvalidationBus interface {
+	// Publish sends an invalidation to every subscribed node
+	Publish(ctx context.Context, invalidation *Invalidation) error
+
+	// Subscribe calls handler for every invalidation received until the bus
+	// is closed, it returns once the subscription is active
+	Subscribe(ctx context.Context, handler func(invalidation *Invalidation)) error
+
+	Close() error
+}
+
+// TTLReader is implemented by caches that can tell how long their entries
+// have left, so a TieredCache over them never keeps an entry in L1 longer
+// than it stays in L2
+type TTLReader interface {
+	// TTLs returns the time left of each key found, zero for keys that never
+	// expire. Missing keys are left out.
+	TTLs(ctx context.Context, keys []string) (map[string]time.Duration, error)
+}
+
+// TieredCache layers a small in-process LRU (L1) over a shared cache (L2).
+// Reads are served from L1 when possible, writes go to both tiers and writes
+// and deletes are published on the bus so other nodes evict their L1 copies.
+// Entries stay in L1 for at most the L1 TTL, which bounds staleness when a
+// message is lost. Values read from L2 are kept in L1 no longer than they
+// have left in L2 when L2 implements TTLReader, other L2 caches may expire
+// an entry up to the L1 TTL before L1 does.
+type TieredCache struct {
+	l1    *MemoryCache
+	l2    CacheProvider
+	bus   InvalidationBus
+	l1TTL time.Duration
+	node  string
+}
+
+// NewTieredCache creates a two-tier cache and subscribes to the bus, a nil
+// bus keeps invalidations local to this node
+func NewTieredCache(l1 *MemoryCache, l2 CacheProvider, bus InvalidationBus, l1TTL time.Duration) (*TieredCache, error) {
+	if l1TTL <= 0 {
+		l1TTL = DefaultL1TTL
+	}
+
+	node := make([]byte, 8)
+	if _, err := rand.Read(node); err != nil {
+		return nil, fmt.Errorf("failed to generate node id: %w", err)
+	}
+
+	t := &TieredCache{
+		l1:    l1,
+		l2:    l2,
+		bus:   bus,
+		l1TTL: l1TTL,
+		node:  hex.EncodeToString(node),
+	}
+	if bus != nil {
+		if err := bus.Subscribe(context.Background(), t.invalidate); err != nil {
+			return nil, fmt.Errorf("failed to subscribe to invalidations: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// SetMetrics passes the provider on to L2
+func (t *TieredCache) SetMetrics(metrics MetricsProvider) {
+	if instrumented, ok := t.l2.(Instrumented); ok {
+		instrumented.SetMetrics(metrics)
+	}
+}
+
+// Set stores a value in both tiers and drops it from the L1 of other nodes
+func (t *TieredCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := t.l2.Set(ctx, key, value, ttl); err != nil {
+		t.l1.Delete(ctx, key)
+		return err
+	}
+	if err := t.l1.Set(ctx, key, value, t.localTTL(ttl)); err != nil {
+		return err
+	}
+	return t.publish(ctx, &Invalidation{Keys: []string{key}})
+}
+
+// Get reads from L1 and falls back to L2, values found in L2 are kept in L1
+func (t *TieredCache) Get(ctx context.Context, key string, dest interface{}) error {
+	if err := t.l1.Get(ctx, key, dest); err == nil {
+		return nil
+	}
+	if err := t.l2.Get(ctx, key, dest); err != nil {
+		return err
+	}
+	if ttl, ok := t.remainingTTLs(ctx, []string{key})[key]; ok {
+		t.l1.Set(ctx, key, dest, ttl)
+	}
+	return nil
+}
+
+// Delete removes a value from both tiers and from the L1 of other nodes
+func (t *TieredCache) Delete(ctx context.Context, key string) error {
+	return t.DeleteMulti(ctx, []string{key})
+}
+
+// SetMulti stores multiple values in both tiers and drops them from the L1
+// of other nodes
+func (t *TieredCache) SetMulti(ctx context.Context, items map[string]interface{}, ttl time.Duration) error {
+	if len(items) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	if err := t.l2.SetMulti(ctx, items, ttl); err != nil {
+		t.l1.DeleteMulti(ctx, keys)
+		return err
+	}
+	if err := t.l1.SetMulti(ctx, items, t.localTTL(ttl)); err != nil {
+		return err
+	}
+	return t.publish(ctx, &Invalidation{Keys: keys})
+}
+
+// GetMulti reads from L1 and fetches the remaining keys from L2
+func (t *TieredCache) GetMulti(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	result, err := t.l1.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if _, found := result[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	fetched, err := t.l2.GetMulti(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	if len(fetched) > 0 {
+		fetchedKeys := make([]string, 0, len(fetched))
+		for key := range fetched {
+			fetchedKeys = append(fetchedKeys, key)
+		}
+		ttls := t.remainingTTLs(ctx, fetchedKeys)
+		for key, value := range fetched {
+			if ttl, ok := ttls[key]; ok {
+				t.l1.Set(ctx, key, value, ttl)
+			}
+		}
+	}
+	for key, value := range fetched {
+		result[key] = value
+	}
+	return result, nil
+}
+
+// DeleteMulti removes values from both tiers and from the L1 of other nodes
+func (t *TieredCache) DeleteMulti(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	t.l1.DeleteMulti(ctx, keys)
+	if err := t.l2.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	return t.publish(ctx, &Invalidation{Keys: keys})
+}
+
+// Increment is passed to L2, counters have to be shared by all nodes
+func (t *TieredCache) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	t.l1.Delete(ctx, key)
+	return t.l2.Increment(ctx, key, delta, ttl)
+}
+
+// FlushAll clears both tiers and the L1 of other nodes
+func (t *TieredCache) FlushAll(ctx context.Context) error {
+	t.l1.FlushAll(ctx)
+	if err := t.l2.FlushAll(ctx); err != nil {
+		return err
+	}
+	return t.publish(ctx, &Invalidation{Flush: true})
+}
+
+// Stats returns the L2 statistics with the reads served by L1 counted as
+// hits, as they would have been L2 hits without it
+func (t *TieredCache) Stats(ctx context.Context) (*CacheStats, error) {
+	stats, err := t.l2.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local, err := t.l1.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	combined := *stats
+	combined.Hits += local.Hits
+	combined.HitRatio = 0
+	if combined.Hits+combined.Misses > 0 {
+		combined.HitRatio = float64(combined.Hits) / float64(combined.Hits+combined.Misses)
+	}
+	return &combined, nil
+}
+
+// Close closes the bus and both tiers
+func (t *TieredCache) Close() error {
+	var busErr error
+	if t.bus != nil {
+		busErr = t.bus.Close()
+	}
+	return errors.Join(busErr, t.l1.Close(), t.l2.Close())
+}
+
+func (t *TieredCache) publish(ctx context.Context, invalidation *Invalidation) error {
+	if t.bus == nil {
+		return nil
+	}
+	invalidation.Node = t.node
+	if err := t.bus.Publish(ctx, invalidation); err != nil {
+		return fmt.Errorf("failed to publish invalidation: %w", err)
+	}
+	return nil
+}
+
+// invalidate applies an invalidation received from another node
+func (t *TieredCache) invalidate(invalidation *Invalidation) {
+	if invalidation.Node == t.node {
+		return
+	}
+	ctx := context.Background()
+	if invalidation.Flush {
+		t.l1.FlushAll(ctx)
+		return
+	}
+	t.l1.DeleteMulti(ctx, invalidation.Keys)
+}
+
+// remainingTTLs returns how long each of keys may stay in L1, what it has
+// left in L2 capped at the L1 TTL. Keys gone from L2 are left out, and so
+// are all keys when L2 fails to tell.
+func (t *TieredCache) remainingTTLs(ctx context.Context, keys []string) map[string]time.Duration {
+	ttls := make(map[string]time.Duration, len(keys))
+	reader, ok := t.l2.(TTLReader)
+	if !ok {
+		for _, key := range keys {
+			ttls[key] = t.l1TTL
+		}
+		return ttls
+	}
+	remaining, err := reader.TTLs(ctx, keys)
+	if err != nil {
+		return ttls
+	}
+	for key, ttl := range remaining {
+		ttls[key] = t.localTTL(ttl)
+	}
+	return ttls
+}
+
+// localTTL caps ttl at the L1 TTL, zero means no expiry in L2
+func (t *TieredCache) localTTL(ttl time.Duration) time.Duration {
+	if ttl == 0 || ttl > t.l1TTL {
+		return t.l1TTL
+	}
+	return ttl
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localBus delivers invalidations synchronously to every subscriber
+type localBus struct {
+	mu       sync.Mutex
+	handlers []func(*Invalidation)
+}
+
+func (b *localBus) Publish(ctx context.Context, invalidation *Invalidation) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, handler := range b.handlers {
+		handler(invalidation)
+	}
+	return nil
+}
+
+func (b *localBus) Subscribe(ctx context.Context, handler func(*Invalidation)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *localBus) Close() error { return nil }
+
+func newTestTieredCache(t *testing.T, l2 CacheProvider, bus InvalidationBus, l1TTL time.Duration) *TieredCache {
+	l1, err := NewMemoryCache(map[string]interface{}{"max_size": 10})
+	require.NoError(t, err)
+	cache, err := NewTieredCache(l1, l2, bus, l1TTL)
+	require.NoError(t, err)
+	return cache
+}
+
+func TestTieredCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	l2, err := NewMemoryCache(nil)
+	require.NoError(t, err)
+	bus := new(localBus)
+	nodeA := newTestTieredCache(t, l2, bus, time.Minute)
+	nodeB := newTestTieredCache(t, l2, bus, time.Minute)
+
+	require.NoError(t, nodeA.Set(ctx, "token", "foo", time.Hour))
+
+	// Node B reads through to L2 and keeps the value in its L1
+	var s string
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	assert.Equal(t, "foo", s)
+	stats, err := nodeB.l1.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Keys)
+
+	// Deleting on node A evicts the L1 copy on node B
+	require.NoError(t, nodeA.Delete(ctx, "token"))
+	assert.Equal(t, ErrCacheMiss, nodeB.Get(ctx, "token", &s))
+
+	// So does overwriting it
+	require.NoError(t, nodeA.Set(ctx, "token", "foo", time.Hour))
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	require.NoError(t, nodeA.Set(ctx, "token", "bar", time.Hour))
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	assert.Equal(t, "bar", s)
+	require.NoError(t, nodeA.SetMulti(ctx, map[string]interface{}{"token": "baz"}, time.Hour))
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	assert.Equal(t, "baz", s)
+
+	// Flushing clears every L1
+	require.NoError(t, nodeA.Set(ctx, "token", "bar", time.Hour))
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	require.NoError(t, nodeA.FlushAll(ctx))
+	assert.Equal(t, ErrCacheMiss, nodeB.Get(ctx, "token", &s))
+
+	require.NoError(t, nodeA.SetMulti(ctx, map[string]interface{}{"a": 1, "b": 2}, time.Hour))
+	values, err := nodeB.GetMulti(ctx, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": float64(1), "b": float64(2)}, values)
+	require.NoError(t, nodeA.DeleteMulti(ctx, []string{"a"}))
+	values, err = nodeB.GetMulti(ctx, []string{"a", "b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"b": float64(2)}, values)
+
+	// Counters always live in L2
+	_, err = nodeA.Increment(ctx, "counter", 1, time.Hour)
+	require.NoError(t, err)
+	value, err := nodeB.Increment(ctx, "counter", 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+}
+
+func TestTieredCacheL1TTL(t *testing.T) {
+	ctx := context.Background()
+	l2, err := NewMemoryCache(nil)
+	require.NoError(t, err)
+	// Without a bus a change on another node is only seen once L1 expires
+	nodeA := newTestTieredCache(t, l2, nil, 20*time.Millisecond)
+	nodeB := newTestTieredCache(t, l2, nil, 20*time.Millisecond)
+
+	require.NoError(t, nodeA.Set(ctx, "token", "foo", time.Hour))
+	var s string
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+
+	require.NoError(t, nodeA.Delete(ctx, "token"))
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	assert.Equal(t, "foo", s)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, ErrCacheMiss, nodeB.Get(ctx, "token", &s))
+
+	stats, err := nodeB.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestTieredCacheL1ExpiresWithL2(t *testing.T) {
+	ctx := context.Background()
+	l2, err := NewMemoryCache(nil)
+	require.NoError(t, err)
+	nodeA := newTestTieredCache(t, l2, nil, time.Minute)
+	nodeB := newTestTieredCache(t, l2, nil, time.Minute)
+
+	// Values read from L2 stay in L1 no longer than they have left in L2
+	require.NoError(t, nodeA.Set(ctx, "token", "foo", 20*time.Millisecond))
+	require.NoError(t, nodeA.SetMulti(ctx, map[string]interface{}{"a": 1}, 20*time.Millisecond))
+	var s string
+	require.NoError(t, nodeB.Get(ctx, "token", &s))
+	values, err := nodeB.GetMulti(ctx, []string{"a"})
+	require.NoError(t, err)
+	assert.Len(t, values, 1)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, ErrCacheMiss, nodeB.Get(ctx, "token", &s))
+	values, err = nodeB.GetMulti(ctx, []string{"a"})
+	require.NoError(t, err)
+	assert.Empty(t, values)
+
+	// Values that never expire in L2 stay for the L1 TTL
+	require.NoError(t, nodeA.Set(ctx, "forever", "foo", 0))
+	ttls, err := l2.TTLs(ctx, []string{"forever", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"forever": 0}, ttls)
+	assert.Equal(t, map[string]time.Duration{"forever": time.Minute}, nodeB.remainingTTLs(ctx, []string{"forever", "missing"}))
+}
@@ -0,0 +1,157 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/oauth/tokentypes"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/util"
+)
+
+// generateTokens creates an access token and refresh token for a user (logs him/her in)
+// and stores them in store
+func (s *SDK) generateTokens(ctx context.Context, store storage.Storage, client *models.OauthClient, user *models.OauthUser, scope string) (*models.OauthAccessToken, *models.OauthRefreshToken, error) {
+	// Create a new access token
+	accessToken, err := s.grantAccessToken(ctx, store, client, user, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a new refresh token
+	refreshToken, err := s.grantRefreshToken(ctx, store, client, user, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// grantAccessToken creates and stores a new access token
+func (s *SDK) grantAccessToken(ctx context.Context, store storage.Storage, client *models.OauthClient, user *models.OauthUser, scope string) (*models.OauthAccessToken, error) {
+	accessToken := models.NewOauthAccessToken(
+		client,
+		user,
+		int(s.config.Performance.AccessTokenTTL.Seconds()), // expires in
+		scope,
+	)
+	if err := store.StoreAccessToken(ctx, accessToken); err != nil {
+		return nil, err
+	}
+	accessToken.Client = client
+	accessToken.User = user
+
+	return accessToken, nil
+}
+
+// grantRefreshToken creates and stores a new refresh token
+func (s *SDK) grantRefreshToken(ctx context.Context, store storage.Storage, client *models.OauthClient, user *models.OauthUser, scope string) (*models.OauthRefreshToken, error) {
+	refreshToken := models.NewOauthRefreshToken(
+		client,
+		user,
+		int(s.config.Performance.RefreshTokenTTL.Seconds()), // expires in
+		scope,
+	)
+	if err := store.StoreRefreshToken(ctx, refreshToken); err != nil {
+		return nil, err
+	}
+	refreshToken.Client = client
+	refreshToken.User = user
+
+	return refreshToken, nil
+}
+
+// validateAccessToken returns a valid non expired access token
+func (s *SDK) validateAccessToken(ctx context.Context, token string) (accessToken *models.OauthAccessToken, err error) {
+	start := time.Now()
+	defer func() {
+		s.metrics.RecordTokenValidation(err == nil, time.Since(start))
+	}()
+
+	// Fetch the access token from the storage
+	accessToken, err = s.storage.GetAccessToken(ctx, token)
+	if errors.Is(err, storage.ErrTokenExpired) {
+		return nil, ErrAccessTokenExpired
+	}
+	if errors.Is(err, storage.ErrTokenNotFound) || (err == nil && accessToken == nil) {
+		return nil, ErrAccessTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the access token hasn't expired
+	if time.Now().UTC().After(accessToken.ExpiresAt) {
+		return nil, ErrAccessTokenExpired
+	}
+
+	return accessToken, nil
+}
+
+// newTokenResponse builds a token endpoint response
+func (s *SDK) newTokenResponse(accessToken *models.OauthAccessToken, refreshToken *models.OauthRefreshToken) *TokenResponse {
+	response := &TokenResponse{
+		AccessToken: accessToken.Token,
+		TokenType:   tokentypes.Bearer,
+		ExpiresIn:   int(s.config.Performance.AccessTokenTTL.Seconds()),
+		Scope:       accessToken.Scope,
+	}
+	if accessToken.UserID.Valid {
+		response.UserID = accessToken.UserID.String
+	}
+	if refreshToken != nil {
+		response.RefreshToken = refreshToken.Token
+	}
+	return response
+}
+
+// getScope takes a requested scope and, if it's empty, returns the default
+// scope, if not empty, it validates the requested scope
+func (s *SDK) getScope(ctx context.Context, requestedScope string) (string, error) {
+	// Return the default scope if the requested scope is empty
+	if requestedScope == "" {
+		return s.storage.GetDefaultScope(ctx)
+	}
+
+	// All of the requested scopes must exist
+	for _, scope := range strings.Split(requestedScope, " ") {
+		scopeObj, err := s.storage.GetScope(ctx, scope)
+		if errors.Is(err, storage.ErrScopeNotFound) {
+			return "", ErrInvalidScope
+		}
+		if err != nil {
+			return "", err
+		}
+		if scopeObj == nil {
+			return "", ErrInvalidScope
+		}
+	}
+
+	return requestedScope, nil
+}
+
+// getRefreshTokenScope returns scope for a new refresh token
+func (s *SDK) getRefreshTokenScope(ctx context.Context, refreshToken *models.OauthRefreshToken, requestedScope string) (string, error) {
+	var (
+		scope = refreshToken.Scope // default to the scope originally granted by the resource owner
+		err   error
+	)
+
+	// If the scope is specified in the request, get the scope string
+	if requestedScope != "" {
+		scope, err = s.getScope(ctx, requestedScope)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Requested scope CANNOT include any scope not originally granted
+	if !util.SpaceDelimitedStringNotGreater(scope, refreshToken.Scope) {
+		return "", ErrRequestedScopeCannotBeGreater
+	}
+
+	return scope, nil
+}
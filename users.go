@@ -0,0 +1,72 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/RichardKnop/go-oauth2-server/models"
+	"github.com/RichardKnop/go-oauth2-server/storage"
+	"github.com/RichardKnop/go-oauth2-server/util"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/google/uuid"
+)
+
+// CreateUser creates a user with a bcrypt hashed password. A password that
+// breaks the security policy returns a *password.PolicyError listing every
+// violated rule, an empty password creates a user without one.
+func (s *SDK) CreateUser(ctx context.Context, roleID, username, password string) (*models.OauthUser, error) {
+	// Usernames are case insensitive
+	user := &models.OauthUser{
+		MyGormModel: models.MyGormModel{
+			ID:        uuid.New().String(),
+			CreatedAt: time.Now().UTC(),
+		},
+		RoleID:   util.StringOrNull(roleID),
+		Username: strings.ToLower(username),
+		Password: util.StringOrNull(""),
+	}
+	if user.Username == "" {
+		return nil, ErrCannotSetEmptyUsername
+	}
+
+	// If the password is being set already, create a bcrypt hash
+	if password != "" {
+		if err := s.passwordPolicy().Validate(password); err != nil {
+			return nil, err
+		}
+		passwordHash, err := pass.HashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		user.Password = util.StringOrNull(string(passwordHash))
+	}
+
+	// Check the username is available
+	_, err := s.storage.GetUser(ctx, user.Username)
+	if err == nil {
+		return nil, ErrUsernameTaken
+	}
+	if !errors.Is(err, storage.ErrUserNotFound) {
+		return nil, err
+	}
+
+	if err := s.storage.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// passwordPolicy returns the password policy from the security settings
+func (s *SDK) passwordPolicy() *pass.Policy {
+	if s.config.Security == nil {
+		return new(pass.Policy)
+	}
+	return &pass.Policy{
+		MinLength:        s.config.Security.MinPasswordLength,
+		RequireUppercase: s.config.Security.RequireUppercase,
+		RequireNumbers:   s.config.Security.RequireNumbers,
+		RequireSymbols:   s.config.Security.RequireSymbols,
+	}
+}
@@ -0,0 +1,46 @@
+package oauth2server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/oauth/roles"
+	pass "github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateUser(t *testing.T) {
+	sdk, _ := newTestSDKFromBuilder(t, New().WithSecurity(&SecurityConfig{
+		MinPasswordLength: 10,
+		RequireUppercase:  true,
+		RequireNumbers:    true,
+		RequireSymbols:    true,
+	}))
+	ctx := context.Background()
+
+	// Every violated rule is returned at once
+	user, err := sdk.CreateUser(ctx, roles.User, "new@user", "secret")
+	assert.Nil(t, user)
+	policyErr := new(pass.PolicyError)
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.Len(t, policyErr.Violations, 4)
+	}
+	assert.Equal(t, http.StatusBadRequest, getErrStatusCode(err))
+
+	// Usernames are case insensitive
+	user, err = sdk.CreateUser(ctx, roles.User, "New@User", "Sup3r-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "new@user", user.Username)
+	assert.NoError(t, pass.VerifyPassword(user.Password.String, "Sup3r-secret"))
+
+	_, err = sdk.CreateUser(ctx, roles.User, "new@user", "Sup3r-secret")
+	assert.Equal(t, ErrUsernameTaken, err)
+
+	// Users can be created without a password
+	user, err = sdk.CreateUser(ctx, roles.User, "nopass@user", "")
+	require.NoError(t, err)
+	assert.Empty(t, user.Password.String)
+}
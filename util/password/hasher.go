@@ -0,0 +1,196 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrMismatch ...
+	ErrMismatch = errors.New("Password does not match")
+	// ErrUnsupportedHash ...
+	ErrUnsupportedHash = errors.New("Unsupported password hash")
+	// ErrInvalidHashParameters ...
+	ErrInvalidHashParameters = errors.New("Invalid password hash parameters")
+)
+
+// BcryptHasher hashes passwords with bcrypt, the format produced by
+// HashPassword and used for client secrets by the oauth service
+type BcryptHasher struct {
+	Cost int
+}
+
+// NewBcryptHasher returns a bcrypt hasher with the default cost
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+// Hash returns a bcrypt hash of the password
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify compares the password with a bcrypt hash in constant time
+func (h *BcryptHasher) Verify(hash, password string) error {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return ErrUnsupportedHash
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// NeedsRehash returns true if the hash is not bcrypt or uses another cost
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.effectiveCost()
+}
+
+// effectiveCost mirrors bcrypt, which uses the default for too low costs
+func (h *BcryptHasher) effectiveCost() int {
+	if h.Cost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// Bounds on argon2id parameters, hashes are verified with the parameters
+// they store, so a stored hash could otherwise make argon2 panic or allocate
+// any amount of memory
+const (
+	maxArgon2idTime   = 16
+	maxArgon2idMemory = 1024 * 1024 // 1 GiB in KiB
+	maxArgon2idKeyLen = 128
+)
+
+// Argon2idHasher hashes passwords with argon2id, hashes are encoded in the
+// PHC string format so the parameters can change over time
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// NewArgon2idHasher returns an argon2id hasher with the parameters
+// recommended by RFC 9106 for memory constrained environments
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+// Hash returns an argon2id hash of the password with a random salt
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	if err := h.validate(h.KeyLen); err != nil {
+		return "", err
+	}
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.Memory,
+		h.Time,
+		h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify compares the password with an argon2id hash in constant time,
+// using the parameters stored in the hash
+func (h *Argon2idHasher) Verify(hash, password string) error {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// NeedsRehash returns true if the hash is not argon2id or uses other parameters
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time != h.Time ||
+		params.Memory != h.Memory ||
+		params.Threads != h.Threads ||
+		uint32(len(key)) != h.KeyLen ||
+		uint32(len(salt)) != h.SaltLen
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func decodeArgon2id(hash string) (*Argon2idHasher, []byte, []byte, error) {
+	if !strings.HasPrefix(hash, argon2idPrefix) {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+	parts := strings.Split(hash[len(argon2idPrefix):], "$")
+	if len(parts) != 4 {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+	params := new(Argon2idHasher)
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+	if err := params.validate(uint32(len(key))); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+// validate returns ErrInvalidHashParameters unless argon2 can derive a key
+// of keyLen bytes with the parameters within the bounds above, argon2 needs
+// at least 8 KiB of memory per thread
+func (h *Argon2idHasher) validate(keyLen uint32) error {
+	if h.Time < 1 || h.Time > maxArgon2idTime ||
+		h.Threads < 1 ||
+		h.Memory < 8*uint32(h.Threads) || h.Memory > maxArgon2idMemory ||
+		keyLen < 1 || keyLen > maxArgon2idKeyLen {
+		return ErrInvalidHashParameters
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package password_test
+
+import (
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBcryptHasher(t *testing.T) {
+	hasher := &password.BcryptHasher{Cost: 4}
+
+	hash, err := hasher.Hash("test_secret")
+	require.NoError(t, err)
+	assert.NoError(t, hasher.Verify(hash, "test_secret"))
+	assert.Equal(t, password.ErrMismatch, hasher.Verify(hash, "bogus"))
+	assert.False(t, hasher.NeedsRehash(hash))
+
+	// Hashes created by HashPassword are compatible
+	legacy, err := password.HashPassword("test_secret")
+	require.NoError(t, err)
+	assert.NoError(t, hasher.Verify(string(legacy), "test_secret"))
+	assert.True(t, hasher.NeedsRehash(string(legacy)))
+	assert.False(t, password.NewBcryptHasher().NeedsRehash(string(legacy)))
+
+	assert.Equal(t, password.ErrUnsupportedHash, hasher.Verify("$argon2id$v=19$m=8,t=1,p=1$c2FsdA$a2V5", "test_secret"))
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := &password.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+	hash, err := hasher.Hash("test_secret")
+	require.NoError(t, err)
+	assert.Contains(t, hash, "$argon2id$v=19$m=1024,t=1,p=1$")
+	assert.NoError(t, hasher.Verify(hash, "test_secret"))
+	assert.Equal(t, password.ErrMismatch, hasher.Verify(hash, "bogus"))
+	assert.False(t, hasher.NeedsRehash(hash))
+
+	// Salts are random
+	other, err := hasher.Hash("test_secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	// Hashes with other parameters still verify but need rehashing
+	stronger := &password.Argon2idHasher{Time: 2, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	assert.NoError(t, stronger.Verify(hash, "test_secret"))
+	assert.True(t, stronger.NeedsRehash(hash))
+
+	bcryptHash, err := password.HashPassword("test_secret")
+	require.NoError(t, err)
+	assert.Equal(t, password.ErrUnsupportedHash, hasher.Verify(string(bcryptHash), "test_secret"))
+	assert.True(t, hasher.NeedsRehash(string(bcryptHash)))
+	assert.Equal(t, password.ErrUnsupportedHash, hasher.Verify("$argon2id$bogus", "test_secret"))
+}
+
+func TestArgon2idHasherParameterBounds(t *testing.T) {
+	hasher := password.NewArgon2idHasher()
+
+	// Parameters argon2 panics on or that would use too much memory are
+	// rejected before deriving a key
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=4,t=1,p=1", "m=4194304,t=1,p=1", "m=1024,t=1000,p=1"} {
+		hash := "$argon2id$v=19$" + params + "$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+		assert.Equal(t, password.ErrInvalidHashParameters, hasher.Verify(hash, "test_secret"), params)
+		assert.True(t, hasher.NeedsRehash(hash), params)
+	}
+
+	_, err := (&password.Argon2idHasher{Time: 0, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}).Hash("test_secret")
+	assert.Equal(t, password.ErrInvalidHashParameters, err)
+}
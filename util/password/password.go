@@ -1,11 +1,17 @@
 package password
 
 import (
+	"strings"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
-// VerifyPassword compares password and the hashed password
+// VerifyPassword compares password and the hashed password, argon2id hashes
+// are accepted as well so secrets rehashed by an Argon2idHasher keep working
 func VerifyPassword(passwordHash, password string) error {
+	if strings.HasPrefix(passwordHash, argon2idPrefix) {
+		return NewArgon2idHasher().Verify(passwordHash, password)
+	}
 	return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
 }
 
@@ -21,4 +21,10 @@ func TestVerifyPassword(t *testing.T) {
 
 	// Test invalid password
 	assert.NotNil(t, password.VerifyPassword("bogus", "password"))
+
+	// Test argon2id hashes
+	hash, err := (&password.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}).Hash("test_secret")
+	assert.NoError(t, err)
+	assert.Nil(t, password.VerifyPassword(hash, "test_secret"))
+	assert.Equal(t, password.ErrMismatch, password.VerifyPassword(hash, "bogus"))
 }
@@ -0,0 +1,120 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy rules, returned with each violation so a UI can
+// highlight the failed rules
+const (
+	RuleMinLength = "min_length"
+	RuleUppercase = "uppercase"
+	RuleNumber    = "number"
+	RuleSymbol    = "symbol"
+)
+
+var (
+	// ErrTooShort ...
+	ErrTooShort = errors.New("Password is too short")
+	// ErrUppercaseRequired ...
+	ErrUppercaseRequired = errors.New("Password must contain an uppercase letter")
+	// ErrNumberRequired ...
+	ErrNumberRequired = errors.New("Password must contain a number")
+	// ErrSymbolRequired ...
+	ErrSymbolRequired = errors.New("Password must contain a symbol")
+)
+
+// Policy defines the rules a password has to satisfy
+type Policy struct {
+	MinLength        int
+	RequireUppercase bool
+	RequireNumbers   bool
+	RequireSymbols   bool
+}
+
+// Violation is a single broken password policy rule, it unwraps to one of
+// the Err* sentinel errors
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	err     error
+}
+
+// Error returns the violation message
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// Unwrap returns the sentinel error for the violated rule
+func (v *Violation) Unwrap() error {
+	return v.err
+}
+
+// PolicyError lists every rule a password violates
+type PolicyError struct {
+	Violations []*Violation `json:"violations"`
+}
+
+// Error joins all violation messages
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap makes every violation matchable with errors.Is and errors.As
+func (e *PolicyError) Unwrap() []error {
+	errs := make([]error, len(e.Violations))
+	for i, violation := range e.Violations {
+		errs[i] = violation
+	}
+	return errs
+}
+
+// Validate checks the password against every rule of the policy and
+// returns a *PolicyError listing all violations, or nil
+func (p *Policy) Validate(password string) error {
+	var upper, number, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			number = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	policyErr := new(PolicyError)
+	if utf8.RuneCountInString(password) < p.MinLength {
+		policyErr.add(RuleMinLength, ErrTooShort, fmt.Sprintf(
+			"Password must be at least %d characters long",
+			p.MinLength,
+		))
+	}
+	if p.RequireUppercase && !upper {
+		policyErr.add(RuleUppercase, ErrUppercaseRequired, ErrUppercaseRequired.Error())
+	}
+	if p.RequireNumbers && !number {
+		policyErr.add(RuleNumber, ErrNumberRequired, ErrNumberRequired.Error())
+	}
+	if p.RequireSymbols && !symbol {
+		policyErr.add(RuleSymbol, ErrSymbolRequired, ErrSymbolRequired.Error())
+	}
+
+	if len(policyErr.Violations) == 0 {
+		return nil
+	}
+	return policyErr
+}
+
+func (e *PolicyError) add(rule string, err error, message string) {
+	e.Violations = append(e.Violations, &Violation{Rule: rule, Message: message, err: err})
+}
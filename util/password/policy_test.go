@@ -0,0 +1,45 @@
+package password_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/util/password"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	policy := &password.Policy{
+		MinLength:        8,
+		RequireUppercase: true,
+		RequireNumbers:   true,
+		RequireSymbols:   true,
+	}
+
+	// Valid password
+	assert.Nil(t, policy.Validate("Sup3r-secret"))
+
+	// Every violated rule is reported at once
+	err := policy.Validate("secret")
+	policyErr := new(password.PolicyError)
+	if assert.True(t, errors.As(err, &policyErr)) {
+		var rules []string
+		for _, violation := range policyErr.Violations {
+			rules = append(rules, violation.Rule)
+		}
+		assert.Equal(t, []string{
+			password.RuleMinLength,
+			password.RuleUppercase,
+			password.RuleNumber,
+			password.RuleSymbol,
+		}, rules)
+		assert.Equal(t, "Password must be at least 8 characters long", policyErr.Violations[0].Message)
+	}
+	assert.True(t, errors.Is(err, password.ErrTooShort))
+	assert.True(t, errors.Is(err, password.ErrSymbolRequired))
+
+	// Length is counted in characters, not bytes
+	err = (&password.Policy{MinLength: 4}).Validate("ééé")
+	assert.True(t, errors.Is(err, password.ErrTooShort))
+	assert.False(t, errors.Is(err, password.ErrUppercaseRequired))
+}
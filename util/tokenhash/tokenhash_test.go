@@ -0,0 +1,46 @@
+package tokenhash_test
+
+import (
+	"testing"
+
+	"github.com/RichardKnop/go-oauth2-server/util/tokenhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	_, err := tokenhash.New("")
+	assert.Equal(t, tokenhash.ErrKeyRequired, err)
+
+	hasher, err := tokenhash.New("secret_key")
+	require.NoError(t, err)
+
+	hash := hasher.Hash("test_token")
+	assert.True(t, tokenhash.IsHashed(hash))
+	assert.Equal(t, hash, hasher.Hash("test_token"))
+	assert.NotEqual(t, hash, hasher.Hash("other_token"))
+	assert.False(t, tokenhash.IsHashed("test_token"))
+
+	// Hashes fit into the token columns
+	assert.True(t, len(hash) <= 100)
+
+	// Hashes depend on the key
+	other, err := tokenhash.New("other_key")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other.Hash("test_token"))
+
+	// Nil hasher leaves tokens unchanged
+	var disabled *tokenhash.Hasher
+	assert.Equal(t, "test_token", disabled.Hash("test_token"))
+}
+
+func TestCandidates(t *testing.T) {
+	hasher, err := tokenhash.New("secret_key")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{hasher.Hash("test_token"), "test_token"}, hasher.Candidates("test_token"))
+
+	// A presented hash is never matched as plaintext
+	hash := hasher.Hash("test_token")
+	assert.Equal(t, []string{hasher.Hash(hash)}, hasher.Candidates(hash))
+}